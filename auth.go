@@ -0,0 +1,276 @@
+package getparty
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	hAuthorization   = "Authorization"
+	hWWWAuthenticate = "Www-Authenticate"
+)
+
+// authState is shared by all transports of the program. Digest challenges
+// are remembered per host, so parts don't need to be challenged one by one.
+// Bearer token is sent only to hosts of user provided urls, never to hosts
+// redirected to, which are often CDNs with signed urls of their own.
+type authState struct {
+	token      string
+	mu         sync.Mutex
+	tokenHosts map[string]bool
+	digests    map[string]*digestChallenge
+}
+
+func newAuthState(token string) *authState {
+	return &authState{
+		token:      token,
+		tokenHosts: make(map[string]bool),
+		digests:    make(map[string]*digestChallenge),
+	}
+}
+
+// allowToken marks host of rawUrl as one, bearer token is sent to
+func (a *authState) allowToken(rawUrl string) {
+	if a == nil || a.token == "" {
+		return
+	}
+	if u, err := url.Parse(rawUrl); err == nil {
+		a.mu.Lock()
+		a.tokenHosts[u.Host] = true
+		a.mu.Unlock()
+	}
+}
+
+// authorize returns value of Authorization header for req, if any
+func (a *authState) authorize(req *http.Request) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c := a.digests[req.URL.Host]; c != nil && req.URL.User != nil {
+		return c.authorize(req)
+	}
+	if a.token != "" && a.tokenHosts[req.URL.Host] {
+		return "Bearer " + a.token
+	}
+	return ""
+}
+
+// challenge remembers digest challenge of resp, reporting whether request
+// is worth repeating with it
+func (a *authState) challenge(req *http.Request, resp *http.Response) bool {
+	if req.URL.User == nil {
+		return false
+	}
+	var best *digestChallenge
+	for _, h := range resp.Header[hWWWAuthenticate] {
+		c, err := parseDigestChallenge(h)
+		if err != nil {
+			continue
+		}
+		if best == nil || c.algorithm.strength > best.algorithm.strength {
+			best = c
+		}
+	}
+	if best == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev := a.digests[req.URL.Host]
+	if prev != nil && prev.nonce == best.nonce && !best.stale {
+		// same nonce has been rejected, so credentials are wrong
+		return false
+	}
+	a.digests[req.URL.Host] = best
+	return true
+}
+
+// authTransport adds Authorization to requests and answers digest
+// challenges
+type authTransport struct {
+	base http.RoundTripper
+	auth *authState
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.roundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return resp, err
+	}
+	if !t.auth.challenge(req, resp) {
+		return resp, nil
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return t.roundTrip(req)
+}
+
+func (t authTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if value := t.auth.authorize(req); value != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(hAuthorization, value)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (t authTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+type digestAlgorithm struct {
+	name     string
+	hash     func() hash.Hash
+	strength int
+}
+
+var digestAlgorithms = [...]digestAlgorithm{
+	{"MD5", md5.New, 1},
+	{"MD5-sess", md5.New, 1},
+	{"SHA-256", sha256.New, 2},
+	{"SHA-256-sess", sha256.New, 2},
+}
+
+// digestChallenge is parsed WWW-Authenticate of RFC 7616 Digest scheme.
+// Only "auth" quality of protection is supported, or none at all for
+// RFC 2069 servers.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	qop       string
+	stale     bool
+	algorithm digestAlgorithm
+	nc        uint32
+}
+
+func parseDigestChallenge(header string) (*digestChallenge, error) {
+	const scheme = "digest "
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return nil, errors.Errorf("not a digest challenge: %q", header)
+	}
+	params := parseAuthParams(header[len(scheme):])
+	c := &digestChallenge{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		opaque:    params["opaque"],
+		stale:     strings.EqualFold(params["stale"], "true"),
+		algorithm: digestAlgorithms[0],
+	}
+	if c.nonce == "" {
+		return nil, errors.Errorf("digest challenge without nonce: %q", header)
+	}
+	if name, ok := params["algorithm"]; ok {
+		var found bool
+		for _, a := range digestAlgorithms {
+			if strings.EqualFold(a.name, name) {
+				c.algorithm, found = a, true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("unsupported digest algorithm %q", name)
+		}
+	}
+	if qop, ok := params["qop"]; ok {
+		for _, q := range strings.Split(qop, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				c.qop = "auth"
+			}
+		}
+		if c.qop == "" {
+			return nil, errors.Errorf("unsupported digest qop %q", qop)
+		}
+	}
+	return c, nil
+}
+
+// authorize computes Authorization for req, must be called with nc guarded
+func (c *digestChallenge) authorize(req *http.Request) string {
+	user := req.URL.User.Username()
+	pass, _ := req.URL.User.Password()
+	uri := req.URL.RequestURI()
+	h := func(s string) string {
+		hh := c.algorithm.hash()
+		io.WriteString(hh, s)
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+
+	cnonce := newCnonce()
+	ha1 := h(user + ":" + c.realm + ":" + pass)
+	if strings.HasSuffix(c.algorithm.name, "-sess") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s`,
+		user, c.realm, c.nonce, uri, c.algorithm.name)
+	if c.qop != "" {
+		c.nc++
+		nc := fmt.Sprintf("%08x", c.nc)
+		response := h(strings.Join([]string{ha1, c.nonce, nc, cnonce, c.qop, ha2}, ":"))
+		fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce="%s", response="%s"`, c.qop, nc, cnonce, response)
+	} else {
+		fmt.Fprintf(&b, `, response="%s"`, h(ha1+":"+c.nonce+":"+ha2))
+	}
+	if c.opaque != "" {
+		fmt.Fprintf(&b, `, opaque="%s"`, c.opaque)
+	}
+	return b.String()
+}
+
+// parseAuthParams parses comma separated key=value pairs, where values
+// may be quoted strings containing commas
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			return params
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " ")
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++ // closing quote
+			}
+			value, s = b.String(), s[i:]
+		} else {
+			i := strings.IndexByte(s, ',')
+			if i < 0 {
+				i = len(s)
+			}
+			value, s = strings.TrimSpace(s[:i]), s[i:]
+		}
+		params[key] = value
+	}
+}
+
+func newCnonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
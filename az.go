@@ -0,0 +1,201 @@
+package getparty
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	azureVersion  = "2020-04-08"
+	azureMetadata = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fstorage.azure.com%2F"
+)
+
+// azureCredentials is one of: account key, SAS token or bearer token of
+// managed identity. None of them is anonymous access.
+type azureCredentials struct {
+	key      []byte
+	sas      string
+	token    string
+	endpoint string // blob endpoint of connection string
+}
+
+type azureToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresOn   string `json:"expires_on"`
+}
+
+// azRoundTripper maps az://account/container/blob onto GET of the blob.
+// Credentials are looked up in AZURE_STORAGE_SAS_TOKEN,
+// AZURE_STORAGE_CONNECTION_STRING, AZURE_STORAGE_KEY and managed identity,
+// in that order. Without any, request goes anonymous, which is fine for
+// public containers.
+type azRoundTripper struct {
+	base  http.RoundTripper
+	creds *credentialCache
+}
+
+func newAzRoundTripper(base http.RoundTripper) azRoundTripper {
+	return azRoundTripper{
+		base:  base,
+		creds: &credentialCache{fetch: fetchAzureCredentials},
+	}
+}
+
+func (rt azRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	defer func() {
+		err = errors.WithMessage(err, "az")
+	}()
+	v, err := rt.creds.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	creds := v.(*azureCredentials)
+	account := req.URL.Host
+	endpoint := fmt.Sprintf("https://%s.blob.core.windows.net", account)
+	if creds.endpoint != "" {
+		endpoint = strings.TrimSuffix(creds.endpoint, "/")
+	}
+	target := endpoint + "/" + awsEscape(strings.TrimPrefix(req.URL.Path, "/"), false)
+	query := req.URL.Query()
+	if creds.sas != "" {
+		sas, err := url.ParseQuery(strings.TrimPrefix(creds.sas, "?"))
+		if err != nil {
+			return nil, errors.WithMessage(err, "SAS token")
+		}
+		for k, values := range sas {
+			query[k] = values
+		}
+	}
+	if len(query) != 0 {
+		target += "?" + query.Encode()
+	}
+	r, err := objectRequest(req, target)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("X-Ms-Version", azureVersion)
+	switch {
+	case creds.key != nil:
+		signAzure(r, account, creds.key, time.Now())
+	case creds.token != "":
+		r.Header.Set("Authorization", "Bearer "+creds.token)
+	}
+	resp, err = rt.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	return objectResponse(req, resp), nil
+}
+
+// signAzure adds Shared Key authorization of account to req
+func signAzure(req *http.Request, account string, key []byte, now time.Time) {
+	req.Header.Set("X-Ms-Date", now.UTC().Format(http.TimeFormat))
+	var msHeaders []string
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name+":"+strings.Join(values, ","))
+		}
+	}
+	sort.Strings(msHeaders)
+	resource := "/" + account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+	var length string
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-Md5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get(hIfModifiedSince),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get(hRange),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", "SharedKey "+account+":"+base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// fetchAzureCredentials walks the credential chain. Empty credentials mean
+// anonymous access.
+func fetchAzureCredentials(ctx context.Context) (interface{}, time.Time, error) {
+	creds := new(azureCredentials)
+	if sas := getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		creds.sas = sas
+		return creds, time.Time{}, nil
+	}
+	if conn := getenv("AZURE_STORAGE_CONNECTION_STRING"); conn != "" {
+		for _, field := range strings.Split(conn, ";") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "accountkey":
+				key, err := base64.StdEncoding.DecodeString(kv[1])
+				if err != nil {
+					return nil, time.Time{}, errors.WithMessage(err, "AZURE_STORAGE_CONNECTION_STRING")
+				}
+				creds.key = key
+			case "sharedaccesssignature":
+				creds.sas = kv[1]
+			case "blobendpoint":
+				creds.endpoint = kv[1]
+			}
+		}
+		return creds, time.Time{}, nil
+	}
+	if key := getenv("AZURE_STORAGE_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, time.Time{}, errors.WithMessage(err, "AZURE_STORAGE_KEY")
+		}
+		creds.key = decoded
+		return creds, time.Time{}, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, azureMetadata, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+	var token azureToken
+	if err := fetchJSON(metadataClient, req, &token); err != nil {
+		// not in Azure or without managed identity
+		return creds, time.Time{}, nil
+	}
+	creds.token = token.AccessToken
+	var expires time.Time
+	if expiresOn, _ := strconv.ParseInt(token.ExpiresOn, 10, 64); expiresOn > 0 {
+		expires = time.Unix(expiresOn, 0)
+	}
+	return creds, expires, nil
+}
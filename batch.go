@@ -0,0 +1,298 @@
+package getparty
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
+)
+
+const (
+	retryCommand    = "retry"
+	retryArgsPrefix = "#args "
+	failedHeader    = "# re-run with: "
+)
+
+// secretHeaders are headers, which values aren't written to failed file
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", hCookie}
+
+const (
+	haltNever   = "never"
+	haltSoon    = "soon"
+	haltOnError = "on-error"
+)
+
+type batchResult struct {
+	url     string
+	file    string
+	err     error
+	skipped bool
+}
+
+// runBatch downloads every line of fileName one after another, according
+// to --halt policy, then writes table of results. Each line is a mirror
+// entry, its alternate urls are rotated on session retries.
+func (cmd *Cmd) runBatch(ctx context.Context, fileName string) error {
+	if cmd.options.OutFileName != "" || cmd.options.JSONFileName != "" || cmd.options.JSONSummary != "" {
+		return errors.New("batch: --output, --continue and --json-summary apply to single download")
+	}
+	input := os.Stdin
+	if fileName != "-" {
+		fd, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		input = fd
+	}
+	lines, err := readLines(input)
+	if err != nil {
+		return errors.WithMessage(err, "batch")
+	}
+
+	// download mutates options, so every item starts from the same ones
+	base := *cmd.options
+	results := make([]batchResult, len(lines))
+	var failed int
+	var haltErr error
+	for i, line := range lines {
+		item := mirror(strings.Fields(line))
+		results[i].url = item[0]
+		if failed != 0 && cmd.options.Halt != haltNever || ctx.Err() != nil {
+			results[i].skipped = true
+			continue
+		}
+		*cmd.options = base
+		cmd.options.HeaderMap = make(map[string]string, len(base.HeaderMap))
+		for k, v := range base.HeaderMap {
+			cmd.options.HeaderMap[k] = v
+		}
+		err := cmd.runHooks(cmd.runTries(ctx, item, ""))
+		results[i].file = cmd.options.OutFileName
+		results[i].err = err
+		if err != nil {
+			failed++
+			cmd.logger.Printf("%s: %v", item[0], err)
+			if cmd.options.Halt == haltOnError {
+				haltErr = err
+			}
+		}
+	}
+	*cmd.options = base
+
+	if err := cmd.writeFailed(lines, results); err != nil {
+		return err
+	}
+	if haltErr != nil {
+		return haltErr
+	}
+	if !cmd.options.Quiet {
+		cmd.writeResults(cmd.Out, results)
+	}
+	if failed != 0 {
+		return ExpectedError{errors.Errorf("batch: %d of %d downloads failed", failed, len(results))}
+	}
+	return nil
+}
+
+// writeFailed writes lines of items, which didn't complete, with args of
+// the run, so "retry" subcommand re-runs exactly them. Secrets among args
+// aren't written, retry has to be given them again. File of previous run,
+// which has fully succeeded now, is removed.
+func (cmd Cmd) writeFailed(lines []string, results []batchResult) (err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "writeFailed")
+	}()
+	fileName := cmd.options.FailedFile
+	if fileName == "" {
+		return nil
+	}
+	var failed []string
+	for i, r := range results {
+		if r.err != nil || r.skipped {
+			failed = append(failed, lines[i])
+		}
+	}
+	if len(failed) == 0 {
+		if !isFailedFile(fileName) {
+			// not ours to remove
+			return nil
+		}
+		return os.Remove(fileName)
+	}
+	stored, secrets := withoutSecrets(cmd.userArgs)
+	args, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s%s %s %s\n", failedHeader, cmdName, retryCommand, fileName)
+	if len(secrets) != 0 {
+		fmt.Fprintf(&b, "# along with: %s\n", strings.Join(secrets, " "))
+	}
+	fmt.Fprintf(&b, "%s%s\n", retryArgsPrefix, args)
+	for _, line := range failed {
+		fmt.Fprintln(&b, line)
+	}
+	if err := ioutil.WriteFile(fileName, b.Bytes(), 0600); err != nil {
+		return err
+	}
+	cmd.logger.Printf(cmd.msgs.T("%d failed items written to %q"), len(failed), fileName)
+	return nil
+}
+
+// isFailedFile reports whether fileName has been written by writeFailed
+func isFailedFile(fileName string) bool {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	header := make([]byte, len(failedHeader))
+	_, err = io.ReadFull(fd, header)
+	return err == nil && string(header) == failedHeader
+}
+
+// withoutSecrets returns args without password, bearer token and secret
+// headers, along with names of ones removed
+func withoutSecrets(args []string) (rest, names []string) {
+	rest, _, names = splitSecrets(args)
+	return rest, names
+}
+
+// splitSecrets splits password, bearer token and secret headers out of
+// args. Secrets are returned as --name=value args, so they may be given
+// before or after rest, names are to show which ones they are.
+func splitSecrets(args []string) (rest, secrets, names []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var name, value, header string
+		switch {
+		case arg == "--":
+			return append(rest, args[i:]...), secrets, names
+		case arg == "--password" || arg == "--bearer-token":
+			name = arg
+			if i++; i < len(args) {
+				value = args[i]
+			}
+		case strings.HasPrefix(arg, "--password=") || strings.HasPrefix(arg, "--bearer-token="):
+			j := strings.IndexByte(arg, '=')
+			name, value = arg[:j], arg[j+1:]
+		case (arg == "-H" || arg == "--header") && i+1 < len(args):
+			header = args[i+1]
+			if isSecretHeader(header) {
+				i++
+			}
+		case strings.HasPrefix(arg, "--header="):
+			header = arg[len("--header="):]
+		case strings.HasPrefix(arg, "-H"):
+			header = arg[len("-H"):]
+		}
+		switch {
+		case name != "":
+			secrets = append(secrets, name+"="+value)
+			names = append(names, name)
+		case isSecretHeader(header):
+			secrets = append(secrets, "--header="+header)
+			names = append(names, "--header "+header[:strings.IndexByte(header, ':')]+":...")
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return rest, secrets, names
+}
+
+func isSecretHeader(header string) bool {
+	i := strings.IndexByte(header, ':')
+	if i <= 0 {
+		return false
+	}
+	key := strings.TrimSpace(header[:i])
+	for _, secret := range secretHeaders {
+		if strings.EqualFold(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandRetry replaces "retry failed.txt" in args with args of the run,
+// which has written failed.txt, reading batch from it. Options given along
+// with retry are added, overriding stored ones.
+func expandRetry(args []string) ([]string, error) {
+	positional, err := flags.NewParser(new(Options), flags.None).ParseArgs(args)
+	if err != nil || len(positional) == 0 || positional[0] != retryCommand {
+		return args, nil
+	}
+	if len(positional) != 2 {
+		return nil, errors.Errorf("usage: %s [OPTIONS] %s failed.txt", cmdName, retryCommand)
+	}
+	fileName := positional[1]
+	stored, err := readRetryArgs(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(stored); n >= 2 && stored[n-2] == "--input-file" && stored[n-1] == fileName {
+		// written by previous retry
+		stored = stored[:n-2]
+	}
+	expanded := stored
+	var removed int
+	for _, arg := range args {
+		if removed < len(positional) && arg == positional[removed] {
+			removed++
+			continue
+		}
+		expanded = append(expanded, arg)
+	}
+	// the last one wins, so batch is read from the failed list
+	return append(expanded, "--input-file", fileName), nil
+}
+
+// readRetryArgs returns args of the run, which has written failed file
+func readRetryArgs(fileName string) ([]string, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, retryArgsPrefix) {
+			var args []string
+			err := json.Unmarshal([]byte(line[len(retryArgsPrefix):]), &args)
+			return args, errors.WithMessage(err, fileName)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.Errorf("%s: no %q line, not a failed list", fileName, retryArgsPrefix)
+}
+
+func (cmd Cmd) writeResults(w io.Writer, results []batchResult) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, cmd.msgs.T("#\tResult\tFile\tUrl\tError"))
+	for i, r := range results {
+		status, errText := cmd.msgs.T("ok"), ""
+		switch {
+		case r.skipped:
+			status = cmd.msgs.T("skipped")
+		case r.err != nil:
+			status, errText = cmd.msgs.T("failed"), r.err.Error()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", i+1, status, r.file, r.url, errText)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,48 @@
+package getparty
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWithoutSecrets(t *testing.T) {
+	tests := []struct {
+		args    []string
+		rest    []string
+		secrets []string
+	}{
+		{
+			args: []string{"-p", "4", "-u", "bob", "--password", "pw", "-i", "urls.txt"},
+			rest: []string{"-p", "4", "-u", "bob", "-i", "urls.txt"}, secrets: []string{"--password"},
+		},
+		{
+			args: []string{"--bearer-token=t", "--password=pw"},
+			rest: nil, secrets: []string{"--bearer-token", "--password"},
+		},
+		{
+			args: []string{"-H", "Authorization: Bearer t", "-H", "X-A: 1", "--header=cookie:a=b", "-HProxy-Authorization:x"},
+			rest: []string{"-H", "X-A: 1"}, secrets: []string{"--header Authorization:...", "--header cookie:...", "--header Proxy-Authorization:..."},
+		},
+		{
+			args: []string{"-H", "@headers.txt", "--", "--password"},
+			rest: []string{"-H", "@headers.txt", "--", "--password"},
+		},
+	}
+	for _, tt := range tests {
+		rest, secrets := withoutSecrets(tt.args)
+		if !reflect.DeepEqual(rest, tt.rest) || !reflect.DeepEqual(secrets, tt.secrets) {
+			t.Errorf("withoutSecrets(%q) = %q, %q, want %q, %q", tt.args, rest, secrets, tt.rest, tt.secrets)
+		}
+	}
+}
+
+func TestSplitSecrets(t *testing.T) {
+	args := []string{"-u", "bob", "--password", "pw", "-H", "Cookie: a=b", "--bearer-token=t", "-p", "4"}
+	rest, secrets, _ := splitSecrets(args)
+	if want := []string{"-u", "bob", "-p", "4"}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("rest = %q, want %q", rest, want)
+	}
+	if want := []string{"--password=pw", "--header=Cookie: a=b", "--bearer-token=t"}; !reflect.DeepEqual(secrets, want) {
+		t.Errorf("secrets = %q, want %q", secrets, want)
+	}
+}
@@ -0,0 +1,33 @@
+package getparty
+
+import (
+	"sync/atomic"
+)
+
+// canceler stops Run on behalf of embedder, see Cmd.Cancel
+type canceler struct {
+	cancel  func()
+	discard int32
+}
+
+// Cancel stops Run in progress from any goroutine, the way ^C does. With
+// keepState, session state is saved, so the download can be resumed with
+// --continue later, like after pause. Otherwise parts and state files are
+// removed, leaving nothing behind. Cancel is no-op, if Run isn't in
+// progress.
+func (cmd *Cmd) Cancel(keepState bool) {
+	c, _ := cmd.canceler.Load().(*canceler)
+	if c == nil {
+		return
+	}
+	if !keepState {
+		atomic.StoreInt32(&c.discard, 1)
+	}
+	c.cancel()
+}
+
+// discardOnCancel reports whether Cancel has asked to clean up everything
+func (cmd *Cmd) discardOnCancel() bool {
+	c, _ := cmd.canceler.Load().(*canceler)
+	return c != nil && atomic.LoadInt32(&c.discard) == 1
+}
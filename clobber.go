@@ -0,0 +1,97 @@
+package getparty
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// clobber policies of existing output, part and state files
+const (
+	clobberAsk    = "ask"
+	clobberForce  = "force"
+	clobberKeep   = "no-clobber"
+	clobberRename = "auto-rename"
+	clobberFail   = "fail"
+)
+
+// clobberPolicy returns policy of --force, --no-clobber or --auto-rename.
+// Without any, user is asked, if there is one at stdin, otherwise it's
+// failure, as prompt would hang a script.
+func (cmd Cmd) clobberPolicy() string {
+	switch {
+	case cmd.options.Force:
+		return clobberForce
+	case cmd.options.NoClobber:
+		return clobberKeep
+	case cmd.options.AutoRename:
+		return clobberRename
+	case isTerminal(os.Stdin):
+		return clobberAsk
+	}
+	return clobberFail
+}
+
+// errClobber is failure of clobberFail policy
+func errClobber(name string) error {
+	return ExpectedError{errors.Errorf("%q already exists, see --force, --no-clobber or --auto-rename", name)}
+}
+
+// ask prompts user with question, which is yes or no
+func (cmd Cmd) ask(question string, args ...interface{}) (bool, error) {
+	var answer string
+	fmt.Fprintf(cmd.Out, cmd.msgs.T(question), args...)
+	if _, err := fmt.Scanf("%s", &answer); err != nil {
+		return false, err
+	}
+	return cmd.msgs.yes(answer), nil
+}
+
+// existingFiles returns output, part and state files of s, which exist
+// already
+func (s Session) existingFiles() []string {
+	return existing(s.fileNamesAs(s.SuggestedFileName))
+}
+
+// autoRename renames output of s, and its parts along, to the first of
+// name.1, name.2 and so on, which none of the files exist for
+func (s *Session) autoRename() {
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("%s.%d", s.SuggestedFileName, i)
+		if len(existing(s.fileNamesAs(name))) != 0 {
+			continue
+		}
+		for _, p := range s.Parts {
+			p.FileName = name + strings.TrimPrefix(p.FileName, s.SuggestedFileName)
+		}
+		s.SuggestedFileName = name
+		return
+	}
+}
+
+// fileNamesAs returns names of output, part and state files of s, as if
+// its output was name
+func (s Session) fileNamesAs(name string) []string {
+	names := []string{name}
+	for _, p := range s.Parts {
+		if p.FileName != s.SuggestedFileName {
+			names = append(names, name+strings.TrimPrefix(p.FileName, s.SuggestedFileName))
+		}
+	}
+	for _, format := range stateFormats {
+		names = append(names, name+"."+format)
+	}
+	return names
+}
+
+func existing(names []string) []string {
+	var found []string
+	for _, name := range names {
+		if _, err := os.Stat(name); err == nil {
+			found = append(found, name)
+		}
+	}
+	return found
+}
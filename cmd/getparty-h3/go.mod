@@ -0,0 +1,35 @@
+module github.com/vbauerster/getparty/cmd/getparty-h3
+
+go 1.24
+
+require (
+	github.com/quic-go/quic-go v0.59.0
+	github.com/vbauerster/getparty v0.0.0
+)
+
+require (
+	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/VividCortex/ewma v1.1.1 // indirect
+	github.com/acarl005/stripansi v0.0.0-20180116102854-5a71ef0e047d // indirect
+	github.com/andybalholm/brotli v1.0.0 // indirect
+	github.com/hashicorp/go-cleanhttp v0.5.1 // indirect
+	github.com/jessevdk/go-flags v1.4.0 // indirect
+	github.com/klauspost/compress v1.11.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pkg/sftp v1.12.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	github.com/vbauerster/backoff v0.0.0-20190809065356-e16a21284378 // indirect
+	github.com/vbauerster/mpb/v5 v5.3.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sync v0.16.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/term v0.34.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
+
+replace github.com/vbauerster/getparty => ../..
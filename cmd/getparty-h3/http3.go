@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/vbauerster/getparty"
+)
+
+func init() {
+	getparty.HTTP3Transport = newTransport
+}
+
+// newTransport returns HTTP/3 transport, which dials ip:port of lookup,
+// so --resolve, --connect-to, -4, -6 and --safe-resolve still apply
+func newTransport(tlsConfig *tls.Config, lookup func(ctx context.Context, address string) (string, error)) http.RoundTripper {
+	return &http3.Transport{
+		TLSClientConfig: tlsConfig,
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			target, err := lookup(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return quic.DialAddrEarly(ctx, target, tlsCfg, cfg)
+		},
+	}
+}
@@ -0,0 +1,29 @@
+// getparty with HTTP/3 support
+// Copyright (C) 2016-2017 Vladimir Bauer
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command getparty-h3 is getparty built with --http3 support. It's a
+// module of its own, as quic-go needs much newer Go than getparty does.
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/vbauerster/getparty"
+)
+
+var (
+	version = "dev"
+	commit  = "xxxxxxx"
+)
+
+func main() {
+	cmd := &getparty.Cmd{Out: os.Stdout, Err: os.Stderr}
+	os.Exit(cmd.Exit(cmd.Run(
+		os.Args[1:],
+		fmt.Sprintf("%s (%.7s) (%s) (http3)", version, commit, runtime.Version()),
+	)))
+}
@@ -0,0 +1,98 @@
+package getparty
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+const configFlag = "config"
+
+// defaultConfigPath returns ~/.config/getparty/config.toml or platform
+// equivalent
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, cmdName, "config.toml")
+}
+
+// configPath looks up --config value in args, before they are parsed
+func configPath(args []string) (string, bool) {
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return "", false
+		case arg == "--"+configFlag && i+1 < len(args):
+			return args[i+1], true
+		case strings.HasPrefix(arg, "--"+configFlag+"="):
+			return arg[len(configFlag)+3:], true
+		}
+	}
+	return "", false
+}
+
+// loadConfig reads toml config, where keys are long option names, and
+// converts it into args, to be parsed ahead of user's args, so flags on
+// command line take precedence. Tables map onto key:value options:
+//
+//	parts = 4
+//	user-agent = "firefox"
+//	[header]
+//	Referer = "https://example.com"
+func (cmd Cmd) loadConfig(fileName string, mustExist bool) (args []string, err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "loadConfig")
+	}()
+	var config map[string]interface{}
+	if _, err := toml.DecodeFile(fileName, &config); err != nil {
+		if os.IsNotExist(err) && !mustExist {
+			return nil, nil
+		}
+		return nil, err
+	}
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == configFlag || cmd.parser.FindOptionByLongName(k) == nil {
+			return nil, errors.Errorf("%s: unknown option %q", fileName, k)
+		}
+		args = append(args, configArgs(k, config[k])...)
+	}
+	return args, nil
+}
+
+func configArgs(key string, value interface{}) []string {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return []string{"--" + key}
+		}
+		return nil
+	case []interface{}:
+		var args []string
+		for _, e := range v {
+			args = append(args, configArgs(key, e)...)
+		}
+		return args
+	case map[string]interface{}:
+		var args []string
+		for k, e := range v {
+			args = append(args, fmt.Sprintf("--%s=%s:%v", key, k, e))
+		}
+		sort.Strings(args)
+		return args
+	default:
+		return []string{fmt.Sprintf("--%s=%v", key, v)}
+	}
+}
@@ -0,0 +1,209 @@
+package getparty
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/vbauerster/mpb/v5/decor"
+)
+
+const minControlRate = 1024
+
+// pauseGate holds parts, while download is paused. Nil *pauseGate is valid
+// and is never paused.
+type pauseGate struct {
+	mu      sync.Mutex
+	resumed chan struct{} // non-nil while paused
+}
+
+func (g *pauseGate) isPaused() bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
+}
+
+// toggle pauses or resumes, reporting whether gate is paused now
+func (g *pauseGate) toggle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+		return true
+	}
+	close(g.resumed)
+	g.resumed = nil
+	return false
+}
+
+// wait blocks while paused, returning for how long
+func (g *pauseGate) wait(ctx context.Context) (time.Duration, error) {
+	if g == nil {
+		return 0, nil
+	}
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed == nil {
+		return 0, nil
+	}
+	start := time.Now()
+	select {
+	case <-resumed:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	}
+}
+
+// downloadControl is what controller can do to the running download
+type downloadControl struct {
+	gate      *pauseGate
+	limiter   *rateLimiter
+	speed     func() float64
+	addPart   func() bool
+	saveState func() (string, error)
+}
+
+// controller drives the running download on SIGUSR1, which toggles pause,
+// and on keys of the terminal:
+//
+//	p, space  pause or resume, state is saved on pause
+//	+, -      double or halve rate limit
+//	u         remove rate limit
+//	a         add part, splitting the slowest one
+type controller struct {
+	mu      sync.Mutex
+	dc      *downloadControl
+	logger  *log.Logger // for messages, when there are no bars
+	dlogger *log.Logger
+	keys    bool
+	once    sync.Once
+	restore func()
+}
+
+// attach makes dc target of controls, nil detaches. Keys are enabled on
+// first attach, so overwrite prompt before it can read stdin.
+func (c *controller) attach(dc *downloadControl) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.dc = dc
+	c.mu.Unlock()
+	if dc != nil && c.keys {
+		c.once.Do(func() {
+			restore, err := readKeys(os.Stdin, c.handle)
+			if err != nil {
+				c.dlogger.Printf("keys: %v", err)
+				return
+			}
+			c.restore = restore
+		})
+	}
+}
+
+// run handles pause signal until ctx is done
+func (c *controller) run(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	if !notifyPause(sig) {
+		return
+	}
+	go func() {
+		defer signal.Stop(sig)
+		for {
+			select {
+			case <-sig:
+				c.handle('p')
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (c *controller) close() {
+	if c != nil && c.restore != nil {
+		c.restore()
+	}
+}
+
+func (c *controller) handle(key byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dc := c.dc
+	if dc == nil {
+		return
+	}
+	switch key {
+	case 'p', ' ':
+		if !dc.gate.toggle() {
+			c.notify("resumed")
+			return
+		}
+		stateName, err := dc.saveState()
+		if err != nil {
+			c.notify(fmt.Sprintf("paused, state not saved: %v", err))
+			return
+		}
+		c.notify(fmt.Sprintf("paused, state saved to %q", stateName))
+	case '+', '=':
+		if rate := dc.limiter.getRate(); rate > 0 {
+			dc.limiter.setRate(rate * 2)
+			c.notifyRate(rate * 2)
+		}
+	case '-', '_':
+		rate := dc.limiter.getRate()
+		if rate <= 0 {
+			rate = dc.speed()
+			if rate <= 0 {
+				rate = niceRate * 2
+			}
+		}
+		rate /= 2
+		if rate < minControlRate {
+			rate = minControlRate
+		}
+		dc.limiter.setRate(rate)
+		c.notifyRate(rate)
+	case 'u':
+		dc.limiter.setRate(0)
+		c.notify("rate limit removed")
+	case 'a':
+		if dc.addPart() {
+			c.notify("part added")
+		} else {
+			c.notify("no part is worth splitting")
+		}
+	}
+}
+
+func (c *controller) notifyRate(rate float64) {
+	c.notify(fmt.Sprintf("rate limit %.1f/s", decor.SizeB1024(int64(rate))))
+}
+
+func (c *controller) notify(msg string) {
+	c.dlogger.Print(msg)
+	if c.logger != nil {
+		c.logger.Print(msg)
+	}
+}
+
+// status is shown by total bar
+func (dc *downloadControl) status() string {
+	var s string
+	if rate := dc.limiter.getRate(); rate > 0 {
+		s = fmt.Sprintf(" limit %.1f/s", decor.SizeB1024(int64(rate)))
+	}
+	if dc.gate.isPaused() {
+		s += " [paused]"
+	}
+	return s
+}
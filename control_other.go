@@ -0,0 +1,18 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package getparty
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func notifyPause(chan<- os.Signal) bool {
+	return false
+}
+
+func readKeys(*os.File, func(byte)) (func(), error) {
+	return nil, errors.New("keys aren't supported on this system")
+}
@@ -0,0 +1,46 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package getparty
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func notifyPause(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR1)
+	return true
+}
+
+// readKeys switches terminal f to unbuffered input without echo, calling
+// handle for every key read. Signal keys like ^C keep working.
+func readKeys(f *os.File, handle func(byte)) (restore func(), err error) {
+	fd := int(f.Fd())
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	t := *old
+	t.Lflag &^= unix.ICANON | unix.ECHO
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &t); err != nil {
+		return nil, err
+	}
+	go func() {
+		b := make([]byte, 1)
+		for {
+			if _, err := f.Read(b); err != nil {
+				return
+			}
+			handle(b[0])
+		}
+	}()
+	return func() {
+		_ = unix.IoctlSetTermios(fd, ioctlSetTermios, old)
+	}, nil
+}
@@ -0,0 +1,180 @@
+package getparty
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/publicsuffix"
+)
+
+const httpOnlyPrefix = "#HttpOnly_"
+
+// cookieJar is cookiejar.Jar, which also keeps every cookie it has been
+// given, so the jar can be saved. Standard jar can only tell cookies for
+// a given url, and without their attributes.
+type cookieJar struct {
+	*cookiejar.Jar
+	mu      sync.Mutex
+	cookies map[string]*http.Cookie
+}
+
+func newCookieJar() (*cookieJar, error) {
+	// All users of cookiejar should import "golang.org/x/net/publicsuffix"
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+	return &cookieJar{
+		Jar:     jar,
+		cookies: make(map[string]*http.Cookie),
+	}, nil
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		c := *c
+		if c.Domain == "" {
+			c.Domain = u.Hostname()
+		} else if !strings.HasPrefix(c.Domain, ".") {
+			c.Domain = "." + c.Domain
+		}
+		if c.Path == "" {
+			c.Path = "/"
+		}
+		if c.MaxAge > 0 {
+			c.Expires = time.Now().Add(time.Duration(c.MaxAge) * time.Second)
+		}
+		key := c.Domain + ";" + c.Path + ";" + c.Name
+		if c.MaxAge < 0 || !c.Expires.IsZero() && c.Expires.Before(time.Now()) {
+			delete(j.cookies, key)
+			continue
+		}
+		j.cookies[key] = &c
+	}
+}
+
+// load reads cookies in Netscape format, as curl and wget write them
+func (j *cookieJar) load(fileName string) (err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "load cookies")
+	}()
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		var httpOnly bool
+		if strings.HasPrefix(text, httpOnlyPrefix) {
+			text, httpOnly = text[len(httpOnlyPrefix):], true
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return errors.Errorf("%s:%d: expected 7 tab separated fields, got %d", fileName, line, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return errors.Errorf("%s:%d: invalid expiry %q", fileName, line, fields[4])
+		}
+		c := &http.Cookie{
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		if expires != 0 {
+			c.Expires = time.Unix(expires, 0)
+			if c.Expires.Before(time.Now()) {
+				continue
+			}
+		}
+		host := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			c.Domain = host
+		}
+		u := &url.URL{Scheme: "http", Host: host, Path: c.Path}
+		if c.Secure {
+			u.Scheme = "https"
+		}
+		j.SetCookies(u, []*http.Cookie{c})
+	}
+	return scanner.Err()
+}
+
+// save writes cookies in Netscape format, session ones included
+func (j *cookieJar) save(fileName string) (err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "save cookies")
+	}()
+	dst, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = j.write(dst)
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (j *cookieJar) write(w io.Writer) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	keys := make([]string, 0, len(j.cookies))
+	for k := range j.cookies {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# Netscape HTTP Cookie File")
+	for _, k := range keys {
+		c := j.cookies[k]
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+		domain := c.Domain
+		if c.HttpOnly {
+			domain = httpOnlyPrefix + domain
+		}
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain,
+			netscapeBool(strings.HasPrefix(c.Domain, ".")),
+			c.Path,
+			netscapeBool(c.Secure),
+			expires,
+			c.Name,
+			c.Value,
+		)
+	}
+	return bw.Flush()
+}
+
+func netscapeBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
@@ -0,0 +1,54 @@
+package getparty
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxKernelCopy is the most one copy_file_range or sendfile call is asked
+// for, as either stops short of 2G anyway
+const maxKernelCopy = 1 << 30
+
+// copyFile copies src from its offset to dst at its offset by
+// copy_file_range, or by sendfile, where the former isn't supported, e.g.
+// across filesystems on kernels before 5.3, so data doesn't pass through
+// user space. Buffered copy with buf is the last resort. dst must not be
+// in append mode, which both calls refuse.
+func copyFile(dst, src *os.File, buf []byte) (written int64, err error) {
+	out, in := int(dst.Fd()), int(src.Fd())
+	kernelCopies := [...]func() (int, error){
+		func() (int, error) { return unix.CopyFileRange(in, nil, out, nil, maxKernelCopy, 0) },
+		func() (int, error) { return unix.Sendfile(out, in, nil, maxKernelCopy) },
+	}
+	for _, kernelCopy := range kernelCopies {
+		for {
+			n, err := kernelCopy()
+			if n > 0 {
+				written += int64(n)
+			}
+			if err == nil && n == 0 {
+				return written, nil
+			}
+			if err == syscall.EINTR || err == nil {
+				continue
+			}
+			if !isCopyUnsupported(err) {
+				return written, err
+			}
+			// offsets of both files are where the call has left them
+			break
+		}
+	}
+	n, err := copyBuffer(dst, src, buf)
+	return written + n, err
+}
+
+func isCopyUnsupported(err error) bool {
+	switch err {
+	case syscall.ENOSYS, syscall.EXDEV, syscall.EINVAL, syscall.EOPNOTSUPP, syscall.EBADF, syscall.EPERM:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package getparty
+
+import "os"
+
+// copyFile copies src from its offset to dst at its offset with buf
+func copyFile(dst, src *os.File, buf []byte) (int64, error) {
+	return copyBuffer(dst, src, buf)
+}
@@ -0,0 +1,348 @@
+package getparty
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
+)
+
+const importCurlCommand = "import-curl"
+
+// curlIgnored are curl options, which don't change what is downloaded.
+// Value tells whether option takes an argument.
+var curlIgnored = map[string]bool{
+	"-L":                   false,
+	"--basic":              false,
+	"--location":           false,
+	"-s":                   false,
+	"--silent":             false,
+	"-S":                   false,
+	"--show-error":         false,
+	"-v":                   false,
+	"--verbose":            false,
+	"-g":                   false,
+	"--globoff":            false,
+	"-O":                   false,
+	"--remote-name":        false,
+	"-J":                   false,
+	"--remote-header-name": false,
+	"-f":                   false,
+	"--fail":               false,
+	"-#":                   false,
+	"--progress-bar":       false,
+	"--http1.1":            false,
+	"--http2":              false,
+	"--connect-timeout":    true,
+	"-m":                   true,
+	"--max-time":           true,
+	"--retry":              true,
+	"-w":                   true,
+	"--write-out":          true,
+}
+
+// expandImportCurl replaces "import-curl 'curl ...'" or "--from-curl
+// 'curl ...'" in args with getparty args equivalent to the curl command, as
+// browser devtools copy it. Command is read from stdin, if it's "-". Options
+// given along with it are added, overriding imported ones.
+func expandImportCurl(args []string) ([]string, error) {
+	opts := new(Options)
+	positional, err := flags.NewParser(opts, flags.None).ParseArgs(args)
+	if err != nil {
+		return args, nil
+	}
+	var command, source string
+	var rest []string
+	switch {
+	case opts.FromCurl != "":
+		source = "--from-curl"
+		if len(positional) != 0 {
+			return nil, errors.Errorf("%s: unexpected args %q, url goes in the command", source, positional)
+		}
+		command, rest = opts.FromCurl, withoutOption(args, source)
+	case len(positional) != 0 && positional[0] == importCurlCommand:
+		source = importCurlCommand
+		if len(positional) != 2 {
+			return nil, errors.Errorf("usage: %s [OPTIONS] %s 'curl url ...'", cmdName, importCurlCommand)
+		}
+		command = positional[1]
+		var removed int
+		for _, arg := range args {
+			if removed < len(positional) && arg == positional[removed] {
+				removed++
+				continue
+			}
+			rest = append(rest, arg)
+		}
+	default:
+		return args, nil
+	}
+	if command == "-" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		command = string(b)
+	}
+	words, err := splitShellWords(command)
+	if err != nil {
+		return nil, errors.WithMessage(err, source)
+	}
+	imported, err := curlArgs(words)
+	if err != nil {
+		return nil, errors.WithMessage(err, source)
+	}
+	return append(imported, rest...), nil
+}
+
+// withoutOption returns args without every long option name, along with
+// its value, either attached by = or the next arg
+func withoutOption(args []string, name string) []string {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--":
+			return append(rest, args[i:]...)
+		case args[i] == name:
+			i++
+		case !strings.HasPrefix(args[i], name+"="):
+			rest = append(rest, args[i])
+		}
+	}
+	return rest
+}
+
+// curlArgs translates curl command words into getparty args, url last
+func curlArgs(words []string) ([]string, error) {
+	if len(words) == 0 || words[0] != "curl" {
+		return nil, errors.New("not a curl command")
+	}
+	var args []string
+	var rawUrl string
+	header := func(key, value string) {
+		args = append(args, "--header", http.CanonicalHeaderKey(key)+":"+value)
+	}
+	for i := 1; i < len(words); i++ {
+		word := words[i]
+		name, value, hasValue := word, "", false
+		if strings.HasPrefix(word, "--") {
+			if j := strings.IndexByte(word, '='); j > 0 {
+				name, value, hasValue = word[:j], word[j+1:], true
+			}
+		} else if len(word) > 2 && word[0] == '-' {
+			// short option with attached value, like -HAccept:*/*
+			name, value, hasValue = word[:2], word[2:], true
+		}
+		next := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if i+1 == len(words) {
+				return "", errors.Errorf("%s: missing value", name)
+			}
+			i++
+			return words[i], nil
+		}
+		if !strings.HasPrefix(name, "-") || name == "-" {
+			if rawUrl != "" {
+				return nil, errors.Errorf("more than one url: %q, %q", rawUrl, word)
+			}
+			rawUrl = word
+			continue
+		}
+		switch name {
+		case "--url":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			rawUrl = v
+		case "-H", "--header":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			j := strings.IndexByte(v, ':')
+			if j <= 0 || strings.HasPrefix(v, "@") {
+				return nil, errors.Errorf("unsupported header %q", v)
+			}
+			key := strings.TrimSpace(v[:j])
+			if strings.EqualFold(key, hAcceptEncoding) {
+				// --compressed takes care of it
+				continue
+			}
+			header(key, strings.TrimSpace(v[j+1:]))
+		case "-b", "--cookie":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if strings.Contains(v, "=") {
+				header(hCookie, v)
+			} else {
+				args = append(args, "--load-cookies", v)
+			}
+		case "-A", "--user-agent":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			header(hUserAgentKey, v)
+		case "-e", "--referer":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			header(hReferer, v)
+		case "-u", "--user":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			pair := strings.SplitN(v, ":", 2)
+			args = append(args, "--username", pair[0])
+			if len(pair) == 2 {
+				args = append(args, "--password", pair[1])
+			}
+		case "--oauth2-bearer":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "--bearer-token", v)
+		case "-c", "--cookie-jar":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "--save-cookies", v)
+		case "-x", "--proxy":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "--proxy", v)
+		case "-o", "--output":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "--output", v)
+		case "--compressed":
+			args = append(args, "--compressed")
+		case "-k", "--insecure":
+			args = append(args, "--no-check-cert")
+		case "-X", "--request":
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if !strings.EqualFold(v, http.MethodGet) {
+				return nil, errors.Errorf("only GET can be downloaded in parts, not %s", v)
+			}
+		case "-d", "--data", "--data-raw", "--data-binary", "--data-urlencode", "-F", "--form":
+			return nil, errors.Errorf("%s: request with body can't be downloaded in parts", name)
+		default:
+			takesValue, ok := curlIgnored[name]
+			if !ok {
+				return nil, errors.Errorf("unsupported curl option %q", name)
+			}
+			if takesValue {
+				if _, err := next(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if rawUrl == "" {
+		return nil, errors.New("no url")
+	}
+	return append(args, rawUrl), nil
+}
+
+// splitShellWords splits command into words as POSIX shell does, for
+// single, double and $'...' quoting, backslash escapes and line
+// continuations. Variables and globs are taken literally.
+func splitShellWords(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	var inWord bool
+	s := []rune(command)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			i++
+			if s[i] != '\n' && s[i] != '\r' {
+				word.WriteRune(s[i])
+				inWord = true
+			} else if s[i] == '\r' && i+1 < len(s) && s[i+1] == '\n' {
+				i++
+			}
+		case c == '\'':
+			j := i + 1
+			for j < len(s) && s[j] != '\'' {
+				j++
+			}
+			if j == len(s) {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(string(s[i+1 : j]))
+			i, inWord = j, true
+		case c == '$' && i+1 < len(s) && s[i+1] == '\'':
+			j := i + 2
+			for ; j < len(s) && s[j] != '\''; j++ {
+				if s[j] != '\\' || j+1 == len(s) {
+					word.WriteRune(s[j])
+					continue
+				}
+				j++
+				switch s[j] {
+				case 'n':
+					word.WriteByte('\n')
+				case 't':
+					word.WriteByte('\t')
+				case 'r':
+					word.WriteByte('\r')
+				default:
+					word.WriteRune(s[j])
+				}
+			}
+			if j == len(s) {
+				return nil, errors.New("unterminated $' quote")
+			}
+			i, inWord = j, true
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) && strings.ContainsRune("\\\"$`\n", s[j+1]) {
+					j++
+					if s[j] == '\n' {
+						continue
+					}
+				}
+				word.WriteRune(s[j])
+			}
+			if j == len(s) {
+				return nil, errors.New("unterminated double quote")
+			}
+			i, inWord = j, true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
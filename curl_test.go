@@ -0,0 +1,56 @@
+package getparty
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandFromCurl(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+		err  string
+	}{
+		{
+			args: []string{"-p", "4", "--from-curl", `curl 'https://example.com/f.iso' -H 'Accept: */*' --oauth2-bearer t -c jar.txt --compressed`},
+			want: []string{"--header", "Accept:*/*", "--bearer-token", "t", "--save-cookies", "jar.txt", "--compressed", "https://example.com/f.iso", "-p", "4"},
+		},
+		{
+			args: []string{"--from-curl=curl -X GET -u bob:pw -b sid=1 https://example.com/f.iso"},
+			want: []string{"--username", "bob", "--password", "pw", "--header", "Cookie:sid=1", "https://example.com/f.iso"},
+		},
+		{
+			args: []string{"--from-curl", "curl -X POST https://example.com/f.iso"},
+			err:  "--from-curl: only GET",
+		},
+		{
+			args: []string{"--from-curl", "curl 'https://example.com/f.iso"},
+			err:  "--from-curl: unterminated single quote",
+		},
+		{
+			args: []string{"--from-curl", "curl https://example.com/f.iso", "https://example.com/g.iso"},
+			err:  "--from-curl: unexpected args",
+		},
+		{
+			args: []string{"import-curl", "curl --data x=1 https://example.com/f.iso"},
+			err:  "import-curl: --data: request with body",
+		},
+	}
+	for _, tt := range tests {
+		got, err := expandImportCurl(tt.args)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("expandImportCurl(%q) error %v, want %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandImportCurl(%q): %v", tt.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandImportCurl(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
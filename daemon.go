@@ -0,0 +1,635 @@
+package getparty
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
+)
+
+const (
+	jobActive = "active"
+	jobPaused = "paused"
+	jobDone   = "done"
+	jobFailed = "failed"
+
+	daemonStateFile = "getparty-daemon.json"
+	// env of job process with its secret args, as argv is visible to all
+	jobSecretsEnv = "GETPARTY_JOB_SECRETS"
+)
+
+// job is a download driven by daemon. Every job is a child getparty
+// process with --progress json, so jobs are isolated from each other, and
+// pause is just interrupt, which leaves session state to resume from.
+type job struct {
+	ID      int      `json:"id"`
+	URL     string   `json:"url"`
+	Args    []string `json:"args,omitempty"`
+	Secrets []string `json:"secrets,omitempty"` // names of secret args
+	Status  string   `json:"status"`
+	File    string   `json:"file,omitempty"`
+	Written int64    `json:"written"`
+	Total   int64    `json:"total"`
+	Speed   float64  `json:"speed"`
+	Retries uint32   `json:"retries"`
+	Error   string   `json:"error,omitempty"`
+
+	secrets    []string // kept in memory only, see jobSecretsEnv
+	proc       *os.Process
+	parts      map[string]event
+	target     string // status to set, when process exits on request
+	failStatus int    // http status code of the last error, if any
+}
+
+type daemonStats struct {
+	Active  int     `json:"active"`
+	Paused  int     `json:"paused"`
+	Done    int     `json:"done"`
+	Failed  int     `json:"failed"`
+	Written int64   `json:"written"`
+	Speed   float64 `json:"speed"`
+	Retries uint32  `json:"retries"`
+}
+
+// daemon serves REST API over jobs. Jobs are saved to daemonStateFile on
+// every status change, so active ones are resumed after restart or crash.
+type daemon struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	cmd      Cmd
+	exe      string
+	jobs     map[int]*job
+	nextID   int
+	closing  bool
+	failures map[failure]uint64 // since the daemon start
+}
+
+func (cmd Cmd) runDaemon(ctx context.Context) (err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "daemon")
+	}()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	d := &daemon{
+		cmd:      cmd,
+		exe:      exe,
+		jobs:     make(map[int]*job),
+		failures: make(map[failure]uint64),
+	}
+	if err := d.load(); err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr:    cmd.options.Listen,
+		Handler: d.handler(),
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	cmd.logger.Printf("listening on %s", cmd.options.Listen)
+
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = srv.Shutdown(shutdownCtx)
+	}
+	d.stopAll()
+	return err
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, d.list())
+		case http.MethodPost:
+			var req struct {
+				URL  string   `json:"url"`
+				Args []string `json:"args"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			j, err := d.add(req.URL, req.Args)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, j)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New(r.Method))
+		}
+	})
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+		id, err := strconv.Atoi(path[0])
+		if err != nil || len(path) > 2 {
+			writeError(w, http.StatusNotFound, errors.Errorf("no such job %q", r.URL.Path))
+			return
+		}
+		var action string
+		if len(path) == 2 {
+			action = path[1]
+		}
+		var j *job
+		switch {
+		case r.Method == http.MethodGet && action == "":
+			j, err = d.get(id)
+		case r.Method == http.MethodDelete && action == "":
+			j, err = d.remove(id)
+		case r.Method == http.MethodPost && action == "pause":
+			j, err = d.pause(id)
+		case r.Method == http.MethodPost && action == "resume":
+			j, err = d.resume(id)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.Errorf("%s %s", r.Method, r.URL.Path))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, j)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.stats())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		d.writeMetrics(w)
+	})
+	return mux
+}
+
+// jobOptions are long names of options, which a job may set. Others would
+// let API client read or write files outside of the daemon's --dir, run
+// commands, or reach hosts, which the daemon's network policy doesn't.
+var jobOptions = map[string]bool{
+	"parts":                    true,
+	"part-size":                true,
+	"max-connections":          true,
+	"min-part-size":            true,
+	"force-parts":              true,
+	"min-split-size":           true,
+	"part-order":               true,
+	"streamable":               true,
+	"buffer-size":              true,
+	"limit-rate":               true,
+	"nice":                     true,
+	"max-connections-per-host": true,
+	"delay-per-request":        true,
+	"max-retry":                true,
+	"max-short-reads":          true,
+	"max-tries":                true,
+	"retry-wait":               true,
+	"verify-retries":           true,
+	"max-retry-after":          true,
+	"timeout":                  true,
+	"output":                   true,
+	"dir":                      true,
+	"output-template":          true,
+	"auto-continue":            true,
+	"allow-restart":            true,
+	"force":                    true,
+	"no-clobber":               true,
+	"auto-rename":              true,
+	"state-format":             true,
+	"timestamping":             true,
+	"keep-versions":            true,
+	"append":                   true,
+	"zsync":                    true,
+	"no-space-check":           true,
+	"reserve-space":            true,
+	"expected-size":            true,
+	"accept-content-type":      true,
+	"verify-tail":              true,
+	"split-pieces":             true,
+	"user-agent":               true,
+	"username":                 true,
+	"password":                 true,
+	"bearer-token":             true,
+	"header":                   true,
+	"compressed":               true,
+	"no-check-cert":            true,
+	"pinnedpubkey":             true,
+	"verify-length":            true,
+	"max-header-size":          true,
+	"http2":                    true,
+	"http1.1":                  true,
+	"http3":                    true,
+	"safe-resolve":             true,
+	"ipv4":                     true,
+	"ipv6":                     true,
+	"lang":                     true,
+}
+
+// validateJobArgs refuses options, which aren't among jobOptions, and
+// output paths, which lead out of the daemon's --dir. Returns parsed args.
+func validateJobArgs(args []string) (*Options, error) {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "@") || strings.HasPrefix(arg, "--header=@") || strings.HasPrefix(arg, "-H@") {
+			return nil, errors.New("header files aren't allowed for jobs")
+		}
+	}
+	opts := new(Options)
+	parser := flags.NewParser(opts, flags.None)
+	rest, err := parser.ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.Errorf("unexpected args %q, url goes to url field", rest)
+	}
+	for _, g := range parser.Groups() {
+		for _, o := range g.Options() {
+			if !o.IsSet() || o.IsSetDefault() || jobOptions[o.LongName] {
+				continue
+			}
+			if o.LongName == "from-curl" {
+				// it's expanded by the child, into file options among others
+				return nil, errors.New("--from-curl isn't allowed for jobs, url and args of the command are")
+			}
+			return nil, errors.Errorf("--%s isn't allowed for jobs", o.LongName)
+		}
+	}
+	for _, name := range []string{opts.OutFileName, opts.Dir, opts.OutputTemplate} {
+		if name == "-" {
+			return nil, errors.New("stdout isn't allowed for jobs")
+		}
+		if clean := filepath.Clean(name); filepath.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return nil, errors.Errorf("%q leads out of the daemon's directory", name)
+		}
+	}
+	return opts, nil
+}
+
+func (d *daemon) add(url string, args []string) (*job, error) {
+	if url == "" {
+		return nil, errors.New("url is required")
+	}
+	if _, err := validateJobArgs(args); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextID++
+	j := &job{
+		ID:  d.nextID,
+		URL: url,
+	}
+	j.Args, j.secrets, j.Secrets = splitSecrets(args)
+	d.jobs[j.ID] = j
+	if err := d.start(j); err != nil {
+		// not to be listed, nor saved by the next state change
+		delete(d.jobs, j.ID)
+		return nil, err
+	}
+	return j.snapshot(), nil
+}
+
+func (d *daemon) get(id int) (*job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j, ok := d.jobs[id]
+	if !ok {
+		return nil, errors.Errorf("no such job %d", id)
+	}
+	return j.snapshot(), nil
+}
+
+func (d *daemon) pause(id int) (*job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j, ok := d.jobs[id]
+	if !ok {
+		return nil, errors.Errorf("no such job %d", id)
+	}
+	if j.proc == nil {
+		return nil, errors.Errorf("job %d is %s", id, j.Status)
+	}
+	j.target = jobPaused
+	interrupt(j.proc)
+	return j.snapshot(), nil
+}
+
+func (d *daemon) resume(id int) (*job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j, ok := d.jobs[id]
+	if !ok {
+		return nil, errors.Errorf("no such job %d", id)
+	}
+	if j.proc != nil || j.Status == jobDone {
+		return nil, errors.Errorf("job %d is %s", id, j.Status)
+	}
+	if err := d.start(j); err != nil {
+		return nil, err
+	}
+	return j.snapshot(), nil
+}
+
+// remove forgets job, stopping it if active. Downloaded files are kept.
+func (d *daemon) remove(id int) (*job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j, ok := d.jobs[id]
+	if !ok {
+		return nil, errors.Errorf("no such job %d", id)
+	}
+	if j.proc != nil {
+		j.target = jobPaused
+		interrupt(j.proc)
+	}
+	delete(d.jobs, id)
+	return j.snapshot(), d.save()
+}
+
+func (d *daemon) list() []*job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobs := make([]*job, 0, len(d.jobs))
+	for _, j := range d.jobs {
+		jobs = append(jobs, j.snapshot())
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].ID < jobs[k].ID
+	})
+	return jobs
+}
+
+func (d *daemon) stats() daemonStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var s daemonStats
+	for _, j := range d.jobs {
+		switch j.Status {
+		case jobActive:
+			s.Active++
+			s.Speed += j.Speed
+		case jobPaused:
+			s.Paused++
+		case jobDone:
+			s.Done++
+		case jobFailed:
+			s.Failed++
+		}
+		s.Written += j.Written
+		s.Retries += j.Retries
+	}
+	return s
+}
+
+// start runs child process of j, resuming from session state if there is
+// one. Job args are validated again, as ones loaded from daemonStateFile may
+// predate the rules. Child inherits network policy of the daemon and saves
+// into its --dir. Must be called with d.mu held.
+func (d *daemon) start(j *job) error {
+	opts, err := validateJobArgs(j.Args)
+	if err != nil {
+		return err
+	}
+	if len(j.Secrets) != 0 && j.secrets == nil {
+		return errors.Errorf("%s aren't kept over daemon restart, add the job again", strings.Join(j.Secrets, ", "))
+	}
+	args := append([]string{"--progress", "json"}, d.policyArgs()...)
+	if endpoint := d.cmd.options.OTLPEndpoint; endpoint != "" {
+		args = append(args, "--otlp-endpoint", endpoint)
+	}
+	args = append(args, j.Args...)
+	// the last one wins, so job's --dir is nested into the daemon's one
+	args = append(args, "--dir", filepath.Join(d.cmd.options.Dir, opts.Dir))
+	if stateName := findStateFile(j.File); j.File != "" && stateName != "" {
+		args = append(args, "--continue", stateName)
+	}
+	args = append(args, j.URL)
+	c := exec.Command(d.exe, args...)
+	if len(j.secrets) != 0 {
+		secrets, err := json.Marshal(j.secrets)
+		if err != nil {
+			return err
+		}
+		c.Env = append(os.Environ(), jobSecretsEnv+"="+string(secrets))
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	d.cmd.dlogger.Printf("job %d: started %q %q", j.ID, d.exe, args)
+	j.proc, j.Status, j.Error, j.target, j.failStatus = c.Process, jobActive, "", "", 0
+	j.parts = make(map[string]event)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			var e event
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				d.update(j, e)
+			}
+		}
+		err := c.Wait()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		j.proc, j.Speed = nil, 0
+		switch {
+		case d.closing:
+			// keep active, to be resumed by the next daemon
+		case j.target != "":
+			j.Status, j.Error = j.target, ""
+		case err == nil:
+			j.Status = jobDone
+		default:
+			j.Status = jobFailed
+			d.failures[failure{"job", j.failStatus}]++
+			if j.Error == "" {
+				j.Error = err.Error()
+			}
+		}
+		d.cmd.dlogger.Printf("job %d: %s %v", j.ID, j.Status, err)
+		if err := d.save(); err != nil {
+			d.cmd.logger.Printf("daemon: %v", err)
+		}
+	}()
+	return d.save()
+}
+
+// policyArgs returns network options of the daemon, which jobs can't set
+// or loosen themselves
+func (d *daemon) policyArgs() []string {
+	opts := d.cmd.options
+	var args []string
+	if opts.SafeResolve {
+		args = append(args, "--safe-resolve")
+	}
+	if opts.IPv4 {
+		args = append(args, "--ipv4")
+	}
+	if opts.IPv6 {
+		args = append(args, "--ipv6")
+	}
+	if opts.Proxy != "" {
+		args = append(args, "--proxy", opts.Proxy)
+	}
+	if opts.DNSServers != "" {
+		args = append(args, "--dns-servers", opts.DNSServers)
+	}
+	for _, r := range opts.Resolve {
+		args = append(args, "--resolve", r)
+	}
+	for _, c := range opts.ConnectTo {
+		args = append(args, "--connect-to", c)
+	}
+	if opts.UnixSocket != "" {
+		args = append(args, "--unix-socket", opts.UnixSocket)
+	}
+	return args
+}
+
+func (d *daemon) update(j *job, e event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch e.Event {
+	case "error":
+		if e.Part == "" {
+			// of the whole job, which is about to exit
+			j.failStatus, j.Error = e.Status, e.Error
+			break
+		}
+		fallthrough
+	case "progress", "done":
+		if e.Event == "error" {
+			// failed part keeps what it has written
+			d.failures[failure{"part", e.Status}]++
+			e.Written = j.parts[e.Part].Written
+		}
+		j.parts[e.Part] = e
+		j.Written, j.Speed = 0, 0
+		for _, p := range j.parts {
+			j.Written += p.Written
+			j.Speed += p.Speed
+		}
+	case "retry":
+		j.Retries++
+	case "summary":
+		if e.Error != "" {
+			j.failStatus = e.Status
+		}
+		j.File, j.Total, j.Written, j.Retries, j.Error = e.File, e.Total, e.Written, e.Retries, e.Error
+	}
+}
+
+// stopAll interrupts active jobs, so they save session state, and waits
+// for them to exit
+func (d *daemon) stopAll() {
+	d.mu.Lock()
+	d.closing = true
+	for _, j := range d.jobs {
+		if j.proc != nil {
+			interrupt(j.proc)
+		}
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+func (d *daemon) load() error {
+	b, err := ioutil.ReadFile(daemonStateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var jobs []*job
+	if err := json.Unmarshal(b, &jobs); err != nil {
+		return errors.WithMessage(err, daemonStateFile)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, j := range jobs {
+		d.jobs[j.ID] = j
+		if j.ID > d.nextID {
+			d.nextID = j.ID
+		}
+		if j.Status == jobActive {
+			if err := d.start(j); err != nil {
+				// e.g. args, which are no longer allowed
+				d.cmd.logger.Printf("daemon: job %d: %v", j.ID, err)
+				j.Status, j.Error = jobFailed, err.Error()
+			}
+		}
+	}
+	return nil
+}
+
+// save writes jobs to daemonStateFile, must be called with d.mu held
+func (d *daemon) save() error {
+	jobs := make([]*job, 0, len(d.jobs))
+	for _, j := range d.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].ID < jobs[k].ID
+	})
+	b, err := json.MarshalIndent(jobs, "", "  ")
+	if err != nil {
+		return err
+	}
+	// urls may still have credentials in them
+	return writeFileAtomic(daemonStateFile, 0600, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+func (j *job) snapshot() *job {
+	s := *j
+	s.proc, s.parts = nil, nil
+	return &s
+}
+
+// interrupt asks getparty process p to stop, saving session state. There
+// is no interrupt on windows, so it's killed there.
+func interrupt(p *os.Process) {
+	if runtime.GOOS == "windows" {
+		_ = p.Kill()
+		return
+	}
+	_ = p.Signal(os.Interrupt)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,61 @@
+package getparty
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestValidateJobArgs(t *testing.T) {
+	tests := []struct {
+		args  []string
+		fails bool
+	}{
+		{args: nil},
+		{args: []string{"-p", "8", "--max-tries", "3", "-H", "X-A:1", "--bearer-token", "t"}},
+		{args: []string{"-o", "sub/f.iso", "-P", "isos", "--force"}},
+		{args: []string{"--output-template", "{host}/{filename}"}},
+		{args: []string{"-o", "/etc/passwd", "--force"}, fails: true},
+		{args: []string{"-P", "../.."}, fails: true},
+		{args: []string{"-P", "a/../../b"}, fails: true},
+		{args: []string{"--output-template", "../{filename}"}, fails: true},
+		{args: []string{"-o", "-"}, fails: true},
+		{args: []string{"--stdout"}, fails: true},
+		{args: []string{"--on-complete", "rm -rf ~"}, fails: true},
+		{args: []string{"--unix-socket", "/var/run/docker.sock"}, fails: true},
+		{args: []string{"--connect-to", "::169.254.169.254:80"}, fails: true},
+		{args: []string{"--resolve", "example.com:443:127.0.0.1"}, fails: true},
+		{args: []string{"--proxy", "http://10.0.0.1:3128"}, fails: true},
+		{args: []string{"--cacert", "/etc/shadow"}, fails: true},
+		{args: []string{"--load-cookies", "/home/u/cookies.txt"}, fails: true},
+		{args: []string{"--from-curl", "curl -b /home/u/cookies.txt https://example.com"}, fails: true},
+		{args: []string{"-H", "@/etc/passwd"}, fails: true},
+		{args: []string{"https://example.com/f.iso"}, fails: true},
+	}
+	for _, tt := range tests {
+		_, err := validateJobArgs(tt.args)
+		if tt.fails && err == nil {
+			t.Errorf("validateJobArgs(%q) accepted", tt.args)
+		}
+		if !tt.fails && err != nil {
+			t.Errorf("validateJobArgs(%q): %v", tt.args, err)
+		}
+	}
+}
+
+func TestAddDropsJobFailedToStart(t *testing.T) {
+	d := &daemon{
+		cmd: Cmd{
+			options: &Options{},
+			dlogger: log.New(ioutil.Discard, "", 0),
+		},
+		exe:  "/nonexistent/getparty",
+		jobs: make(map[int]*job),
+	}
+	if _, err := d.add("https://example.com/f.iso", nil); err == nil {
+		t.Fatal("add of job, which can't start, succeeded")
+	}
+	if len(d.jobs) != 0 {
+		t.Errorf("jobs = %v, want none", d.jobs)
+	}
+}
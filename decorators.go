@@ -35,6 +35,13 @@ func newMsgGate(prefix string, quiet bool) msgGate {
 }
 
 func (s msgGate) flash(msg *message) {
+	if s.msgCh == nil {
+		// quiet, nobody is going to show it
+		if msg.final && msg.done != nil {
+			close(msg.done)
+		}
+		return
+	}
 	msg.times = 14
 	msg.msg = fmt.Sprintf("%s:%s", s.prefix, msg.msg)
 	select {
@@ -49,6 +56,7 @@ func (s msgGate) flash(msg *message) {
 type mainDecorator struct {
 	decor.WC
 	curTry   *uint32
+	retryAt  *int64
 	name     string
 	format   string
 	flashMsg *message
@@ -56,13 +64,14 @@ type mainDecorator struct {
 	gate     msgGate
 }
 
-func newMainDecorator(curTry *uint32, format, name string, gate msgGate, wc decor.WC) decor.Decorator {
+func newMainDecorator(curTry *uint32, retryAt *int64, format, name string, gate msgGate, wc decor.WC) decor.Decorator {
 	d := &mainDecorator{
-		WC:     wc.Init(),
-		curTry: curTry,
-		name:   name,
-		format: format,
-		gate:   gate,
+		WC:      wc.Init(),
+		curTry:  curTry,
+		retryAt: retryAt,
+		name:    name,
+		format:  format,
+		gate:    gate,
 	}
 	return d
 }
@@ -104,6 +113,12 @@ func (d *mainDecorator) Decor(stat decor.Statistics) string {
 		return d.FormatMsg(d.flashMsg.msg)
 	}
 
+	if at := atomic.LoadInt64(d.retryAt); at != 0 {
+		if wait := time.Until(time.Unix(0, at)); wait > 0 {
+			return d.FormatMsg(fmt.Sprintf("%s:retry in %s", d.name, wait.Round(time.Second)))
+		}
+	}
+
 	name := d.name
 	if atomic.LoadUint32(&globTry) > 0 {
 		name = fmt.Sprintf("%s:R%02d", name, atomic.LoadUint32(d.curTry))
@@ -0,0 +1,209 @@
+package getparty
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// dialer is net.Dialer with address family and resolution options of
+// -4, -6, --resolve, --dns-servers, --connect-to and --unix-socket applied
+type dialer struct {
+	*net.Dialer
+	network    string            // tcp4 or tcp6 to force, empty for any
+	resolve    map[string]string // host:port to addr:port
+	connectTo  []connectTo
+	unixSocket string // path to connect to, whatever address is
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.unixSocket != "" {
+		return d.Dialer.DialContext(ctx, "unix", d.unixSocket)
+	}
+	address = d.target(address)
+	if d.network != "" && network == "tcp" {
+		network = d.network
+	}
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+// target returns address to connect to instead of address, as --connect-to
+// and --resolve tell
+func (d *dialer) target(address string) string {
+	for _, c := range d.connectTo {
+		if next, ok := c.apply(address); ok {
+			address = next
+			break
+		}
+	}
+	if addr, ok := d.resolve[strings.ToLower(address)]; ok {
+		address = addr
+	}
+	return address
+}
+
+// lookup resolves address to ip:port, with the same options as dial does,
+// for transports which connect by themselves, like HTTP/3 over UDP
+func (d *dialer) lookup(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(d.target(address))
+	if err != nil {
+		return "", err
+	}
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	err = errors.Errorf("no address of %s to connect to", host)
+	for _, a := range addrs {
+		ipv4 := a.IP.To4() != nil
+		if d.network == "tcp4" && !ipv4 || d.network == "tcp6" && ipv4 {
+			continue
+		}
+		target := net.JoinHostPort(a.IP.String(), port)
+		if d.Control != nil {
+			if err = d.Control("udp", target, nil); err != nil {
+				continue
+			}
+		}
+		return target, nil
+	}
+	return "", err
+}
+
+func (d *dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// parseResolve parses curl style host:port:addr entries of --resolve, IPv6
+// host must be in brackets, IPv6 addr may be
+func parseResolve(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	resolve := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		fields := splitOutsideBrackets(entry, ':')
+		if len(fields) < 3 || fields[0] == "" || fields[1] == "" {
+			return nil, errors.Errorf("--resolve: %q isn't host:port:addr", entry)
+		}
+		// unbracketed IPv6 addr is split too
+		fields = append(fields[:2], strings.Join(fields[2:], ":"))
+		addr := strings.TrimSuffix(strings.TrimPrefix(fields[2], "["), "]")
+		if net.ParseIP(addr) == nil {
+			return nil, errors.Errorf("--resolve: %q isn't ip address", fields[2])
+		}
+		host := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(fields[0], "["), "]"))
+		resolve[net.JoinHostPort(host, fields[1])] = net.JoinHostPort(addr, fields[1])
+	}
+	return resolve, nil
+}
+
+// connectTo is curl style host:port:target:port entry of --connect-to,
+// empty host or port matches any, empty target or its port keeps the
+// original one
+type connectTo struct {
+	host, port             string
+	targetHost, targetPort string
+}
+
+// apply returns address to connect to instead of host:port address, if
+// c matches it
+func (c connectTo) apply(address string) (string, bool) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", false
+	}
+	if (c.host != "" && !strings.EqualFold(c.host, host)) || (c.port != "" && c.port != port) {
+		return "", false
+	}
+	if c.targetHost != "" {
+		host = c.targetHost
+	}
+	if c.targetPort != "" {
+		port = c.targetPort
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+// parseConnectTo parses host:port:target:port entries of --connect-to, IPv6
+// hosts may be in brackets
+func parseConnectTo(entries []string) ([]connectTo, error) {
+	var rules []connectTo
+	for _, entry := range entries {
+		fields := splitOutsideBrackets(entry, ':')
+		if len(fields) != 4 {
+			return nil, errors.Errorf("--connect-to: %q isn't host:port:target:port", entry)
+		}
+		for _, port := range []string{fields[1], fields[3]} {
+			if n, err := strconv.ParseUint(port, 10, 16); port != "" && (err != nil || n == 0) {
+				return nil, errors.Errorf("--connect-to: %q: invalid port %q", entry, port)
+			}
+		}
+		rules = append(rules, connectTo{
+			host:       strings.TrimSuffix(strings.TrimPrefix(fields[0], "["), "]"),
+			port:       fields[1],
+			targetHost: strings.TrimSuffix(strings.TrimPrefix(fields[2], "["), "]"),
+			targetPort: fields[3],
+		})
+	}
+	return rules, nil
+}
+
+// splitOutsideBrackets splits s at every sep, which isn't within [ and ]
+func splitOutsideBrackets(s string, sep rune) []string {
+	var fields []string
+	var depth, last int
+	for i, r := range s {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']' && depth > 0:
+			depth--
+		case r == sep && depth == 0:
+			fields = append(fields, s[last:i])
+			last = i + 1
+		}
+	}
+	return append(fields, s[last:])
+}
+
+// parseDNSServers parses comma separated addr[:port] list of --dns-servers
+func parseDNSServers(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var servers []string
+	for _, server := range strings.Split(list, ",") {
+		server = strings.TrimSpace(server)
+		if addr := strings.TrimSuffix(strings.TrimPrefix(server, "["), "]"); net.ParseIP(addr) != nil {
+			server = net.JoinHostPort(addr, "53")
+		}
+		host, _, err := net.SplitHostPort(server)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, errors.Errorf("--dns-servers: %q isn't addr[:port]", server)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// newResolver returns resolver, which queries servers in turn
+func newResolver(servers []string) *net.Resolver {
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
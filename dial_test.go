@@ -0,0 +1,170 @@
+package getparty
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseResolve(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  map[string]string
+	}{
+		{"example.com:443:203.0.113.7", map[string]string{"example.com:443": "203.0.113.7:443"}},
+		{"Example.COM:80:127.0.0.1", map[string]string{"example.com:80": "127.0.0.1:80"}},
+		{"example.com:443:[2001:db8::1]", map[string]string{"example.com:443": "[2001:db8::1]:443"}},
+		{"example.com:443:2001:db8::1", map[string]string{"example.com:443": "[2001:db8::1]:443"}},
+		{"[::1]:443:127.0.0.1", map[string]string{"[::1]:443": "127.0.0.1:443"}},
+		{"[2001:DB8::1]:443:[::1]", map[string]string{"[2001:db8::1]:443": "[::1]:443"}},
+		{"example.com:443", nil},
+		{":443:127.0.0.1", nil},
+		{"example.com::127.0.0.1", nil},
+		{"example.com:443:example.org", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseResolve([]string{tt.entry})
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseResolve(%q) = %v, want error", tt.entry, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseResolve(%q): %v", tt.entry, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseResolve(%q) = %v, want %v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestParseDNSServers(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"1.1.1.1", []string{"1.1.1.1:53"}},
+		{"1.1.1.1, 9.9.9.9:5353", []string{"1.1.1.1:53", "9.9.9.9:5353"}},
+		{"2001:db8::1", []string{"[2001:db8::1]:53"}},
+		{"[2001:db8::1]:5353", []string{"[2001:db8::1]:5353"}},
+		{"dns.example.com", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseDNSServers(tt.list)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseDNSServers(%q) = %q, want error", tt.list, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDNSServers(%q): %v", tt.list, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDNSServers(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestSplitOutsideBrackets(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"a:b:c", []string{"a", "b", "c"}},
+		{"", []string{""}},
+		{"::", []string{"", "", ""}},
+		{"[::1]:443", []string{"[::1]", "443"}},
+		{"[a:[b]:c]:d", []string{"[a:[b]:c]", "d"}},
+		{"]:a", []string{"]", "a"}},
+	}
+	for _, tt := range tests {
+		if got := splitOutsideBrackets(tt.s, ':'); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitOutsideBrackets(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseConnectTo(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  connectTo
+		fails bool
+	}{
+		{entry: "example.com:443:staging.example.com:8443", want: connectTo{"example.com", "443", "staging.example.com", "8443"}},
+		{entry: "::other.example.com:", want: connectTo{"", "", "other.example.com", ""}},
+		{entry: "[2001:db8::1]:443:[::1]:8443", want: connectTo{"2001:db8::1", "443", "::1", "8443"}},
+		{entry: "example.com:443:staging.example.com", fails: true},
+		{entry: "example.com:https::", fails: true},
+		{entry: "example.com:443::0", fails: true},
+		{entry: "example.com:443::65536", fails: true},
+	}
+	for _, tt := range tests {
+		got, err := parseConnectTo([]string{tt.entry})
+		if tt.fails {
+			if err == nil {
+				t.Errorf("parseConnectTo(%q) = %+v, want error", tt.entry, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseConnectTo(%q): %v", tt.entry, err)
+			continue
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("parseConnectTo(%q) = %+v, want %+v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestConnectToApply(t *testing.T) {
+	tests := []struct {
+		rule    connectTo
+		address string
+		want    string
+		ok      bool
+	}{
+		{connectTo{"example.com", "443", "staging", "8443"}, "example.com:443", "staging:8443", true},
+		{connectTo{"example.com", "443", "staging", "8443"}, "EXAMPLE.com:443", "staging:8443", true},
+		{connectTo{"example.com", "443", "staging", "8443"}, "example.com:80", "", false},
+		{connectTo{"example.com", "443", "staging", "8443"}, "example.org:443", "", false},
+		{connectTo{"", "", "", "8443"}, "example.org:80", "example.org:8443", true},
+		{connectTo{"", "443", "::1", ""}, "example.org:443", "[::1]:443", true},
+		{connectTo{"::1", "", "localhost", ""}, "[::1]:80", "localhost:80", true},
+		{connectTo{}, "example.org", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.rule.apply(tt.address)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%+v.apply(%q) = %q, %v, want %q, %v", tt.rule, tt.address, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSafeControl(t *testing.T) {
+	tests := []struct {
+		address string
+		refused bool
+	}{
+		{"93.184.216.34:443", false},
+		{"[2606:2800:220:1::]:443", false},
+		{"127.0.0.1:80", true},
+		{"169.254.169.254:80", true},
+		{"192.0.0.170:80", true},
+		{"198.18.0.1:80", true},
+		{"255.255.255.255:80", true},
+		{"[::ffff:10.0.0.1]:80", true},
+		{"[64:ff9b::a9fe:a9fe]:80", true},
+		{"[64:ff9b:1::a00:1]:80", true},
+		{"[2002:a9fe:a9fe::1]:80", true},
+		{"[fd00::1]:80", true},
+	}
+	for _, tt := range tests {
+		err := safeControl("tcp", tt.address, nil)
+		if refused := err != nil; refused != tt.refused {
+			t.Errorf("safeControl(%q) = %v, want refused %v", tt.address, err, tt.refused)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package getparty
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	hAcceptEncoding  = "Accept-Encoding"
+	hContentEncoding = "Content-Encoding"
+	acceptEncodings  = "gzip, br, zstd"
+)
+
+// isDecodable reports whether content of encoding can be decoded, which is
+// one of acceptEncodings
+func isDecodable(encoding string) bool {
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip", "br", "zstd":
+		return true
+	}
+	return false
+}
+
+// newDecoder returns reader of decoded body, closing it on Close
+func newDecoder(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return decoder{Reader: zr, body: body}, nil
+	case "br":
+		return decoder{Reader: brotli.NewReader(body), body: body}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return decoder{Reader: zr, body: body, release: zr.Close}, nil
+	}
+	return nil, errors.Errorf("unsupported %s %q", hContentEncoding, encoding)
+}
+
+type decoder struct {
+	io.Reader
+	body    io.Closer
+	release func()
+}
+
+func (d decoder) Close() error {
+	if d.release != nil {
+		d.release()
+	}
+	return d.body.Close()
+}
@@ -0,0 +1,103 @@
+package getparty
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// event is a single line of --progress json output
+type event struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Part    string    `json:"part,omitempty"`
+	Start   int64     `json:"start,omitempty"`
+	Stop    int64     `json:"stop,omitempty"`
+	Written int64     `json:"written,omitempty"`
+	Total   int64     `json:"total,omitempty"`
+	Try     int       `json:"try,omitempty"`
+	Speed   float64   `json:"speed,omitempty"`
+	Retries uint32    `json:"retries,omitempty"`
+	File    string    `json:"file,omitempty"`
+	URL     string    `json:"url,omitempty"`
+	Status  int       `json:"status,omitempty"`
+	Cookies []string  `json:"cookies,omitempty"`
+	Elapsed float64   `json:"elapsed,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// eventLog writes newline delimited json events. Nil *eventLog is valid
+// and discards everything, so callers don't need to check mode.
+type eventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newEventLog(w io.Writer) *eventLog {
+	return &eventLog{enc: json.NewEncoder(w)}
+}
+
+func (l *eventLog) emit(e event) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_ = l.enc.Encode(e)
+}
+
+func (l *eventLog) partError(p *Part, err error) {
+	if l == nil || err == nil {
+		return
+	}
+	l.emit(event{Event: "error", Part: p.name, Status: errorStatus(err), Error: err.Error()})
+}
+
+// errorStatus returns http status code err is caused by, 0 if it isn't
+func errorStatus(err error) int {
+	if e, ok := errors.Cause(err).(StatusError); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// track emits "progress" event for every active part each interval,
+// until ctx is done.
+func (l *eventLog) track(ctx context.Context, ws *workStealer, interval time.Duration) {
+	if l == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ws.mu.Lock()
+			for _, p := range ws.session.Parts {
+				if p.isDone() || p.name == "" {
+					continue
+				}
+				p.mu.Lock()
+				e := event{
+					Event:   "progress",
+					Part:    p.name,
+					Written: p.Written,
+					Total:   p.Stop - p.Start + 1,
+				}
+				if !p.started.IsZero() {
+					e.Speed = float64(p.Written-p.startWritten) / time.Since(p.started).Seconds()
+				}
+				p.mu.Unlock()
+				l.emit(e)
+			}
+			ws.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package getparty
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	reByteRange = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+	reEPSV      = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+	rePASV      = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+)
+
+// ftpRoundTripper implements http.RoundTripper on top of ftp protocol,
+// so ftp urls can be downloaded by the same Session/Part machinery.
+// Range requests are mapped onto REST command, ranges are advertised only
+// if server accepts it.
+type ftpRoundTripper struct {
+	dialer *dialer
+}
+
+func (rt ftpRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	defer func() {
+		err = errors.WithMessage(err, "ftp")
+	}()
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "21")
+	}
+	conn, err := rt.dialer.DialContext(req.Context(), "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{
+		Conn:   textproto.NewConn(conn),
+		host:   req.URL.Hostname(),
+		dialer: rt.dialer,
+	}
+	stop := watchContext(req, c)
+	var streaming bool
+	defer func() {
+		if !streaming {
+			stop()
+			c.quit()
+		}
+	}()
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return nil, err
+	}
+	user, pass := "anonymous", "anonymous@"
+	if req.URL.User != nil {
+		user = req.URL.User.Username()
+		if p, ok := req.URL.User.Password(); ok {
+			pass = p
+		}
+	}
+	code, msg, err := c.cmd("USER " + user)
+	if err != nil {
+		return nil, err
+	}
+	if code == 331 {
+		code, msg, err = c.cmd("PASS " + pass)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if code != 230 {
+		return ftpResponse(req, http.StatusUnauthorized, msg), nil
+	}
+	if code, msg, err := c.cmd("TYPE I"); err != nil || code != 200 {
+		return nil, errors.Errorf("TYPE I: %d %s %v", code, msg, err)
+	}
+
+	size := int64(-1)
+	if code, msg, err := c.cmd("SIZE " + req.URL.Path); err != nil {
+		return nil, err
+	} else if code == 213 {
+		size, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	} else if code == 550 {
+		return ftpResponse(req, http.StatusNotFound, msg), nil
+	}
+
+	status, start, end := http.StatusOK, int64(0), size-1
+	groups := reByteRange.FindStringSubmatch(req.Header.Get(hRange))
+	if groups != nil {
+		start, _ = strconv.ParseInt(groups[1], 10, 64)
+		if groups[2] != "" {
+			end, _ = strconv.ParseInt(groups[2], 10, 64)
+		}
+	}
+	// REST 0 changes nothing, but tells whether ranges can be served
+	code, _, err = c.cmd(fmt.Sprintf("REST %d", start))
+	if err != nil {
+		return nil, err
+	}
+	ranged := code == 350
+	switch {
+	case groups == nil:
+	case ranged && (start != 0 || size > 0):
+		status = http.StatusPartialContent
+	default:
+		// no REST support, fallback to single stream
+		start, end = 0, size-1
+	}
+
+	if err := c.openData(req); err != nil {
+		return nil, err
+	}
+	if code, msg, err := c.cmd("RETR " + req.URL.Path); err != nil {
+		return nil, err
+	} else if code != 125 && code != 150 {
+		return ftpResponse(req, http.StatusNotFound, msg), nil
+	}
+
+	resp = ftpResponse(req, status, "")
+	if ranged {
+		resp.Header.Set("Accept-Ranges", acceptRangesType)
+	}
+	resp.ContentLength = -1
+	var body io.Reader = c.data
+	if end >= start && end >= 0 {
+		resp.ContentLength = end - start + 1
+		body = io.LimitReader(c.data, resp.ContentLength)
+	}
+	if status == http.StatusPartialContent {
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	resp.Body = &ftpBody{Reader: body, conn: c, stop: stop}
+	streaming = true
+	return resp, nil
+}
+
+type ftpConn struct {
+	*textproto.Conn
+	host   string
+	dialer *dialer
+	data   net.Conn
+}
+
+func (c *ftpConn) cmd(line string) (int, string, error) {
+	if err := c.PrintfLine("%s", line); err != nil {
+		return 0, "", err
+	}
+	return c.ReadResponse(0)
+}
+
+func (c *ftpConn) openData(req *http.Request) (err error) {
+	var addr string
+	if code, msg, err := c.cmd("EPSV"); err == nil && code == 229 {
+		if groups := reEPSV.FindStringSubmatch(msg); groups != nil {
+			addr = net.JoinHostPort(c.host, groups[1])
+		}
+	}
+	if addr == "" {
+		code, msg, err := c.cmd("PASV")
+		if err != nil {
+			return err
+		}
+		groups := rePASV.FindStringSubmatch(msg)
+		if code != 227 || groups == nil {
+			return errors.Errorf("PASV: %d %s", code, msg)
+		}
+		p1, _ := strconv.Atoi(groups[5])
+		p2, _ := strconv.Atoi(groups[6])
+		addr = net.JoinHostPort(c.host, strconv.Itoa(p1<<8|p2))
+	}
+	c.data, err = c.dialer.DialContext(req.Context(), "tcp", addr)
+	return err
+}
+
+func (c *ftpConn) Close() error {
+	if c.data != nil {
+		c.data.Close()
+	}
+	return c.Conn.Close()
+}
+
+func (c *ftpConn) quit() {
+	if c.data != nil {
+		c.data.Close()
+		c.data = nil
+	}
+	c.PrintfLine("QUIT")
+	c.Conn.Close()
+}
+
+type ftpBody struct {
+	io.Reader
+	conn *ftpConn
+	stop func()
+}
+
+func (b *ftpBody) Close() error {
+	b.stop()
+	b.conn.quit()
+	return nil
+}
+
+func ftpResponse(req *http.Request, status int, msg string) *http.Response {
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "FTP",
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}
+	if msg != "" {
+		resp.Body = ioutil.NopCloser(strings.NewReader(msg))
+		resp.Status += ": " + msg
+	}
+	return resp
+}
+
+// watchContext closes conn on req's context cancellation, until returned
+// func is called.
+func watchContext(req *http.Request, conn io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-req.Context().Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,126 @@
+package getparty
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveFTP serves content as /f.bin to one control connection at a time,
+// REST is accepted only if rest is true
+func serveFTP(t *testing.T, content string, rest bool) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFTPConn(conn, content, rest)
+		}
+	}()
+	return ln
+}
+
+func serveFTPConn(conn net.Conn, content string, rest bool) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, a ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", a...)
+	}
+	reply("220 ready")
+	var offset int
+	var data net.Listener
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "USER":
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 binary")
+		case "SIZE":
+			reply("213 %d", len(content))
+		case "REST":
+			if !rest {
+				reply("502 not implemented")
+				continue
+			}
+			offset, _ = strconv.Atoi(fields[1])
+			reply("350 restarting at %d", offset)
+		case "EPSV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				return
+			}
+			reply("229 passive (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "RETR":
+			reply("150 sending")
+			dc, err := data.Accept()
+			data.Close()
+			if err != nil {
+				return
+			}
+			dc.Write([]byte(content[offset:]))
+			dc.Close()
+			reply("226 done")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestFTPRanges(t *testing.T) {
+	const content = "0123456789"
+	tests := []struct {
+		rest        bool
+		rangeHeader string
+		status      int
+		ranges      string
+		body        string
+	}{
+		{true, "", http.StatusOK, acceptRangesType, content},
+		{true, "bytes=3-5", http.StatusPartialContent, acceptRangesType, "345"},
+		{false, "", http.StatusOK, "", content},
+		{false, "bytes=3-5", http.StatusOK, "", content},
+		{false, "bytes=0-5", http.StatusOK, "", content},
+	}
+	for _, tt := range tests {
+		ln := serveFTP(t, content, tt.rest)
+		req, err := http.NewRequest(http.MethodGet, "ftp://"+ln.Addr().String()+"/f.bin", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.rangeHeader != "" {
+			req.Header.Set(hRange, tt.rangeHeader)
+		}
+		rt := ftpRoundTripper{dialer: Cmd{options: new(Options)}.newDialer()}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("rest %v, %q: %v", tt.rest, tt.rangeHeader, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		ln.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status || resp.Header.Get("Accept-Ranges") != tt.ranges || string(body) != tt.body {
+			t.Errorf("rest %v, %q: got %d, Accept-Ranges %q, %q, want %d, %q, %q",
+				tt.rest, tt.rangeHeader, resp.StatusCode, resp.Header.Get("Accept-Ranges"), body, tt.status, tt.ranges, tt.body)
+		}
+	}
+}
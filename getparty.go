@@ -4,12 +4,13 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"os/signal"
@@ -17,15 +18,16 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	cleanhttp "github.com/hashicorp/go-cleanhttp"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/pkg/errors"
 	"github.com/vbauerster/mpb/v5"
+	"github.com/vbauerster/mpb/v5/decor"
+	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/ssh/terminal"
-	"golang.org/x/net/publicsuffix"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -35,10 +37,14 @@ const (
 
 	maxRedirects        = 10
 	refreshRate         = 200
+	niceRate            = 512 * 1024
+	defaultSplitSize    = 1024 * 1024
+	defaultConnections  = 8 // of --part-size without --max-connections
 	hUserAgentKey       = "User-Agent"
 	hContentDisposition = "Content-Disposition"
 	hRange              = "Range"
 	hCookie             = "Cookie"
+	hReferer            = "Referer"
 )
 
 // https://regex101.com/r/N4AovD/3
@@ -50,6 +56,17 @@ var userAgents = map[string]string{
 	"safari":  "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_4) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/11.1 Safari/605.1.15",
 }
 
+// StatusError is returned on unexpected HTTP response status
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // advised by 429 or 503 response, 0 if not
+}
+
+func (e StatusError) Error() string {
+	return "unexpected status: " + e.Status
+}
+
 type ExpectedError struct {
 	Err error
 }
@@ -61,57 +78,170 @@ func (e ExpectedError) Error() string {
 // Options struct, represents cmd line options
 type Options struct {
 	Parts              uint              `short:"p" long:"parts" value-name:"n" default:"2" description:"number of parts"`
+	PartSize           ByteSize          `long:"part-size" value-name:"size" description:"split into parts of size, e.g. 64M, instead of -p number of them, at least --min-part-size, see --max-connections"`
+	MaxConnections     uint              `long:"max-connections" value-name:"n" description:"download at most n parts at once, others wait for their turn (default: all, or 8 with --part-size)"`
+	MinPartSize        ByteSize          `long:"min-part-size" value-name:"size" default:"1M" description:"lower number of parts, so each one is at least size, 0 disables"`
+	ForceParts         bool              `long:"force-parts" description:"split even if server doesn't advertise byte ranges, falling back to single part, if it ignores them"`
+	MinSplitSize       ByteSize          `long:"min-split-size" value-name:"size" default:"1M" description:"steal half of the slowest part's remainder if it's at least 2*size, merge not started parts smaller than size into neighbors, 0 disables"`
+	PartOrder          string            `long:"part-order" choice:"sequential" choice:"random" choice:"tail-first" description:"start parts one by one in this order, each once the previous one has got response, instead of all at once"`
+	Streamable         bool              `long:"streamable" description:"prioritize head of content for playback while downloading, e.g. with --stdout: freed connections help the part with the earliest missing byte, instead of the slowest one"`
+	BufferSize         ByteSize          `long:"buffer-size" value-name:"size" default:"128K" description:"read and copy buffer, rounded up to multiple of 4K, cut down to quarter of --limit-rate"`
+	LimitRate          ByteSize          `long:"limit-rate" value-name:"size" description:"cap total download speed to size per second, e.g. 512K"`
+	Nice               bool              `long:"nice" description:"background mode: single connection, --limit-rate 512K unless given, idle cpu and I/O priority"`
+	MaxConnsPerHost    uint              `long:"max-connections-per-host" value-name:"n" description:"max simultaneous part connections to a host, over all parts and batch items, others wait for their turn"`
+	DelayPerRequest    time.Duration     `long:"delay-per-request" value-name:"duration" description:"min delay between part requests to a host, e.g. 500ms"`
 	MaxRetry           uint              `short:"r" long:"max-retry" value-name:"n" default:"10" description:"max retries per each part"`
+	MaxShortReads      uint              `long:"max-short-reads" value-name:"n" default:"64" description:"max immediate continuations after premature end of response, not counted as retries"`
+	MaxTries           uint              `long:"max-tries" value-name:"n" default:"1" description:"max whole session tries, rotating urls and mirrors, keeping downloaded data"`
+	RetryWait          time.Duration     `long:"retry-wait" value-name:"duration" default:"5s" description:"wait between session tries"`
+	VerifyRetries      uint              `long:"verify-retries" value-name:"n" description:"on zsync or torrent hash mismatch, download mismatching pieces, or the whole file if there are no piece hashes, again up to n times"`
+	MaxRetryAfter      time.Duration     `long:"max-retry-after" value-name:"duration" default:"5m" description:"longest Retry-After of 429 and 503 responses to wait for, server asking for longer fails the part"`
 	Timeout            uint              `short:"t" long:"timeout" value-name:"sec" default:"15" description:"context timeout"`
-	OutFileName        string            `short:"o" long:"output" value-name:"filename" description:"user defined output"`
+	OutFileName        string            `short:"o" long:"output" value-name:"filename" description:"user defined output, - for stdout"`
+	Dir                string            `short:"P" long:"dir" value-name:"dir" description:"directory to save to, created if missing"`
+	OutputTemplate     string            `long:"output-template" value-name:"template" description:"name downloads by template of {host}, {filename}, {name}, {ext}, {date}, {hash:n}, may contain directories"`
+	Stdout             bool              `long:"stdout" description:"write content to stdout, same as -o -"`
 	JSONFileName       string            `short:"c" long:"continue" value-name:"state.json" description:"resume download from the last session"`
+	AutoContinue       bool              `long:"auto-continue" description:"resume unfinished session of the same output, found by its state file, without asking"`
+	AllowRestart       bool              `long:"allow-restart" description:"on resume, start over if the remote file has changed, instead of failing"`
+	Force              bool              `long:"force" description:"overwrite existing output, part and state files without asking"`
+	NoClobber          bool              `long:"no-clobber" description:"skip download, if output, part or state files exist already"`
+	AutoRename         bool              `long:"auto-rename" description:"save to name.1, name.2 and so on, if output, part or state files exist already"`
+	StateFormat        string            `long:"state-format" choice:"json" choice:"yaml" choice:"toml" default:"json" description:"format of session state file, yaml and toml are commented for hand editing"`
+	Timestamping       bool              `short:"N" long:"timestamping" description:"skip download if remote file isn't newer than local one, set mtime from Last-Modified"`
+	Watch              time.Duration     `long:"watch" value-name:"interval" description:"check url every interval and download it again, if it has changed, implies --timestamping, --auto-continue and --allow-restart"`
+	KeepVersions       uint              `long:"keep-versions" value-name:"n" description:"keep n versions replaced by --timestamping or --watch, as name.1, name.2 and so on"`
+	Append             bool              `long:"append" description:"treat existing output file as downloaded prefix, request only the rest"`
+	Zsync              bool              `long:"zsync" description:"reuse blocks of existing output file, which match url.zsync control file, request only the rest"`
+	NoSpaceCheck       bool              `long:"no-space-check" description:"don't check free disk space and inodes before download"`
+	ReserveSpace       bool              `long:"reserve-space" description:"allocate disk space of parts upfront, where filesystem supports it"`
+	ExpectedSize       SizeTolerance     `long:"expected-size" value-name:"size[,tolerance]" description:"refuse content of other length, before any part is started, tolerance is size or percent, e.g. 1.2G,5%"`
+	AcceptContentType  []string          `long:"accept-content-type" value-name:"type" description:"refuse content of other Content-Type, before any part is started, e.g. application/zip or video/*, may be repeated"`
+	VerifyTail         ByteSize          `long:"verify-tail" value-name:"size" description:"on resume, compare last size bytes of each part with the server and restart mismatching ones"`
+	SignatureURL       string            `long:"signature-url" value-name:"url" description:"verify saved file with detached OpenPGP signature at url, {} is replaced with download url, e.g. {}.asc"`
+	SignatureFile      string            `long:"signature-file" value-name:"file" description:"verify saved file with detached OpenPGP signature of file"`
+	Keyring            []string          `long:"keyring" value-name:"file" description:"public keys to verify signature with, armored or binary, may be repeated"`
+	SplitPieces        uint              `long:"split-pieces" value-name:"n" description:"url is the first of n split archive pieces (file.001, file.z01), join them"`
 	UserAgent          string            `short:"a" long:"user-agent" choice:"chrome" choice:"firefox" choice:"safari" default:"chrome" description:"User-Agent header"`
+	InputFile          string            `short:"i" long:"input-file" value-name:"urls.txt" description:"batch of downloads, one per line, whitespace separated alternate urls, - for stdin"`
+	FailedFile         string            `long:"failed-file" value-name:"failed.txt" default:"failed.txt" description:"where batch writes items, which didn't complete, for retry subcommand"`
+	Halt               string            `long:"halt" choice:"never" choice:"soon" choice:"on-error" default:"never" description:"batch failure policy: never stop, stop soon with results, or stop on error at once"`
+	Daemon             bool              `long:"daemon" description:"serve REST API of download jobs, see --listen"`
+	Listen             string            `long:"listen" value-name:"addr" default:"127.0.0.1:6800" description:"address of --daemon API"`
 	BestMirror         bool              `short:"b" long:"best-mirror" description:"pickup the fastest mirror"`
+	BenchSize          ByteSize          `long:"bench-size" value-name:"size" description:"with --best-mirror, rank mirrors by throughput of downloading first size bytes from each, instead of picking the first to respond"`
+	BenchTop           uint              `long:"bench-top" value-name:"k" description:"with --bench-size and --multi-source, download from k best mirrors only"`
+	MultiSource        bool              `long:"multi-source" description:"with --best-mirror, spread parts over all responding mirrors"`
+	CrossCheck         uint              `long:"cross-check" value-name:"bytes" description:"with --multi-source, compare window of n bytes of each mirror against the best one"`
+	TotalBar           string            `long:"total-bar" choice:"top" choice:"bottom" choice:"off" default:"bottom" description:"aggregate bar of all parts: total bytes, speed, ETA and retries"`
+	SummaryInterval    time.Duration     `long:"summary-interval" value-name:"duration" description:"with --quiet or when output isn't a terminal, print aggregate progress line each duration"`
+	CostPerGB          float64           `long:"cost-per-gb" value-name:"price" description:"show estimated transfer cost at price per GB of egress, e.g. 0.09"`
+	OnComplete         string            `long:"on-complete" value-name:"command" description:"run shell command when done, {} or {file}, {url}, {size}, {sha256} are replaced with quoted values, also set as GETPARTY_FILE etc. environment"`
+	OnError            string            `long:"on-error" value-name:"command" description:"run shell command on failure, {file}, {url} and {error} are available"`
 	Quiet              bool              `short:"q" long:"quiet" description:"quiet mode, no progress bars"`
-	AuthUser           string            `short:"u" long:"username" description:"basic http auth username"`
-	AuthPass           string            `long:"password" description:"basic http auth password"`
-	HeaderMap          map[string]string `short:"H" long:"header" value-name:"key:value" description:"arbitrary http header"`
+	Progress           string            `long:"progress" choice:"auto" choice:"bar" choice:"json" choice:"simple-text" choice:"none" default:"auto" description:"progress output: bars, newline delimited json events, plain sentences at 25, 50, 75 and 100 percent or none, auto is bars on capable terminal and plain sentences otherwise"`
+	ProgressFile       string            `long:"progress-file" value-name:"path" description:"write progress events to path, e.g. named pipe, instead of stdout"`
+	JSONSummary        string            `long:"json-summary" value-name:"path" description:"write final report to path as json: url, file, size, duration, avg speed, retries, sha256 and exit code"`
+	OTLPEndpoint       string            `long:"otlp-endpoint" value-name:"url" description:"export traces of probing and part attempts to OTLP/HTTP collector, e.g. http://localhost:4318, daemon passes it to jobs"`
+	AuthUser           string            `short:"u" long:"username" description:"http auth username, basic or digest as server asks"`
+	AuthPass           string            `long:"password" description:"http auth password"`
+	BearerToken        string            `long:"bearer-token" value-name:"token" description:"bearer token, sent only to hosts of given urls"`
+	TokenFile          string            `long:"token-file" value-name:"file" description:"read bearer token from file"`
+	LoadCookies        string            `long:"load-cookies" value-name:"cookies.txt" description:"load cookies from file in Netscape format"`
+	SaveCookies        string            `long:"save-cookies" value-name:"cookies.txt" description:"save cookies to file in Netscape format, when done"`
+	HeaderMap          map[string]string `short:"H" long:"header" value-name:"key:value" description:"arbitrary http header, @file reads them from file, one per line"`
+	FromCurl           string            `long:"from-curl" value-name:"command" description:"download what curl command, as copied by browser devtools, would: url, headers, cookies and auth, GET only, - reads it from stdin"`
+	Compressed         bool              `long:"compressed" description:"request gzip, br or zstd encoded content and decode it, in single part, as decoded length is unknown"`
 	InsecureSkipVerify bool              `long:"no-check-cert" description:"don't validate the server's certificate"`
+	CACert             string            `long:"cacert" value-name:"file" description:"PEM bundle of CA certificates to verify the server with"`
+	Cert               string            `long:"cert" value-name:"file" description:"PEM client certificate for mutual TLS"`
+	Key                string            `long:"key" value-name:"file" description:"PEM private key of --cert, if not in the same file"`
+	PinnedPubKey       string            `long:"pinnedpubkey" value-name:"sha256//hash" description:"';' separated base64 sha256 hashes of accepted server public keys"`
+	TLSSessionCache    string            `long:"tls-session-cache" value-name:"file" description:"keep TLS sessions in file, to resume them in next runs instead of full handshake"`
+	VerifyLength       string            `long:"verify-length" choice:"strict" choice:"lenient" default:"lenient" description:"strict makes Content-Length, Content-Range and written bytes mismatch an error"`
+	MaxHeaderSize      ByteSize          `long:"max-header-size" value-name:"size" default:"64K" description:"max size of response headers while probing"`
+	HTTP2              bool              `long:"http2" description:"use HTTP/2, over TLS if server agrees, cleartext h2c with prior knowledge for http urls"`
+	HTTP11             bool              `long:"http1.1" description:"use HTTP/1.1 only, one connection per part"`
+	HTTP3              bool              `long:"http3" description:"use HTTP/3 over QUIC for https urls, if built with it, see cmd/getparty-h3"`
+	Proxy              string            `long:"proxy" value-name:"url" description:"proxy url, overrides http(s)_proxy environment"`
+	SafeResolve        bool              `long:"safe-resolve" description:"refuse to connect to private, loopback and link-local addresses"`
+	IPv4               bool              `short:"4" long:"ipv4" description:"connect to IPv4 addresses only"`
+	IPv6               bool              `short:"6" long:"ipv6" description:"connect to IPv6 addresses only"`
+	Resolve            []string          `long:"resolve" value-name:"host:port:addr" description:"connect to addr instead of resolving host:port, may be repeated"`
+	DNSServers         string            `long:"dns-servers" value-name:"addr[,addr]" description:"resolve hosts with these DNS servers instead of the system ones"`
+	ConnectTo          []string          `long:"connect-to" value-name:"host:port:target:port" description:"connect to target:port instead of host:port, empty host or port matches any, empty target keeps original, may be repeated"`
+	UnixSocket         string            `long:"unix-socket" value-name:"path" description:"connect through Unix domain socket at path instead of network"`
+	Lang               string            `long:"lang" value-name:"code" description:"language of messages, e.g. ru or de (default: from LC_ALL, LC_MESSAGES or LANG)"`
+	Config             string            `long:"config" value-name:"config.toml" description:"option defaults, keyed by long name (default: ~/.config/getparty/config.toml)"`
+	SimulateLatency    time.Duration     `long:"simulate-latency" value-name:"duration" hidden:"true" description:"for testing: delay every request"`
+	SimulateLoss       float64           `long:"simulate-loss" value-name:"probability" hidden:"true" description:"for testing: fail request or cut its body short with probability 0..1"`
+	SimulateSeed       int64             `long:"simulate-seed" value-name:"n" default:"1" hidden:"true" description:"for testing: seed of --simulate-loss"`
+	LogFile            string            `long:"log-file" value-name:"path" description:"write log to path as well, whether it's shown or not, see --log-level"`
+	LogLevel           string            `long:"log-level" choice:"info" choice:"debug" choice:"trace" default:"trace" description:"of --log-file: plain messages, plus debug of every part, plus headers of every request and response"`
+	LogMaxSize         ByteSize          `long:"log-max-size" value-name:"size" default:"10M" description:"rotate --log-file, once it exceeds size, 0 disables"`
+	LogMaxBackups      uint              `long:"log-max-backups" value-name:"n" default:"3" description:"rotated log files to keep, as path.1, path.2 and so on"`
 	Debug              bool              `long:"debug" description:"enable debug to stderr"`
 	Version            bool              `long:"version" description:"show version"`
 }
 
 type Cmd struct {
-	Out      io.Writer
-	Err      io.Writer
-	userInfo *url.Userinfo
-	options  *Options
-	parser   *flags.Parser
-	logger   *log.Logger
-	dlogger  *log.Logger
+	Out       io.Writer
+	Err       io.Writer
+	userInfo  *url.Userinfo
+	tlsConfig *tls.Config
+	options   *Options
+	parser    *flags.Parser
+	logger    *log.Logger
+	dlogger   *log.Logger
+	events    *eventLog
+	stream    *streamer
+	auth      *authState
+	msgs      catalog
+	text      *textProgress
+	ctl       *controller
+	sim       *simulator
+	tracer    *tracer
+	hosts     *hostLimiter
+	resolve   map[string]string
+	dns       []string
+	connectTo []connectTo
+	torrent   *torrentMeta
+	keyring   openpgp.EntityList
+	logFile   *logFile
+	watchETag string // of the last download of --watch
+	unchanged bool   // download has been skipped: remote isn't modified, or existing file is kept
+	noBars    bool   // progress isn't drawn as bars, though other output may be
+	mirrorOpt *mirrorTestOptions
+	canceler  atomic.Value // of *canceler, while Run is in progress
+	verified  int          // verify retries of the current runTries
+	userUrl   string
+	userArgs  []string
+	summary   *summary // of --json-summary
+	leftState string   // state file of failed session to resume from
 }
 
+// Exit reports err and returns exit code of it, see exitCode
 func (cmd Cmd) Exit(err error) int {
-	if err == nil {
-		return 0
-	}
-	switch e := errors.Cause(err).(type) {
-	case *flags.Error:
-		if e.Type == flags.ErrHelp {
-			return 0
-		}
+	code := cmd.exitCode(err)
+	switch code {
+	case exitOK:
+		return code
+	case exitUsage:
 		cmd.parser.WriteHelp(cmd.Err)
-		return 2
-	case ExpectedError:
+	case exitUnexpected:
 		if cmd.options.Debug {
-			cmd.dlogger.Printf("exit error: %+v", err)
+			cmd.dlogger.Printf("unexpected error: %+v", err)
 		} else {
-			fmt.Fprintf(cmd.Err, "exit error: %v\n", err)
+			fmt.Fprintf(cmd.Err, cmd.msgs.T("unexpected error: %v\n"), err)
 		}
-		return 1
 	default:
 		if cmd.options.Debug {
-			cmd.dlogger.Printf("unexpected error: %+v", err)
+			cmd.dlogger.Printf("exit error: %+v", err)
 		} else {
-			fmt.Fprintf(cmd.Err, "unexpected error: %v\n", err)
+			fmt.Fprintf(cmd.Err, cmd.msgs.T("exit error: %v\n"), err)
 		}
-		return 3
 	}
+	return code
 }
 
 func (cmd *Cmd) Run(args []string, version string) (err error) {
@@ -123,22 +253,209 @@ func (cmd *Cmd) Run(args []string, version string) (err error) {
 	cmd.parser = flags.NewParser(cmd.options, flags.Default)
 	cmd.parser.Name = cmdName
 	cmd.parser.Usage = "[OPTIONS] url"
+	cmd.parser.SubcommandsOptional = true
+	cmd.mirrorOpt = new(mirrorTestOptions)
+	_, err = cmd.parser.AddCommand(mirrorTestCommand,
+		"rank mirrors by latency and throughput, without downloading",
+		"Every mirror of the list downloads first --sample bytes concurrently, ranking is printed as a table or json.",
+		cmd.mirrorOpt,
+	)
+	if err != nil {
+		return err
+	}
+
+	if secrets := os.Getenv(jobSecretsEnv); secrets != "" {
+		// credentials of daemon job, not to be seen in its argv
+		var secretArgs []string
+		if err := json.Unmarshal([]byte(secrets), &secretArgs); err != nil {
+			return errors.WithMessage(err, jobSecretsEnv)
+		}
+		os.Unsetenv(jobSecretsEnv)
+		args = append(secretArgs, args...)
+	}
+	args, err = expandRetry(args)
+	if err != nil {
+		return err
+	}
+	args, err = expandImportCurl(args)
+	if err != nil {
+		return err
+	}
+	cmd.userArgs = args
+	args, err = expandHeaderFiles(args)
+	if err != nil {
+		return err
+	}
 
+	configFile, explicit := configPath(args)
+	if !explicit {
+		configFile = defaultConfigPath()
+	}
+	if configFile != "" {
+		configArgs, err := cmd.loadConfig(configFile, explicit)
+		if err != nil {
+			return err
+		}
+		args = append(configArgs, args...)
+	}
+
+	for _, arg := range args {
+		if arg == mirrorTestCommand {
+			// no url for subcommand's help
+			cmd.parser.Usage = "[OPTIONS]"
+			break
+		}
+	}
 	args, err = cmd.parser.ParseArgs(args)
 	if err != nil {
 		return err
 	}
 
+	lang := cmd.options.Lang
+	if lang == "" {
+		lang = detectLanguage()
+	}
+	cmd.msgs = catalogs[lang]
+
 	if cmd.options.Version {
 		fmt.Fprintf(cmd.Out, "%s: %s\n", cmdName, version)
 		fmt.Fprintf(cmd.Out, "Project home: %s\n", projectHome)
 		return nil
 	}
 
-	if len(args) == 0 && cmd.options.JSONFileName == "" && !cmd.options.BestMirror {
+	mirrorTest := cmd.parser.Active != nil && cmd.parser.Active.Name == mirrorTestCommand
+	if len(args) == 0 && cmd.options.JSONFileName == "" && !cmd.options.BestMirror && cmd.options.InputFile == "" && !cmd.options.Daemon && !mirrorTest {
 		return new(flags.Error)
 	}
 
+	if cmd.options.FromCurl != "" {
+		// command line one is expanded already, before config is read
+		return errors.New("--from-curl isn't allowed in config file")
+	}
+
+	if cmd.options.Nice {
+		cmd.options.Parts = 1
+		cmd.options.PartSize = 0
+		cmd.options.MinSplitSize = 0
+		if cmd.options.LimitRate == 0 {
+			cmd.options.LimitRate = niceRate
+		}
+	}
+
+	if size := cmd.options.PartSize; size > 0 && size < cmd.options.MinPartSize {
+		// every part is a file and a connection of its own
+		return errors.Errorf("--part-size: %d is less than --min-part-size %d", size, cmd.options.MinPartSize)
+	}
+
+	if cmd.options.CostPerGB < 0 {
+		return errors.New("--cost-per-gb: price can't be negative")
+	}
+
+	if cmd.options.SimulateLoss < 0 || cmd.options.SimulateLoss > 1 {
+		return errors.New("--simulate-loss: probability isn't in 0..1")
+	}
+	cmd.sim = newSimulator(cmd.options.SimulateLatency, cmd.options.SimulateLoss, cmd.options.SimulateSeed)
+
+	if cmd.options.OTLPEndpoint != "" {
+		if _, err := url.Parse(cmd.options.OTLPEndpoint); err != nil {
+			return errors.WithMessage(err, "otlp-endpoint")
+		}
+	}
+	cmd.tracer = newTracer(cmd.options.OTLPEndpoint)
+
+	if cmd.options.DelayPerRequest < 0 {
+		return errors.New("--delay-per-request: duration can't be negative")
+	}
+	cmd.hosts = newHostLimiter(cmd.options.MaxConnsPerHost, cmd.options.DelayPerRequest)
+
+	if cmd.options.Append && cmd.options.Zsync {
+		return errors.New("--append and --zsync are mutually exclusive")
+	}
+
+	var clobber int
+	for _, set := range []bool{cmd.options.Force, cmd.options.NoClobber, cmd.options.AutoRename} {
+		if set {
+			clobber++
+		}
+	}
+	if clobber > 1 {
+		return errors.New("--force, --no-clobber and --auto-rename are mutually exclusive")
+	}
+
+	if cmd.options.SignatureURL != "" || cmd.options.SignatureFile != "" {
+		switch {
+		case cmd.options.SignatureURL != "" && cmd.options.SignatureFile != "":
+			return errors.New("--signature-url and --signature-file are mutually exclusive")
+		case len(cmd.options.Keyring) == 0:
+			return errors.New("--keyring is required to verify signature")
+		case cmd.options.Stdout || cmd.options.OutFileName == "-":
+			return errors.New("stdout: can't verify signature of streamed content")
+		}
+		if cmd.keyring, err = readKeyring(cmd.options.Keyring); err != nil {
+			return errors.WithMessage(err, "keyring")
+		}
+	}
+
+	if cmd.options.Watch < 0 {
+		return errors.New("--watch: interval can't be negative")
+	}
+	if cmd.options.Watch > 0 && (cmd.options.InputFile != "" || cmd.options.Stdout || cmd.options.OutFileName == "-" || cmd.options.JSONFileName != "") {
+		return errors.New("--watch applies to single download to file")
+	}
+
+	if cmd.options.JSONSummary != "" && (cmd.options.Daemon || mirrorTest) {
+		return errors.New("--json-summary applies to downloads")
+	}
+
+	if cmd.options.HTTP2 && cmd.options.HTTP11 {
+		return errors.New("--http2 and --http1.1 are mutually exclusive")
+	}
+
+	if cmd.options.HTTP3 {
+		switch {
+		case HTTP3Transport == nil:
+			return errors.New("--http3: not supported by this build, see cmd/getparty-h3")
+		case cmd.options.HTTP2 || cmd.options.HTTP11:
+			return errors.New("--http3 is mutually exclusive with --http2 and --http1.1")
+		case cmd.options.Proxy != "" || cmd.options.UnixSocket != "":
+			return errors.New("--http3 can't go through --proxy or --unix-socket")
+		}
+	}
+
+	if cmd.options.Proxy != "" {
+		if _, err := url.Parse(cmd.options.Proxy); err != nil {
+			return errors.WithMessage(err, "proxy")
+		}
+	}
+
+	if cmd.options.IPv4 && cmd.options.IPv6 {
+		return errors.New("--ipv4 and --ipv6 are mutually exclusive")
+	}
+
+	cmd.resolve, err = parseResolve(cmd.options.Resolve)
+	if err != nil {
+		return err
+	}
+
+	cmd.dns, err = parseDNSServers(cmd.options.DNSServers)
+	if err != nil {
+		return err
+	}
+
+	cmd.connectTo, err = parseConnectTo(cmd.options.ConnectTo)
+	if err != nil {
+		return err
+	}
+
+	if cmd.options.UnixSocket != "" && cmd.options.SafeResolve {
+		return errors.New("--unix-socket and --safe-resolve are mutually exclusive")
+	}
+
+	cmd.tlsConfig, err = cmd.buildTLSConfig()
+	if err != nil {
+		return err
+	}
+
 	if cmd.options.AuthUser != "" {
 		if cmd.options.AuthPass == "" {
 			cmd.options.AuthPass, err = cmd.readPassword()
@@ -149,203 +466,951 @@ func (cmd *Cmd) Run(args []string, version string) (err error) {
 		cmd.userInfo = url.UserPassword(cmd.options.AuthUser, cmd.options.AuthPass)
 	}
 
-	setupLogger := func(out io.Writer, prefix string, discard bool) *log.Logger {
-		if discard {
-			out = ioutil.Discard
+	token := cmd.options.BearerToken
+	if cmd.options.TokenFile != "" {
+		b, err := ioutil.ReadFile(cmd.options.TokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if cmd.userInfo != nil || token != "" {
+		cmd.auth = newAuthState(token)
+	}
+
+	if cmd.options.OutFileName == "-" {
+		cmd.options.Stdout = true
+	}
+	if cmd.options.OutputTemplate != "" {
+		if _, err := expandTemplate(cmd.options.OutputTemplate, "", "", time.Now()); err != nil {
+			return err
+		}
+	}
+	if cmd.options.OutFileName != "" && !cmd.options.Stdout && !filepath.IsAbs(cmd.options.OutFileName) {
+		cmd.options.OutFileName = filepath.Join(cmd.options.Dir, cmd.options.OutFileName)
+	}
+	if cmd.options.Stdout {
+		if cmd.options.JSONFileName != "" {
+			return errors.New("stdout: can't resume from session state")
+		}
+		// parts still go to disk, streamer picks them up from there
+		dir, err := ioutil.TempDir(".", "."+cmdName+"-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		cmd.options.OutFileName = filepath.Join(dir, "stdout")
+		cmd.stream = &streamer{w: cmd.Out}
+		// closed pipe should fail the write, not kill the process, so
+		// parts get cleaned up
+		signal.Ignore(syscall.SIGPIPE)
+		cmd.Out = cmd.Err
+	}
+
+	if cmd.options.Progress == "auto" {
+		// bars redrawn in a file, pipe or dumb terminal are escape garbage
+		cmd.options.Progress = "simple-text"
+		if hasTTYCapabilities(cmd.Out) {
+			cmd.options.Progress = "bar"
+		}
+	}
+
+	if cmd.options.Progress == "json" {
+		out := cmd.Out
+		if cmd.options.ProgressFile != "" {
+			fd, err := os.OpenFile(cmd.options.ProgressFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+			out = fd
 		}
-		return log.New(out, prefix, log.LstdFlags)
+		cmd.events = newEventLog(out)
+		cmd.options.Quiet = true
 	}
 
-	cmd.logger = setupLogger(cmd.Out, "", cmd.options.Quiet)
-	cmd.dlogger = setupLogger(cmd.Err, fmt.Sprintf("[%s] ", cmdName), !cmd.options.Debug)
+	if cmd.options.LogFile != "" {
+		cmd.logFile, err = openLogFile(cmd.options.LogFile, cmd.options.LogLevel, int64(cmd.options.LogMaxSize), int(cmd.options.LogMaxBackups))
+		if err != nil {
+			return errors.WithMessage(err, "log file")
+		}
+		defer func() {
+			if err != nil {
+				// it's printed to stderr after Run only
+				log.New(cmd.logFile, "", log.LstdFlags).Printf("error: %v", err)
+			}
+			cmd.logFile.Close()
+		}()
+	}
+	cmd.logger = setupLogger(cmd.logFile.tee(cmd.Out, cmd.options.Quiet, logInfo), "", false)
+	cmd.noBars = cmd.options.Quiet
+	if cmd.options.SummaryInterval > 0 && !isTerminal(cmd.Out) {
+		// redrawn bars are garbage in a file or pipe, summary lines aren't
+		cmd.noBars = true
+	}
+	if (cmd.options.Progress == "simple-text" || cmd.options.Progress == "none") && !cmd.noBars {
+		if cmd.options.Progress == "simple-text" {
+			cmd.text = &textProgress{w: cmd.Out, msgs: cmd.msgs}
+		}
+		// no bars, but the rest of plain output stays
+		cmd.noBars = true
+	}
+	cmd.dlogger = setupLogger(cmd.logFile.tee(cmd.Err, !cmd.options.Debug, logDebug), fmt.Sprintf("[%s] ", cmdName), false)
+	if cmd.options.Nice {
+		if err := setLowPriority(); err != nil {
+			// still nice to the network
+			cmd.dlogger.Printf("low priority: %v", err)
+		}
+	}
 
 	ctx, cancel := backgroundContext()
 	defer cancel()
+	cmd.canceler.Store(&canceler{cancel: cancel})
+	defer cmd.canceler.Store((*canceler)(nil))
+
+	if cmd.options.JSONSummary != "" {
+		cmd.summary = &summary{started: time.Now()}
+		defer func() {
+			if e := cmd.writeSummary(err); e != nil {
+				if err == nil {
+					err = errors.WithMessage(e, "json-summary")
+				} else {
+					cmd.logger.Printf("json-summary: %v", e)
+				}
+			}
+		}()
+	}
+
+	if cmd.options.Daemon {
+		return cmd.runDaemon(ctx)
+	}
+
+	saveSessions, err := cmd.setupSessionCache()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := saveSessions(); err == nil {
+			err = e
+		}
+	}()
+
+	if mirrorTest {
+		return cmd.mirrorTest(ctx, cmd.mirrorOpt)
+	}
+
+	cmd.ctl = &controller{
+		dlogger: cmd.dlogger,
+		keys:    !cmd.options.Quiet && cmd.options.InputFile == "" && isTerminal(os.Stdin),
+	}
+	if cmd.noBars {
+		// no total bar to show status
+		cmd.ctl.logger = cmd.logger
+	}
+	cmd.ctl.run(ctx)
+	defer cmd.ctl.close()
 
+	if cmd.options.InputFile != "" {
+		return cmd.runBatch(ctx, cmd.options.InputFile)
+	}
+
+	if len(args) == 1 && isTorrentSource(args[0]) && cmd.options.JSONFileName == "" {
+		if args, err = cmd.useTorrent(ctx, args[0]); err != nil {
+			return err
+		}
+	}
+
+	var mirrorList string
+	switch {
+	case cmd.options.BestMirror && cmd.torrent != nil:
+		mirrorList = strings.Join(args, "\n")
+	case cmd.options.BestMirror:
+		mirrorList, err = cmd.readMirrorList(args)
+		if err != nil {
+			return err
+		}
+	}
+	if cmd.options.Watch > 0 {
+		return cmd.watch(ctx, args, mirrorList)
+	}
+	return cmd.runHooks(cmd.runTries(ctx, args, mirrorList))
+}
+
+// runTries downloads args, retrying whole session up to MaxTries times
+func (cmd *Cmd) runTries(ctx context.Context, args []string, mirrorList string) (err error) {
+	cmd.verified, cmd.unchanged = 0, false
+	var stateName string
+	defer func() {
+		cmd.leftState = ""
+		if err != nil {
+			cmd.leftState = stateName
+		}
+	}()
+	for try := 1; ; try++ {
+		stateName, err = cmd.download(ctx, args, mirrorList, try)
+		if _, ok := errors.Cause(err).(verifyError); ok && stateName != "" && ctx.Err() == nil {
+			cmd.verified++
+			cmd.logger.Printf(cmd.msgs.T("verification failed: %v, downloading again, %d of %d"), err, cmd.verified, cmd.options.VerifyRetries)
+			cmd.options.JSONFileName = stateName
+			continue
+		}
+		if errors.Cause(err) == errNoRanges && stateName != "" && ctx.Err() == nil {
+			cmd.logger.Printf(cmd.msgs.T("%v, falling back to single part"), err)
+			// it's not failure of the try, so it doesn't count
+			try--
+			cmd.options.JSONFileName = stateName
+			continue
+		}
+		// verify retries have their own limit
+		if err == nil || ctx.Err() != nil || try-cmd.verified >= int(cmd.options.MaxTries) || !isRetryable(err) {
+			return err
+		}
+		wait := cmd.options.RetryWait
+		if e, ok := errors.Cause(err).(StatusError); ok && e.RetryAfter > wait {
+			if e.RetryAfter > cmd.options.MaxRetryAfter {
+				return err
+			}
+			wait = e.RetryAfter
+		}
+		cmd.logger.Printf(cmd.msgs.T("try %d of %d failed: %v"), try, cmd.options.MaxTries, err)
+		if stateName != "" {
+			// resume from what has been downloaded so far
+			cmd.options.JSONFileName = stateName
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ExpectedError{ctx.Err()}
+		}
+	}
+}
+
+// download does single download attempt. If attempt fails, but session
+// state has been saved, its file name is returned.
+func (cmd *Cmd) download(ctx context.Context, args []string, mirrorList string, try int) (stateName string, err error) {
 	var userUrl string
+	var mirrors []mirror
 	var lastSession *Session
 
-	switch {
-	case cmd.options.JSONFileName != "":
+	trace := cmd.tracer.start("download")
+	trace.set("try", try)
+	defer func() {
+		trace.end(err)
+		// ctx may be done already, spans of failure are wanted the most
+		if err := cmd.tracer.flush(context.Background()); err != nil {
+			cmd.dlogger.Printf("traces: %v", err)
+		}
+	}()
+
+	if cmd.options.JSONFileName != "" {
 		lastSession = new(Session)
 		if err := lastSession.loadState(cmd.options.JSONFileName); err != nil {
-			return err
+			return "", err
 		}
 		userUrl = lastSession.Location
 		cmd.options.HeaderMap = lastSession.HeaderMap
+		if cmd.options.HeaderMap == nil {
+			cmd.options.HeaderMap = make(map[string]string)
+		}
 		cmd.options.OutFileName = lastSession.SuggestedFileName
+		cmd.options.SplitPieces = uint(lastSession.SplitPieces)
+	}
+
+	switch {
 	case cmd.options.BestMirror:
-		var input io.Reader
-		var rr []io.Reader
-		for _, fn := range args {
-			if fd, err := os.Open(fn); err == nil {
-				rr = append(rr, fd)
-			}
+		max := 1
+		if cmd.options.MultiSource {
+			max = 0 // all responding mirrors
 		}
-		if len(rr) > 0 {
-			input = io.MultiReader(rr...)
+		if cmd.options.BenchSize > 0 {
+			if cmd.options.MultiSource {
+				max = int(cmd.options.BenchTop)
+			}
+			mirrors, err = cmd.benchMirrors(ctx, strings.NewReader(mirrorList), int64(cmd.options.BenchSize), max)
 		} else {
-			input = os.Stdin
+			mirrors, err = cmd.bestMirror(ctx, strings.NewReader(mirrorList), max)
 		}
-		userUrl, err = cmd.bestMirror(ctx, input)
-		cmd.closeReaders(rr)
 		if err != nil {
-			return err
+			return "", err
 		}
-	default:
-		userUrl = args[0]
+		userUrl = mirrors[0][0]
+	case len(args) != 0 && (lastSession == nil || try > 1):
+		// rotate user provided urls on every try
+		userUrl = args[(try-1)%len(args)]
 	}
 
+	cmd.auth.allowToken(userUrl)
+	cmd.userUrl = userUrl
+
 	if _, ok := cmd.options.HeaderMap[hUserAgentKey]; !ok {
 		cmd.options.HeaderMap[hUserAgentKey] = userAgents[cmd.options.UserAgent]
 	}
 
-	// All users of cookiejar should import "golang.org/x/net/publicsuffix"
-	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	jar, err := newCookieJar()
 	if err != nil {
-		return err
+		return "", err
+	}
+	if cmd.options.LoadCookies != "" {
+		if err := jar.load(cmd.options.LoadCookies); err != nil {
+			return "", err
+		}
+	}
+	if cmd.options.SaveCookies != "" {
+		defer func() {
+			if e := jar.save(cmd.options.SaveCookies); err == nil {
+				err = e
+			}
+		}()
 	}
 
-	session, err := cmd.follow(ctx, jar, userUrl)
+	var session *Session
+	defer func() {
+		cmd.summary.record(userUrl, session)
+	}()
+	defer func() {
+		if cmd.events == nil || session == nil {
+			return
+		}
+		e := event{
+			Event:   "summary",
+			File:    session.SuggestedFileName,
+			Total:   session.ContentLength,
+			Written: session.totalWritten(),
+			Retries: atomic.LoadUint32(&globTry),
+		}
+		if err != nil {
+			e.Status = errorStatus(err)
+			e.Error = err.Error()
+		}
+		cmd.events.emit(e)
+	}()
+	trace.set("url", userUrl)
+	followSpan := trace.child("follow")
+	if cmd.options.SplitPieces != 0 {
+		session, err = cmd.followPieces(ctx, jar, userUrl, int(cmd.options.SplitPieces))
+	} else {
+		session, err = cmd.follow(ctx, jar, userUrl)
+	}
+	if session != nil {
+		followSpan.set("http.url", session.Location)
+		followSpan.set("http.status_code", session.StatusCode)
+		followSpan.set("redirects", len(session.Hops))
+	}
+	followSpan.end(err)
 	if err != nil {
 		if ctx.Err() == context.Canceled {
 			// most probably user hit ^C, so mark as expected
-			return ExpectedError{ctx.Err()}
+			return "", ExpectedError{ctx.Err()}
+		}
+		if errors.Cause(err) == errNotModified {
+			cmd.unchanged = true
+			return "", nil
+		}
+		// no session, so no summary
+		cmd.events.emit(event{Event: "error", Status: errorStatus(err), Error: err.Error()})
+		return "", err
+	}
+	if err := cmd.checkGuards(session); err != nil {
+		cmd.events.emit(event{Event: "error", Error: err.Error()})
+		return "", err
+	}
+	if cmd.options.Timestamping && lastSession == nil && !session.remoteNewer() {
+		// server ignored If-Modified-Since, or it was sent for other name
+		cmd.logger.Printf(cmd.msgs.T("%q is up to date, skipping"), session.SuggestedFileName)
+		cmd.unchanged = true
+		return "", nil
+	}
+
+	if lastSession == nil && cmd.options.Parts > 0 && cmd.stream == nil {
+		if found, foundName := cmd.findSession(session); found != nil {
+			resume := cmd.options.AutoContinue
+			if !resume {
+				switch cmd.clobberPolicy() {
+				case clobberKeep:
+					cmd.logger.Printf(cmd.msgs.T("%q already exists, skipping"), foundName)
+					cmd.unchanged = true
+					return "", nil
+				case clobberRename:
+					// found session stays, as is, new one gets other name
+					found, resume = nil, false
+				case clobberAsk:
+					if resume, err = cmd.ask("Found unfinished session %q, resume? [y/n] ", foundName); err != nil {
+						return "", err
+					}
+				case clobberFail:
+					return "", errClobber(foundName)
+				}
+			}
+			if resume {
+				lastSession = found
+				// so it's removed, once done
+				cmd.options.JSONFileName = foundName
+			} else if found != nil {
+				// new parts would be appended to stale ones
+				if err := found.removeFiles(); err != nil {
+					return "", err
+				}
+				if err := os.Remove(foundName); err != nil {
+					return "", err
+				}
+			}
 		}
-		return err
 	}
 
 	if lastSession != nil {
-		if lastSession.ContentMD5 != session.ContentMD5 {
-			return errors.Errorf(
-				"ContentMD5 mismatch: remote %q expected %q",
-				session.ContentMD5, lastSession.ContentMD5,
-			)
-		}
-		if lastSession.ContentLength != session.ContentLength {
-			return errors.Errorf(
-				"ContentLength mismatch: remote %d expected %d",
-				session.ContentLength, lastSession.ContentLength,
-			)
+		if changed := session.changedFrom(lastSession); changed != "" {
+			if !cmd.options.AllowRestart {
+				return "", ExpectedError{errors.Errorf("%v: %s, see --allow-restart", errRemoteChanged, changed)}
+			}
+			cmd.logger.Printf(cmd.msgs.T("Remote file has changed: %s, starting over"), changed)
+			if err := lastSession.removeFiles(); err != nil {
+				return "", err
+			}
+			lastSession = nil
 		}
+	}
+
+	if lastSession != nil {
 		lastSession.Location = session.Location
+		lastSession.Hops = session.Hops
 		session = lastSession
+		// replay cookies of the original session, fresh ones may differ
+		if u, err := url.Parse(session.Location); err == nil {
+			jar.SetCookies(u, parseCookieHeader(session.Header.Get(hCookie)))
+		}
+		if err := cmd.checkParts(session); err != nil {
+			return "", err
+		}
+		if cmd.options.VerifyTail > 0 {
+			if err := cmd.verifyTails(ctx, jar, session, int64(cmd.options.VerifyTail)); err != nil {
+				return "", err
+			}
+		}
+		if err := cmd.coalesceParts(session); err != nil {
+			return "", err
+		}
 	} else if cmd.options.Parts > 0 {
+		if size := int64(cmd.options.PartSize); size > 0 && session.ContentLength > 0 {
+			cmd.options.Parts = uint((session.ContentLength + size - 1) / size)
+		}
+		if cmd.options.Parts > 1 && session.ContentLength > 0 && session.ContentEncoding == "" && session.SplitPieces == 0 {
+			if cmd.probeRanges(ctx, jar, session) {
+				session.AcceptRanges = acceptRangesType
+			} else {
+				session.AcceptRanges = ""
+			}
+		}
 		if !session.isAcceptRanges() {
 			cmd.options.Parts = 1
 		}
+		if max := maxParts(session.ContentLength, int64(cmd.options.MinPartSize)); int64(cmd.options.Parts) > max && cmd.options.PartSize == 0 {
+			cmd.logger.Printf(cmd.msgs.T("%d parts are too many for %.1f, using %d, see --min-part-size"), cmd.options.Parts, decor.SizeB1024(session.ContentLength), max)
+			cmd.options.Parts = uint(max)
+		}
 		session.HeaderMap = cmd.options.HeaderMap
-		session.Parts = session.calcParts(int64(cmd.options.Parts))
-		if _, err := os.Stat(session.SuggestedFileName); err == nil {
-			var answer string
-			fmt.Fprintf(cmd.Out, "File %q already exists, overwrite? [y/n] ", session.SuggestedFileName)
-			if _, err := fmt.Scanf("%s", &answer); err != nil {
-				return err
+		if cmd.torrent != nil {
+			if err := cmd.torrent.apply(session); err != nil {
+				return "", err
+			}
+		}
+		if dir := filepath.Dir(session.SuggestedFileName); dir != "." {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return "", err
+			}
+		}
+		var appended bool
+		if cmd.options.Append {
+			if appended, err = cmd.appendExisting(session); err != nil {
+				return "", err
+			}
+		}
+		if cmd.options.Zsync {
+			if appended, err = cmd.zsyncExisting(ctx, jar, session, int(cmd.options.Parts)); err != nil {
+				return "", err
 			}
-			switch strings.ToLower(answer) {
-			case "y", "yes":
+		}
+		if cmd.torrent != nil && !appended {
+			if appended, err = cmd.torrentExisting(session, int(cmd.options.Parts)); err != nil {
+				return "", err
+			}
+		}
+		if session.SplitPieces == 0 && !appended {
+			if cmd.options.PartSize > 0 && cmd.options.Parts > 1 {
+				session.Parts = session.calcChunks(int64(cmd.options.PartSize))
+			} else {
+				session.Parts = session.calcParts(int64(cmd.options.Parts))
+			}
+		}
+		if err := cmd.coalesceParts(session); err != nil {
+			return "", err
+		}
+		if len(mirrors) == 0 && cmd.torrent != nil && len(args) > 1 {
+			// rest of web seeds are fallbacks of every part
+			m := mirror{userUrl}
+			for _, seed := range args {
+				if seed != userUrl {
+					m = append(m, seed)
+				}
+			}
+			mirrors = []mirror{m}
+		}
+		if len(mirrors) != 0 && session.SplitPieces == 0 {
+			if len(mirrors) > 1 && cmd.options.CrossCheck != 0 {
+				mirrors = cmd.crossCheck(ctx, jar, mirrors, session.ContentLength, int64(cmd.options.CrossCheck))
+			}
+			session.spreadMirrors(mirrors)
+		}
+		if _, err := os.Stat(session.SuggestedFileName); err == nil && cmd.options.Timestamping && !appended {
+			// remote is newer, so local file is outdated anyway
+			if err := rotateFiles(session.SuggestedFileName, int(cmd.options.KeepVersions)); err != nil {
+				return "", err
+			}
+			if err := session.removeFiles(); err != nil {
+				return "", err
+			}
+		} else if existing := session.existingFiles(); len(existing) != 0 && !appended {
+			switch cmd.clobberPolicy() {
+			case clobberKeep:
+				cmd.logger.Printf(cmd.msgs.T("%q already exists, skipping"), existing[0])
+				cmd.unchanged = true
+				return "", nil
+			case clobberRename:
+				session.autoRename()
+				cmd.logger.Printf(cmd.msgs.T("%q already exists, saving to %q"), existing[0], session.SuggestedFileName)
+			case clobberAsk:
+				overwrite, err := cmd.ask("File %q already exists, overwrite? [y/n] ", existing[0])
+				if err != nil {
+					return "", err
+				}
+				if !overwrite {
+					cmd.unchanged = true
+					return "", nil
+				}
+				fallthrough
+			case clobberForce:
 				if err := session.removeFiles(); err != nil {
-					return err
+					return "", err
 				}
-			default:
-				return nil
+				if stateName := findStateFile(session.SuggestedFileName); stateName != "" {
+					if err := os.Remove(stateName); err != nil {
+						return "", err
+					}
+				}
+			case clobberFail:
+				return "", errClobber(existing[0])
 			}
 		}
 	}
 
+	if !cmd.options.NoSpaceCheck {
+		if err := cmd.checkSpace(session); err != nil {
+			return "", err
+		}
+	}
+	if err := cmd.checkOpenFiles(session); err != nil {
+		return "", err
+	}
+
 	if !cmd.options.Quiet {
-		session.writeSummary(cmd.Out)
+		session.writeSummary(cmd.Out, cmd.msgs, cmd.options.CostPerGB)
+	}
+	progressOut := cmd.Out
+	if cmd.noBars {
+		progressOut = ioutil.Discard
 	}
 	progress := mpb.NewWithContext(ctx,
-		mpb.ContainerOptOn(mpb.WithOutput(cmd.Out), func() bool { return !cmd.options.Quiet }),
+		mpb.WithOutput(progressOut),
 		mpb.ContainerOptOn(mpb.WithDebugOutput(cmd.Err), func() bool { return cmd.options.Debug }),
-		mpb.ContainerOptOn(mpb.WithManualRefresh(make(chan time.Time)), func() bool { return cmd.options.Quiet }),
+		mpb.ContainerOptOn(mpb.WithManualRefresh(make(chan time.Time)), func() bool { return cmd.noBars }),
 		mpb.WithRefreshRate(refreshRate*time.Millisecond),
 		mpb.WithWidth(60),
 	)
 
 	var eg errgroup.Group
-	transport := cleanhttp.DefaultPooledTransport()
-	transport.TLSHandshakeTimeout = time.Duration(cmd.options.Timeout) * time.Second
-	if cmd.options.InsecureSkipVerify {
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	}
-	for i, p := range session.Parts {
-		if p.isDone() {
-			continue
-		}
-		p.order = i
+	transport := cmd.newRoundTripper(true)
+	limiter := newRateLimiter(cmd.options.LimitRate)
+	gate := new(pauseGate)
+	pieces := session.newPieceVerifier()
+	var dropBars bool
+	prepare := func(p *Part) *http.Request {
 		p.maxTry = int(cmd.options.MaxRetry)
-		p.quiet = cmd.options.Quiet
+		p.maxShortReads = int(cmd.options.MaxShortReads)
+		p.quiet = cmd.noBars
 		p.jar = jar
 		p.transport = transport
-		p.name = fmt.Sprintf("P%02d", i+1)
-		p.dlogger = setupLogger(cmd.Err, fmt.Sprintf("[%s] ", p.name), !cmd.options.Debug)
-		req, err := http.NewRequest(http.MethodGet, session.Location, nil)
+		p.limiter = limiter
+		p.hosts = cmd.hosts
+		p.maxRetryAfter = cmd.options.MaxRetryAfter
+		p.gate = gate
+		p.reserve = cmd.options.ReserveSpace
+		p.events = cmd.events
+		p.trace = trace
+		p.strictLength = cmd.options.VerifyLength == verifyStrict
+		p.bufSize = cmd.bufSize()
+		p.dropBar = dropBars
+		p.encoding = session.ContentEncoding
+		if session.SplitPieces == 0 {
+			p.totalLength = session.ContentLength
+		}
+		if p.pieces = pieces; pieces != nil {
+			p.initChecked(pieces.length, session.ContentLength)
+		}
+		p.dlogger = setupLogger(cmd.logFile.tee(cmd.Err, !cmd.options.Debug, logDebug), fmt.Sprintf("[%s] ", p.name), false)
+		location := session.Location
+		if p.Location != "" {
+			location = p.Location
+		}
+		req, err := http.NewRequest(http.MethodGet, location, nil)
 		if err != nil {
 			cmd.logger.Fatalf("%s: %v", p.name, err)
 		}
 		req.URL.User = cmd.userInfo
-		cmd.applyHeaders(req)
-		p := p // https://golang.org/doc/faq#closures_and_goroutines
+		if session.Header != nil {
+			req.Header = session.partHeader()
+		} else {
+			cmd.applyHeaders(req)
+		}
+		if p.Location == "" {
+			// validators are of session's location, mirrors have their own
+			if v := session.ifRange(); v != "" {
+				req.Header.Set(hIfRange, v)
+			}
+		}
+		return req
+	}
+	stealer := &workStealer{
+		session:   session,
+		minSize:   int64(cmd.options.MinSplitSize),
+		headFirst: cmd.options.Streamable,
+	}
+	tracker := newTotalTracker(stealer)
+	var pauseState string
+	control := &downloadControl{
+		gate:    gate,
+		limiter: limiter,
+		speed: func() float64 {
+			return tracker.stats().speed
+		},
+		saveState: func() (string, error) {
+			if cmd.stream != nil {
+				return "", errors.New("stdout can't be resumed")
+			}
+			stealer.mu.Lock()
+			defer stealer.mu.Unlock()
+			for _, p := range session.Parts {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+			}
+			s := *session
+			// preserve user provided url
+			s.Location = userUrl
+			pauseState = session.SuggestedFileName + "." + cmd.options.StateFormat
+			return pauseState, s.saveState(pauseState)
+		},
+	}
+	var totalBar *mpb.Bar
+	if !cmd.noBars && cmd.options.TotalBar != "off" && session.ContentLength > 0 {
+		totalBar = tracker.makeBar(progress, cmd.options.TotalBar == "top", control.status)
+	}
+	var summaryOut io.Writer
+	if cmd.options.SummaryInterval > 0 && cmd.noBars && cmd.events == nil {
+		summaryOut = cmd.Out
+	}
+	// parts are canceled, once one of them finds out server ignores ranges
+	partCtx, cancelParts := context.WithCancel(ctx)
+	defer cancelParts()
+	var noRanges int32
+	var streamDone chan struct{}
+	streamErr := make(chan error, 1)
+	if cmd.stream != nil {
+		streamDone = make(chan struct{})
+		go func() {
+			err := cmd.stream.run(stealer, streamDone, refreshRate*time.Millisecond)
+			if err != nil {
+				// nowhere to write, so no point to download
+				cancelParts()
+			}
+			streamErr <- err
+		}()
+	}
+	// parts over --max-connections wait here for a free connection
+	var queued []*Part
+	var queueMu sync.Mutex
+	dequeue := func() *Part {
+		queueMu.Lock()
+		defer queueMu.Unlock()
+		if len(queued) == 0 {
+			return nil
+		}
+		p := queued[0]
+		queued = queued[1:]
+		return p
+	}
+	start := func(p *Part, req *http.Request) {
 		eg.Go(func() error {
-			return p.download(ctx, progress, req, cmd.options.Timeout)
+			err := p.download(partCtx, progress, req, cmd.options.Timeout)
+			for err == nil {
+				if p = dequeue(); p == nil {
+					// stealing is for the tail, once all parts are started
+					if p = stealer.steal(); p == nil {
+						break
+					}
+				}
+				err = p.download(partCtx, progress, prepare(p), cmd.options.Timeout)
+			}
+			if errors.Cause(err) == errNoRanges {
+				// error of canceled part may be the one returned by eg.Wait
+				atomic.StoreInt32(&noRanges, 1)
+				cancelParts()
+			}
+			return err
 		})
 	}
+	control.addPart = func() bool {
+		if p := dequeue(); p != nil {
+			// waiting part is the one to add, rather than a split
+			start(p, prepare(p))
+			return true
+		}
+		minSize := stealer.minSize
+		if minSize <= 0 {
+			minSize = int64(defaultSplitSize)
+		}
+		p := stealer.split(minSize)
+		if p == nil {
+			return false
+		}
+		// victim is still running, so eg.Wait can't have returned yet
+		start(p, prepare(p))
+		return true
+	}
+	var pending []*Part
+	stealer.mu.Lock()
+	for i, p := range session.Parts {
+		if p.isDone() {
+			continue
+		}
+		p.order = i
+		p.name = fmt.Sprintf("P%02d", i+1)
+		if cmd.options.PartOrder != "" {
+			p.responded = make(chan struct{})
+		}
+		pending = append(pending, p)
+	}
+	stealer.mu.Unlock()
+	pending = orderParts(pending, cmd.options.PartOrder)
+	if max := cmd.maxConnections(); max > 0 && len(pending) > max {
+		pending, queued = pending[:max], pending[max:]
+		// bars of parts come and go, total bar is the one to watch
+		dropBars = true
+	}
+	for _, p := range pending {
+		if p.responded == nil {
+			start(p, prepare(p))
+		}
+	}
+	cmd.ctl.attach(control)
+	trackCtx, stopTrack := context.WithCancel(ctx)
+	go cmd.events.track(trackCtx, stealer, time.Second)
+	textDone := make(chan struct{})
+	go func() {
+		cmd.text.track(trackCtx, stealer, time.Second)
+		close(textDone)
+	}()
+	totalDone := make(chan struct{})
+	go func() {
+		tracker.run(trackCtx, totalBar, summaryOut, cmd.options.SummaryInterval, cmd.msgs)
+		close(totalDone)
+	}()
+	for _, p := range pending {
+		if p.responded == nil {
+			// started already
+			continue
+		}
+		cmd.dlogger.Printf("starting %s", p.name)
+		start(p, prepare(p))
+		select {
+		case <-p.responded:
+		case <-partCtx.Done():
+		}
+	}
 
 	err = eg.Wait()
+	cmd.ctl.attach(nil)
+	stopTrack()
+	<-textDone
+	<-totalDone
+	if totalBar != nil {
+		if err == nil {
+			totalBar.SetTotal(session.ContentLength, true)
+		} else {
+			totalBar.Abort(false)
+		}
+	}
+	if streamDone != nil {
+		close(streamDone)
+		if e := <-streamErr; e != nil {
+			err = e
+		}
+	}
 	session.actualPartsOnly()
 
 	if err != nil && ctx.Err() == context.Canceled {
 		// most probably user hit ^C, so mark as expected
 		err = ExpectedError{ctx.Err()}
+	} else if atomic.LoadInt32(&noRanges) != 0 {
+		err = errors.WithStack(errNoRanges)
+		if cmd.stream == nil {
+			// state of single part is resumed by runTries
+			if e := session.singlePart(); e != nil {
+				err = e
+			}
+		}
 	} else if cmd.options.Parts > 0 {
 		if written := session.totalWritten(); written == session.ContentLength || session.ContentLength <= 0 {
-			err = session.concatenateParts(cmd.dlogger, progress)
+			if cmd.stream != nil {
+				return "", cmd.finishStream(session, progress, written)
+			}
+			err = session.concatenateParts(cmd.dlogger, progress, int(cmd.bufSize()))
 			progress.Wait()
 			if err != nil {
-				return err
+				return "", err
+			}
+			if err := cmd.checkFinalLength(session, written); err != nil {
+				return "", err
+			}
+			verifyErr := session.checkSHA1()
+			if verifyErr == nil {
+				verifyErr = session.checkPieces()
+			}
+			if verifyErr != nil {
+				if cmd.verified >= int(cmd.options.VerifyRetries) {
+					// keep the file as is, for user to decide, state of
+					// concatenated parts is of no use
+					if cmd.options.JSONFileName != "" {
+						if err := os.Remove(cmd.options.JSONFileName); err != nil {
+							return "", err
+						}
+					}
+					return "", verifyError{verifyErr}
+				}
+				stateName, err := cmd.prepareVerifyRetry(session, userUrl)
+				if err != nil {
+					return "", err
+				}
+				for _, name := range []string{pauseState, cmd.options.JSONFileName} {
+					if name != "" && name != stateName {
+						if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+							return "", err
+						}
+					}
+				}
+				return stateName, verifyError{verifyErr}
+			}
+			if cmd.options.Timestamping {
+				if err := session.setModTime(); err != nil {
+					return "", err
+				}
+			}
+			if cmd.events == nil {
+				fmt.Fprintln(cmd.Out)
+			}
+			cmd.logger.Printf(cmd.msgs.T("%q saved [%d/%d]"), session.SuggestedFileName, session.ContentLength, written)
+			cmd.watchETag = session.ETag
+			if active, waited := session.timeStats(); active > 0 {
+				speed := decor.SizeB1024(int64(float64(written) / active.Seconds()))
+				cmd.logger.Printf(cmd.msgs.T("active: %s, waited: %s, avg speed: %.1f/s"), active.Round(time.Millisecond), waited.Round(time.Millisecond), speed)
+			}
+			if cmd.options.CostPerGB > 0 {
+				// data of previous sessions has been paid for by them
+				transferred := written - tracker.initial
+				cmd.logger.Printf(cmd.msgs.T("transferred: %.1f, estimated cost: %.2f"), decor.SizeB1024(transferred), transferCost(transferred, cmd.options.CostPerGB))
+			}
+			if cmd.options.SignatureURL != "" || cmd.options.SignatureFile != "" {
+				if err := cmd.checkSignature(ctx, jar, session.SuggestedFileName, userUrl); err != nil {
+					// keep the file as is, for user to decide
+					if cmd.options.JSONFileName != "" {
+						if err := os.Remove(cmd.options.JSONFileName); err != nil {
+							return "", err
+						}
+					}
+					return "", err
+				}
+			}
+			if pauseState != "" && pauseState != cmd.options.JSONFileName {
+				if err := os.Remove(pauseState); err != nil {
+					return "", err
+				}
 			}
-			fmt.Fprintln(cmd.Out)
-			cmd.logger.Printf("%q saved [%d/%d]", session.SuggestedFileName, session.ContentLength, written)
 			if cmd.options.JSONFileName != "" {
-				return os.Remove(cmd.options.JSONFileName)
+				return "", os.Remove(cmd.options.JSONFileName)
 			}
-			return nil
+			return "", nil
 		}
 	}
 
 	progress.Wait()
 
+	if ctx.Err() != nil && cmd.discardOnCancel() {
+		// embedder doesn't want to resume, so leave nothing behind
+		if e := session.removeFiles(); e != nil {
+			cmd.dlogger.Printf("remove parts: %v", e)
+		}
+		for _, name := range []string{pauseState, cmd.options.JSONFileName} {
+			if name == "" {
+				continue
+			}
+			if e := os.Remove(name); e != nil && !os.IsNotExist(e) {
+				cmd.dlogger.Printf("remove state: %v", e)
+			}
+		}
+		return "", err
+	}
+
 	// preserve user provided url
 	session.Location = userUrl
-	stateName := session.SuggestedFileName + ".json"
+	stateName = session.SuggestedFileName + "." + cmd.options.StateFormat
 	if e := session.saveState(stateName); e == nil {
+		if cmd.events == nil {
+			fmt.Fprintln(cmd.Out)
+		}
+		cmd.logger.Printf(cmd.msgs.T("session state saved to %q"), stateName)
+	} else {
+		stateName = ""
+		if err == nil {
+			err = e
+		}
+	}
+	return stateName, err
+}
+
+// finishStream cleans up parts, which content has already been written
+// to stdout.
+func (cmd Cmd) finishStream(session *Session, progress *mpb.Progress, written int64) error {
+	progress.Wait()
+	if err := session.removeFiles(); err != nil {
+		return err
+	}
+	if cmd.stream.total != written {
+		return errors.Errorf("stream: %d bytes written to stdout, downloaded %d", cmd.stream.total, written)
+	}
+	if cmd.events == nil {
 		fmt.Fprintln(cmd.Out)
-		cmd.logger.Printf("session state saved to %q", stateName)
-	} else if err == nil {
-		err = e
 	}
-	return err
+	cmd.logger.Printf(cmd.msgs.T("%d bytes written to stdout"), written)
+	return nil
 }
 
 func (cmd Cmd) follow(ctx context.Context, jar http.CookieJar, userUrl string) (session *Session, err error) {
 	var redirected bool
+	var referer string
+	var hops []Hop
 	if hc, ok := cmd.options.HeaderMap[hCookie]; ok {
-		var cookies []*http.Cookie
-		for _, cookie := range strings.Split(hc, "; ") {
-			pair := strings.SplitN(cookie, "=", 2)
-			if len(pair) != 2 {
-				continue
-			}
-			cookies = append(cookies, &http.Cookie{Name: pair[0], Value: pair[1]})
-		}
 		if u, err := url.Parse(userUrl); err == nil {
-			jar.SetCookies(u, cookies)
+			jar.SetCookies(u, parseCookieHeader(hc))
 		}
 	}
-	client := cleanhttp.DefaultClient()
-	client.Jar = jar
+	client := cmd.newProbeClient(jar)
 	client.CheckRedirect = func(*http.Request, []*http.Request) error {
 		return http.ErrUseLastResponse
 	}
@@ -370,13 +1435,55 @@ func (cmd Cmd) follow(ctx context.Context, jar http.CookieJar, userUrl string) (
 		}
 		req.URL.User = cmd.userInfo
 		cmd.applyHeaders(req)
+		if cmd.options.Compressed {
+			req.Header.Set(hAcceptEncoding, acceptEncodings)
+		}
+		if referer != "" && req.Header.Get(hReferer) == "" {
+			req.Header.Set(hReferer, referer)
+		}
+		// as far as hops followed so far tell, final one may name it otherwise
+		localName, err := cmd.savedName(userUrl, hops)
+		if err != nil {
+			return nil, err
+		}
+		if cmd.options.Timestamping {
+			setIfModifiedSince(req, localName)
+		}
+		if cmd.watchETag != "" && cmd.options.Watch > 0 {
+			req.Header.Set(hIfNoneMatch, cmd.watchETag)
+		}
 
-		resp, err := client.Do(req.WithContext(ctx))
+		// bound the whole hop, so slow trickling server can't hang the probe
+		hopCtx, cancel := context.WithTimeout(ctx, 2*time.Duration(cmd.options.Timeout)*time.Second)
+		defer cancel()
+		start := time.Now()
+		resp, err := client.Do(req.WithContext(hopCtx))
 		if err != nil {
 			return nil, err
 		}
+		// credentials stay out of state and events
+		hopUrl := *req.URL
+		hopUrl.User = nil
+		hop := Hop{
+			URL:        hopUrl.String(),
+			Status:     resp.StatusCode,
+			SetCookies: resp.Header.Values("Set-Cookie"),
+			FileName:   parseContentDisposition(resp.Header.Get(hContentDisposition)),
+			Elapsed:    time.Since(start),
+		}
+		hops = append(hops, hop)
+		cmd.events.emit(event{
+			Event:   "hop",
+			URL:     hop.URL,
+			Status:  hop.Status,
+			Cookies: hop.SetCookies,
+			Elapsed: hop.Elapsed.Seconds(),
+		})
 		cmd.logger.Printf("HTTP response: %s", resp.Status)
 		cmd.dlogger.Printf("HTTP response: %s", resp.Status)
+		if resp.TLS != nil {
+			cmd.dlogger.Printf("TLS resumed: %t", resp.TLS.DidResume)
+		}
 		if cookies := jar.Cookies(req.URL); len(cookies) != 0 {
 			cmd.dlogger.Println("CookieJar:")
 			for _, cookie := range cookies {
@@ -384,40 +1491,60 @@ func (cmd Cmd) follow(ctx context.Context, jar http.CookieJar, userUrl string) (
 			}
 		}
 
+		if resp.StatusCode == http.StatusNotModified {
+			cmd.logger.Printf(cmd.msgs.T("%q is up to date, skipping"), localName)
+			resp.Body.Close()
+			return nil, errNotModified
+		}
+
 		if isRedirect(resp.StatusCode) {
 			redirected = true
 			loc, err := resp.Location()
 			if err != nil {
 				return nil, err
 			}
+			referer = refererFor(req.URL, loc)
 			userUrl = loc.String()
-			// don't bother closing resp.Body here,
-			// it will be closed by underlying RoundTripper
+			resp.Body.Close()
 			continue
 		}
 
 		if resp.StatusCode != http.StatusOK {
-			return nil, errors.Errorf("unexpected status: %s", resp.Status)
+			resp.Body.Close()
+			return nil, errors.WithStack(newStatusError(resp))
 		}
 
-		if name := cmd.options.OutFileName; name == "" {
-			name = parseContentDisposition(resp.Header.Get(hContentDisposition))
-			if name == "" {
-				if nURL, err := url.Parse(userUrl); err == nil {
-					nURL.RawQuery = ""
-					name, err = url.QueryUnescape(nURL.String())
-					if err != nil {
-						name = nURL.String()
-					}
-				} else {
-					name = userUrl
-				}
-				name = filepath.Base(name)
+		if cmd.options.OutFileName == "" {
+			if cmd.options.OutFileName, err = cmd.savedName(userUrl, hops); err != nil {
+				resp.Body.Close()
+				return nil, err
 			}
-			cmd.options.OutFileName = name
 		}
 
+		header := req.Header.Clone()
+		header.Del(hIfModifiedSince)
+		if cookies := jar.Cookies(req.URL); len(cookies) != 0 {
+			header.Set(hCookie, cookieHeader(cookies))
+		}
+		encoding := resp.Header.Get(hContentEncoding)
+		if cmd.options.Compressed {
+			switch {
+			case isDecodable(encoding):
+				cmd.dlogger.Printf("%s: %s", hContentEncoding, encoding)
+			case encoding == "" || strings.EqualFold(encoding, "identity"):
+				// not encoded, so parts are ranges of it as usual
+				encoding = ""
+				header.Del(hAcceptEncoding)
+			default:
+				resp.Body.Close()
+				return nil, errors.Errorf("unsupported %s %q", hContentEncoding, encoding)
+			}
+		} else {
+			// as is, encoded length is the length of what's saved
+			encoding = ""
+		}
 		session = &Session{
+			Header:            header,
 			Location:          userUrl,
 			SuggestedFileName: cmd.options.OutFileName,
 			AcceptRanges:      resp.Header.Get("Accept-Ranges"),
@@ -425,81 +1552,96 @@ func (cmd Cmd) follow(ctx context.Context, jar http.CookieJar, userUrl string) (
 			StatusCode:        resp.StatusCode,
 			ContentLength:     resp.ContentLength,
 			ContentMD5:        resp.Header.Get("Content-MD5"),
+			LastModified:      resp.Header.Get(hLastModified),
+			ETag:              resp.Header.Get(hETag),
+			ContentEncoding:   encoding,
+			Hops:              hops,
+		}
+		if encoding != "" {
+			// decoded length is unknown and ranges of encoded content
+			// can't be decoded separately
+			session.ContentLength = -1
+			session.AcceptRanges = ""
 		}
 		return session, resp.Body.Close()
 	}
 	return
 }
 
-func (cmd Cmd) applyHeaders(req *http.Request) {
-	for k, v := range cmd.options.HeaderMap {
-		if k == hCookie {
-			continue
+// urlFileName returns file name from the path of userUrl
+func urlFileName(userUrl string) string {
+	name := userUrl
+	if nURL, err := url.Parse(userUrl); err == nil {
+		nURL.RawQuery = ""
+		name, err = url.QueryUnescape(nURL.String())
+		if err != nil {
+			name = nURL.String()
 		}
-		req.Header.Set(k, v)
 	}
+	return filepath.Base(name)
 }
 
-func (cmd Cmd) bestMirror(ctx context.Context, input io.Reader) (best string, err error) {
-	defer func() {
-		// just add method name, without stack trace at the point
-		err = errors.WithMessage(err, "bestMirror")
-	}()
-	urls, err := readLines(input)
-	if err != nil {
-		return
+// refererFor returns Referer of request to next, redirected from last, as
+// browsers send it: without credentials and never from https to http
+func refererFor(last, next *url.URL) string {
+	if last.Scheme == "https" && next.Scheme == "http" {
+		return ""
 	}
+	u := *last
+	u.User, u.Fragment = nil, ""
+	return u.String()
+}
 
-	var readyWg sync.WaitGroup
-	start := make(chan struct{})
-	first := make(chan string, 1)
-	client := cleanhttp.DefaultClient()
-	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
-	defer cancel()
+func parseCookieHeader(hc string) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, cookie := range strings.Split(hc, "; ") {
+		pair := strings.SplitN(cookie, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		// site wide, so cookies of the same name set by server are replaced
+		cookies = append(cookies, &http.Cookie{Name: pair[0], Value: pair[1], Path: "/"})
+	}
+	return cookies
+}
 
-	for _, u := range urls {
-		req, err := http.NewRequest(http.MethodGet, u, nil)
-		if err != nil {
-			cmd.dlogger.Printf("skipping %q: %v", u, err)
+func cookieHeader(cookies []*http.Cookie) string {
+	pairs := make([]string, len(cookies))
+	for i, c := range cookies {
+		pairs[i] = c.Name + "=" + c.Value
+	}
+	return strings.Join(pairs, "; ")
+}
+
+func (cmd Cmd) applyHeaders(req *http.Request) {
+	for k, v := range cmd.options.HeaderMap {
+		if k == hCookie {
 			continue
 		}
-		readyWg.Add(1)
-		req.URL.User = cmd.userInfo
-		u := u // https://golang.org/doc/faq#closures_and_goroutines
-		subscribe(&readyWg, start, func() {
-			cmd.dlogger.Printf("fetching: %q", u)
-			resp, err := client.Do(req.WithContext(ctx))
-			if err != nil {
-				cmd.dlogger.Printf("fetch error: %v", err)
-			}
-			if resp == nil || resp.Body == nil {
-				return
-			}
-			defer resp.Body.Close()
+		req.Header.Set(k, v)
+	}
+}
 
-			if resp.StatusCode != http.StatusOK {
-				cmd.dlogger.Printf("fetch %q unexpected status: %s", u, resp.Status)
-				return
-			}
-			select {
-			case first <- u:
-			default:
-				// first has already been found
-			}
-		})
+func (cmd Cmd) readMirrorList(args []string) (string, error) {
+	var input io.Reader
+	var rr []io.Reader
+	for _, fn := range args {
+		if fd, err := os.Open(fn); err == nil {
+			rr = append(rr, fd)
+		}
 	}
-	readyWg.Wait()
-	close(start)
-	select {
-	case best = <-first:
-		cmd.dlogger.Printf("best mirror found: %q", best)
-	case <-ctx.Done():
+	if len(rr) > 0 {
+		input = io.MultiReader(rr...)
+	} else {
+		input = os.Stdin
 	}
-	return best, ctx.Err()
+	b, err := ioutil.ReadAll(input)
+	cmd.closeReaders(rr)
+	return string(b), err
 }
 
 func (cmd Cmd) readPassword() (string, error) {
-	fmt.Fprint(cmd.Out, "Enter Password: ")
+	fmt.Fprint(cmd.Out, cmd.msgs.T("Enter Password: "))
 	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
 	if err != nil {
 		return "", err
@@ -518,6 +1660,50 @@ func (cmd Cmd) closeReaders(rr []io.Reader) {
 	}
 }
 
+// maxConnections returns number of parts downloaded at once, 0 for all
+func (cmd Cmd) maxConnections() int {
+	if cmd.options.MaxConnections == 0 && cmd.options.PartSize > 0 {
+		return defaultConnections
+	}
+	return int(cmd.options.MaxConnections)
+}
+
+// bufSize returns --buffer-size, rounded up to page multiple. It's cut down
+// to quarter of --limit-rate, so limited parts don't go in bursts.
+func (cmd Cmd) bufSize() int64 {
+	size := int64(cmd.options.BufferSize)
+	if limit := int64(cmd.options.LimitRate); limit > 0 && size > limit/4 {
+		size = limit / 4
+	}
+	if size < minBufSize {
+		return minBufSize
+	}
+	return (size + minBufSize - 1) / minBufSize * minBufSize
+}
+
+// isRetryable reports whether err is worth another session try
+func isRetryable(err error) bool {
+	cause := errors.Cause(err)
+	if cause == ErrGiveUp || cause == errRemoteChanged {
+		// next try validates the session again
+		return true
+	}
+	switch e := cause.(type) {
+	case StatusError:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+func setupLogger(out io.Writer, prefix string, discard bool) *log.Logger {
+	if discard {
+		out = ioutil.Discard
+	}
+	return log.New(out, prefix, log.LstdFlags)
+}
+
 func subscribe(wg *sync.WaitGroup, start <-chan struct{}, fn func()) {
 	go func() {
 		wg.Done()
@@ -526,28 +1712,86 @@ func subscribe(wg *sync.WaitGroup, start <-chan struct{}, fn func()) {
 	}()
 }
 
+// parseContentDisposition returns file name of Content-Disposition header,
+// reduced to its last element, or empty string if there is no usable one
 func parseContentDisposition(input string) string {
 	groups := reContentDisposition.FindAllStringSubmatch(input, -1)
 	for _, group := range groups {
 		if group[2] != "" {
-			return group[2]
+			name, _ := safeFileName(group[2])
+			return name
 		}
 		split := strings.Split(group[1], "'")
 		if len(split) == 3 && strings.ToLower(split[0]) == "utf-8" {
 			unescaped, _ := url.QueryUnescape(split[2])
-			return unescaped
+			name, _ := safeFileName(unescaped)
+			return name
 		}
 		if split[0] != `""` {
-			return split[0]
+			name, _ := safeFileName(split[0])
+			return name
 		}
 	}
 	return ""
 }
 
+// savedName returns path, download of userUrl is saved to: the one of
+// --output-document or of the name given by hops, or else by the url
+func (cmd Cmd) savedName(userUrl string, hops []Hop) (string, error) {
+	if cmd.options.OutFileName != "" {
+		return cmd.options.OutFileName, nil
+	}
+	var name string
+	if len(hops) != 0 {
+		name = cmd.dispositionName(hops)
+	}
+	if name == "" {
+		name = urlFileName(userUrl)
+	}
+	return cmd.outputName(cmd.userUrl, name)
+}
+
+// dispositionName returns file name of Content-Disposition of the final
+// hop, or of the latest redirect, if the final one has none. Redirectors
+// and mirrors often disagree on the name, so conflicts are noted.
+func (cmd Cmd) dispositionName(hops []Hop) string {
+	final := len(hops) - 1
+	name, from := hops[final].FileName, final
+	for i := final - 1; i >= 0; i-- {
+		switch hop := hops[i]; {
+		case hop.FileName == "" || hop.FileName == name:
+		case name == "":
+			name, from = hop.FileName, i
+		default:
+			cmd.dlogger.Printf("%s: %q of hop %d conflicts with %q of hop %d, using the latter", hContentDisposition, hop.FileName, i+1, name, from+1)
+		}
+	}
+	if name != "" {
+		cmd.dlogger.Printf("%s: %q of hop %d", hContentDisposition, name, from+1)
+	}
+	return name
+}
+
 func isRedirect(status int) bool {
 	return status > 299 && status < 400
 }
 
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && terminal.IsTerminal(int(f.Fd()))
+}
+
+// hasTTYCapabilities reports whether w is terminal, which bars can be
+// redrawn on: not dumb and of known width
+func hasTTYCapabilities(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok || !terminal.IsTerminal(int(f.Fd())) || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	width, _, err := terminal.GetSize(int(f.Fd()))
+	return err == nil && width > 0
+}
+
 func readLines(r io.Reader) ([]string, error) {
 	var lines []string
 	scanner := bufio.NewScanner(r)
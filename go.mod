@@ -1,15 +1,20 @@
 module github.com/vbauerster/getparty
 
 require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/andybalholm/brotli v1.0.0
 	github.com/hashicorp/go-cleanhttp v0.5.1
 	github.com/jessevdk/go-flags v1.4.0
+	github.com/klauspost/compress v1.11.0
 	github.com/pkg/errors v0.9.1
+	github.com/pkg/sftp v1.12.0
 	github.com/vbauerster/backoff v0.0.0-20190809065356-e16a21284378
 	github.com/vbauerster/mpb/v5 v5.3.0
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
 	golang.org/x/net v0.0.0-20200904194848-62affa334b73
 	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208
-	golang.org/x/sys v0.0.0-20200909081042-eff7692f9009 // indirect
+	golang.org/x/sys v0.0.0-20200909081042-eff7692f9009
+	gopkg.in/yaml.v2 v2.3.0
 )
 
 go 1.14
@@ -0,0 +1,214 @@
+package getparty
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gcsReadScope     = "https://www.googleapis.com/auth/devstorage.read_only"
+	gcsTokenURL      = "https://oauth2.googleapis.com/token"
+	gcsMetadataHost  = "metadata.google.internal"
+	gcsStorageHost   = "https://storage.googleapis.com"
+	gcsMetadataToken = "/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+type gcsToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// gcsCredentials is application default credentials file, either of
+// service account or of gcloud user
+type gcsCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// gsRoundTripper maps gs://bucket/object onto GET of the object with
+// OAuth2 bearer token. Token is got like Google client libraries do:
+// GOOGLE_APPLICATION_CREDENTIALS, gcloud application default credentials
+// and metadata server. Without any, request goes anonymous, which is fine
+// for public buckets.
+type gsRoundTripper struct {
+	base   http.RoundTripper
+	tokens *credentialCache
+}
+
+func newGsRoundTripper(base http.RoundTripper) gsRoundTripper {
+	client := &http.Client{Transport: base, Timeout: 30 * time.Second}
+	return gsRoundTripper{
+		base: base,
+		tokens: &credentialCache{fetch: func(ctx context.Context) (interface{}, time.Time, error) {
+			return fetchGCSToken(ctx, client)
+		}},
+	}
+}
+
+func (rt gsRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	defer func() {
+		err = errors.WithMessage(err, "gs")
+	}()
+	endpoint := gcsStorageHost
+	if emulator := getenv("STORAGE_EMULATOR_HOST"); emulator != "" {
+		endpoint = strings.TrimSuffix(emulator, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	}
+	target := endpoint + "/" + req.URL.Host + "/" + awsEscape(strings.TrimPrefix(req.URL.Path, "/"), false)
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	r, err := objectRequest(req, target)
+	if err != nil {
+		return nil, err
+	}
+	v, err := rt.tokens.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	if token := v.(string); token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err = rt.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	return objectResponse(req, resp), nil
+}
+
+// fetchGCSToken walks the credential chain. Empty token means anonymous
+// access.
+func fetchGCSToken(ctx context.Context, client *http.Client) (interface{}, time.Time, error) {
+	if token := getenv("CLOUDSDK_AUTH_ACCESS_TOKEN", "GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, time.Time{}, nil
+	}
+	fileName := getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if fileName == "" {
+		fileName = homeFile(".config", "gcloud", "application_default_credentials.json")
+		if dir := getenv("CLOUDSDK_CONFIG"); dir != "" {
+			fileName = filepath.Join(dir, "application_default_credentials.json")
+		}
+	}
+	data, err := ioutil.ReadFile(fileName)
+	switch {
+	case err == nil:
+		var creds gcsCredentials
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return nil, time.Time{}, errors.WithMessage(err, fileName)
+		}
+		form, err := creds.tokenRequest(time.Now())
+		if err != nil {
+			return nil, time.Time{}, errors.WithMessage(err, fileName)
+		}
+		tokenURL := gcsTokenURL
+		if creds.TokenURI != "" {
+			tokenURL = creds.TokenURI
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return gcsFetchToken(client, req)
+	case !os.IsNotExist(err):
+		return nil, time.Time{}, err
+	}
+	host := gcsMetadataHost
+	if h := getenv("GCE_METADATA_HOST"); h != "" {
+		host = h
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+gcsMetadataToken, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	token, expires, err := gcsFetchToken(metadataClient, req)
+	if err == errNoMetadata {
+		return "", time.Time{}, nil
+	}
+	return token, expires, err
+}
+
+func gcsFetchToken(client *http.Client, req *http.Request) (interface{}, time.Time, error) {
+	var token gcsToken
+	if err := fetchJSON(client, req, &token); err != nil {
+		return nil, time.Time{}, err
+	}
+	return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+// tokenRequest returns form of OAuth2 token request: JWT bearer grant,
+// signed by service account key, or refresh token grant of gcloud user
+func (c gcsCredentials) tokenRequest(now time.Time) (url.Values, error) {
+	switch c.Type {
+	case "authorized_user":
+		return url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {c.ClientID},
+			"client_secret": {c.ClientSecret},
+			"refresh_token": {c.RefreshToken},
+		}, nil
+	case "service_account":
+		block, _ := pem.Decode([]byte(c.PrivateKey))
+		if block == nil {
+			return nil, errors.New("private_key isn't PEM")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, err
+			}
+		}
+		key, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private_key isn't RSA")
+		}
+		aud := c.TokenURI
+		if aud == "" {
+			aud = gcsTokenURL
+		}
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":   c.ClientEmail,
+			"scope": gcsReadScope,
+			"aud":   aud,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		})
+		enc := base64.RawURLEncoding
+		unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+		hash := sha256.Sum256([]byte(unsigned))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			return nil, err
+		}
+		return url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+		}, nil
+	}
+	return nil, errors.Errorf("unsupported credentials type %q", c.Type)
+}
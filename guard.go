@@ -0,0 +1,54 @@
+package getparty
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/vbauerster/mpb/v5/decor"
+)
+
+// checkGuards refuses content of s, which isn't of --expected-size or
+// --accept-content-type, before any part is started. Error page served
+// with 200 OK is a common way for file hosts to fail, which would be saved
+// as the file otherwise.
+func (cmd Cmd) checkGuards(s *Session) error {
+	if expected := cmd.options.ExpectedSize; expected.Size != 0 {
+		switch {
+		case s.ContentLength < 0:
+			cmd.dlogger.Printf("expected size: length is unknown, not checked")
+		case !expected.contains(s.ContentLength):
+			return ExpectedError{errors.Errorf("size %d (%.1f) isn't of --expected-size %s",
+				s.ContentLength, decor.SizeB1024(s.ContentLength), expected.value)}
+		}
+	}
+	if accept := cmd.options.AcceptContentType; len(accept) != 0 {
+		contentType := s.ContentType
+		if contentType == "" {
+			// what recipient may assume, as HTTP says
+			contentType = "application/octet-stream"
+		}
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			mediaType = contentType
+		}
+		for _, pattern := range accept {
+			if matchMediaType(pattern, mediaType) {
+				return nil
+			}
+		}
+		return ExpectedError{errors.Errorf("Content-Type %q isn't of --accept-content-type %s", contentType, strings.Join(accept, ", "))}
+	}
+	return nil
+}
+
+// matchMediaType matches mediaType against pattern, which may be type/*
+// or */*, case insensitively
+func matchMediaType(pattern, mediaType string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	mediaType = strings.ToLower(mediaType)
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	return strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+}
@@ -0,0 +1,74 @@
+package getparty
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var reRequestLine = regexp.MustCompile(`^[A-Z]+ \S+ HTTP/[\d.]+$`)
+
+// expandHeaderFiles replaces every --header @file in args with --header
+// for each line of the file, as curl does. Lines are "Key: Value", empty
+// ones and ones starting with # are skipped, so are request line and
+// HTTP/2 pseudo headers, which browser devtools put into copied headers.
+func expandHeaderFiles(args []string) ([]string, error) {
+	expanded := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var fileName string
+		switch {
+		case arg == "--":
+			return append(expanded, args[i:]...), nil
+		case (arg == "-H" || arg == "--header") && i+1 < len(args) && strings.HasPrefix(args[i+1], "@"):
+			fileName = args[i+1][1:]
+			i++
+		case strings.HasPrefix(arg, "--header=@"):
+			fileName = arg[len("--header=@"):]
+		case strings.HasPrefix(arg, "-H@"):
+			fileName = arg[len("-H@"):]
+		default:
+			expanded = append(expanded, arg)
+			continue
+		}
+		headers, err := readHeaderFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range headers {
+			expanded = append(expanded, "--header", h)
+		}
+	}
+	return expanded, nil
+}
+
+func readHeaderFile(fileName string) (headers []string, err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "header file")
+	}()
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, ":") {
+			continue
+		}
+		if line == 1 && reRequestLine.MatchString(text) {
+			continue
+		}
+		i := strings.IndexByte(text, ':')
+		if i <= 0 {
+			return nil, errors.Errorf("%s:%d: expected key: value, got %q", fileName, line, text)
+		}
+		headers = append(headers, strings.TrimSpace(text[:i])+":"+strings.TrimSpace(text[i+1:]))
+	}
+	return headers, scanner.Err()
+}
@@ -0,0 +1,108 @@
+package getparty
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// hookVars are exposed to --on-complete and --on-error commands, both as
+// placeholders, like {file}, and as environment, like GETPARTY_FILE. {} is
+// the same as {file}.
+type hookVars map[string]string
+
+// runHooks runs --on-complete or --on-error command, depending on err,
+// unless download has been skipped
+func (cmd Cmd) runHooks(err error) error {
+	if err == nil && cmd.unchanged {
+		// nothing has been downloaded for hooks to process
+		return nil
+	}
+	command := cmd.options.OnComplete
+	if err != nil {
+		command = cmd.options.OnError
+	}
+	if command == "" {
+		return err
+	}
+	vars := hookVars{
+		"file": cmd.options.OutFileName,
+		"url":  cmd.userUrl,
+	}
+	if cmd.stream != nil {
+		vars["file"] = "-"
+	}
+	if err != nil {
+		vars["error"] = err.Error()
+	} else if fi, e := os.Stat(vars["file"]); e == nil {
+		vars["size"] = fmt.Sprint(fi.Size())
+		// reading whole file may take a while, so only if asked for
+		if strings.Contains(command, "{sha256}") || strings.Contains(command, "GETPARTY_SHA256") {
+			sum, e := fileSHA256(vars["file"])
+			if e != nil {
+				return e
+			}
+			vars["sha256"] = sum
+		}
+	}
+	if e := cmd.runHook(command, vars); e != nil {
+		if err != nil {
+			cmd.logger.Printf("on-error: %v", e)
+			return err
+		}
+		return ExpectedError{errors.WithMessage(e, "on-complete")}
+	}
+	return err
+}
+
+func (cmd Cmd) runHook(command string, vars hookVars) error {
+	var pairs []string
+	env := os.Environ()
+	for k, v := range vars {
+		pairs = append(pairs, "{"+k+"}", shellQuote(v))
+		env = append(env, "GETPARTY_"+strings.ToUpper(k)+"="+v)
+	}
+	pairs = append(pairs, "{}", shellQuote(vars["file"]))
+	command = strings.NewReplacer(pairs...).Replace(command)
+	cmd.dlogger.Printf("hook: %s", command)
+
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.Command("cmd", "/C", command)
+	} else {
+		c = exec.Command("sh", "-c", command)
+	}
+	c.Env = env
+	c.Stdout = cmd.Out
+	c.Stderr = cmd.Err
+	return c.Run()
+}
+
+// shellQuote quotes s as single word for the shell, so file names from
+// Content-Disposition can't inject commands
+func shellQuote(s string) string {
+	if runtime.GOOS == "windows" {
+		return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func fileSHA256(fileName string) (string, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
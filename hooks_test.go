@@ -0,0 +1,56 @@
+package getparty
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHooksSkippedWithoutDownload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook is a sh command")
+	}
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	body := []byte(strings.Repeat("getparty", 1024))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// If-Modified-Since is ignored, as some servers do
+		w.Header().Set(hLastModified, modTime.Format(http.TimeFormat))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "getparty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "marker")
+
+	tests := []struct {
+		name string
+		args []string
+		runs bool
+	}{
+		{"download", []string{"-N"}, true},
+		{"timestamping", []string{"-N"}, false},
+		{"no-clobber", []string{"--no-clobber"}, false},
+	}
+	for _, tt := range tests {
+		os.Remove(marker)
+		cmd := &Cmd{Out: ioutil.Discard, Err: ioutil.Discard}
+		args := append(tt.args, "-q", "-P", dir, "--on-complete", "touch "+marker, ts.URL+"/f.bin")
+		if err := cmd.Run(args, "test"); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		_, err := os.Stat(marker)
+		if runs := err == nil; runs != tt.runs {
+			t.Errorf("%s: hook ran %v, want %v", tt.name, runs, tt.runs)
+		}
+	}
+}
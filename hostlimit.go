@@ -0,0 +1,79 @@
+package getparty
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// hostLimiter caps concurrent connections and spaces out requests per
+// host. It's shared by all parts and batch items, so many of them don't
+// trip rate limiting of a server. Nil *hostLimiter doesn't limit anything.
+type hostLimiter struct {
+	max   int
+	delay time.Duration
+	mu    sync.Mutex
+	hosts map[string]*hostSlots
+}
+
+type hostSlots struct {
+	sem  chan struct{} // nil if connections aren't limited
+	next time.Time     // when the next request is due
+}
+
+func newHostLimiter(max uint, delay time.Duration) *hostLimiter {
+	if max == 0 && delay <= 0 {
+		return nil
+	}
+	return &hostLimiter{
+		max:   int(max),
+		delay: delay,
+		hosts: make(map[string]*hostSlots),
+	}
+}
+
+// acquire waits for free connection slot of host and for delay since the
+// previous request to it. Returned release must be called, once the
+// connection is done.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (release func(), err error) {
+	release = func() {}
+	if l == nil {
+		return release, nil
+	}
+	l.mu.Lock()
+	slots := l.hosts[host]
+	if slots == nil {
+		slots = new(hostSlots)
+		if l.max > 0 {
+			slots.sem = make(chan struct{}, l.max)
+		}
+		l.hosts[host] = slots
+	}
+	l.mu.Unlock()
+
+	if slots.sem != nil {
+		select {
+		case slots.sem <- struct{}{}:
+			var once sync.Once
+			release = func() {
+				once.Do(func() { <-slots.sem })
+			}
+		case <-ctx.Done():
+			return release, ctx.Err()
+		}
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if slots.next.Before(now) {
+		slots.next = now
+	}
+	wait := slots.next.Sub(now)
+	slots.next = slots.next.Add(l.delay)
+	l.mu.Unlock()
+	if err := sleepContext(ctx, wait); err != nil {
+		release()
+		return func() {}, err
+	}
+	return release, nil
+}
@@ -0,0 +1,151 @@
+package getparty
+
+import (
+	"os"
+	"strings"
+)
+
+// catalog maps English format strings of user facing messages onto their
+// translations. Nil catalog is valid and leaves messages in English, as
+// does missing entry, so partial translations are fine.
+type catalog map[string]string
+
+var catalogs = map[string]catalog{
+	"ru": {
+		"File %q already exists, overwrite? [y/n] ":   "Файл %q уже существует, перезаписать? [y/n] ",
+		"Found unfinished session %q, resume? [y/n] ": "Найдена незавершённая сессия %q, продолжить? [y/n] ",
+		"y":                     "д",
+		"yes":                   "да",
+		"Enter Password: ":      "Введите пароль: ",
+		"Length: %s [%s]\n":     "Размер: %s [%s]\n",
+		"unknown":               "неизвестен",
+		", %d (%.1f) remaining": ", осталось %d (%.1f)",
+		"HTTP server doesn't seem to support byte ranges. Cannot resume.\n": "HTTP сервер, похоже, не поддерживает диапазоны байтов. Докачка невозможна.\n",
+		"server ignores advertised byte ranges, using single part":          "сервер игнорирует заявленные диапазоны байтов, используется одна часть",
+		"server supports byte ranges without advertising them":              "сервер поддерживает диапазоны байтов, не заявляя об этом",
+		"%v, falling back to single part":                                   "%v, переход на одну часть",
+		"%d parts are too many for %.1f, using %d, see --min-part-size":     "%d частей слишком много для %.1f, используется %d, см. --min-part-size",
+		"Saving to: %q\n\n":                                         "Сохранение в: %q\n\n",
+		"Estimated cost: %.2f\n":                                    "Оценка стоимости: %.2f\n",
+		"%q saved [%d/%d]":                                          "%q сохранён [%d/%d]",
+		"%q: good signature by %s":                                  "%q: верная подпись %s",
+		"active: %s, waited: %s, avg speed: %.1f/s":                 "активно: %s, ожидание: %s, средняя скорость: %.1f/s",
+		"transferred: %.1f, estimated cost: %.2f":                   "передано: %.1f, оценка стоимости: %.2f",
+		"session state saved to %q":                                 "состояние сессии сохранено в %q",
+		"%d bytes written to stdout":                                "%d байт записано в stdout",
+		"%q is up to date, skipping":                                "%q не изменился, пропуск",
+		"%q already exists, skipping":                               "%q уже существует, пропуск",
+		"%q already exists, saving to %q":                           "%q уже существует, сохранение в %q",
+		"try %d of %d failed: %v":                                   "попытка %d из %d не удалась: %v",
+		"verification failed: %v, downloading again, %d of %d":      "проверка не прошла: %v, скачиваем снова, %d из %d",
+		"%q is shorter than recorded: %d < %d, resuming from %[2]d": "%q короче записанного: %d < %d, продолжаем с %[2]d",
+		"%q is longer than recorded: %d > %d, truncating":           "%q длиннее записанного: %d > %d, обрезаем",
+		"%q tail doesn't match remote, restarting part":             "хвост %q не совпадает с сервером, часть начинается заново",
+		"%q doesn't match its checksum, restarting part":            "%q не совпадает с контрольной суммой, часть начинается заново",
+		"%q doesn't match its checksum, verifying its pieces":       "%q не совпадает с контрольной суммой, проверяются её куски",
+		"Remote file has changed: %s, starting over":                "Файл на сервере изменился: %s, загрузка начинается заново",
+		"appending to %q, %d bytes already there":                   "дописываем в %q, уже есть %d байт",
+		"zsync: %d of %d bytes reused from %q":                      "zsync: %d из %d байт взято из %q",
+		"torrent: %d of %d pieces of %q are good already":           "torrent: %d из %d частей %q уже в порядке",
+		"torrent: no piece hashes, content won't be verified":       "torrent: нет хешей частей, содержимое не будет проверено",
+		"mirror %q dropped: %v":                                     "зеркало %q исключено: %v",
+		"mirror %q dropped: content differs at [%d:%d]":             "зеркало %q исключено: содержимое отличается в [%d:%d]",
+		"%s: %d percent downloaded.\n":                              "%s: загружено %d процентов.\n",
+		"#\tResult\tFile\tUrl\tError":                               "#\tРезультат\tФайл\tUrl\tОшибка",
+		"#\tSpeed\tLatency\tMirror\tError":                          "#\tСкорость\tЗадержка\tЗеркало\tОшибка",
+		"ok":                                                        "готово",
+		"failed":                                                    "ошибка",
+		"skipped":                                                   "пропущено",
+		"Total: %.1f / %.1f (%d%%), %.1f/s, ETA %s, retries %d\n":   "Всего: %.1f / %.1f (%d%%), %.1f/s, осталось %s, повторов %d\n",
+		"%d failed items written to %q":                             "%d незавершённых записано в %q",
+		"exit error: %v\n":                                          "ошибка: %v\n",
+		"unexpected error: %v\n":                                    "непредвиденная ошибка: %v\n",
+	},
+	"de": {
+		"File %q already exists, overwrite? [y/n] ":   "Die Datei %q existiert bereits, überschreiben? [y/n] ",
+		"Found unfinished session %q, resume? [y/n] ": "Unvollständige Sitzung %q gefunden, fortsetzen? [y/n] ",
+		"y":                     "j",
+		"yes":                   "ja",
+		"Enter Password: ":      "Passwort eingeben: ",
+		"Length: %s [%s]\n":     "Länge: %s [%s]\n",
+		"unknown":               "unbekannt",
+		", %d (%.1f) remaining": ", %d (%.1f) verbleibend",
+		"HTTP server doesn't seem to support byte ranges. Cannot resume.\n": "Der HTTP-Server scheint keine Byte-Bereiche zu unterstützen. Fortsetzen nicht möglich.\n",
+		"server ignores advertised byte ranges, using single part":          "Server ignoriert angekündigte Byte-Bereiche, verwende einen Teil",
+		"server supports byte ranges without advertising them":              "Server unterstützt Byte-Bereiche, ohne sie anzukündigen",
+		"%v, falling back to single part":                                   "%v, Rückfall auf einen Teil",
+		"%d parts are too many for %.1f, using %d, see --min-part-size":     "%d Teile sind zu viele für %.1f, verwende %d, siehe --min-part-size",
+		"Saving to: %q\n\n":                                         "Speichern in: %q\n\n",
+		"Estimated cost: %.2f\n":                                    "Geschätzte Kosten: %.2f\n",
+		"%q saved [%d/%d]":                                          "%q gespeichert [%d/%d]",
+		"%q: good signature by %s":                                  "%q: gültige Signatur von %s",
+		"active: %s, waited: %s, avg speed: %.1f/s":                 "aktiv: %s, gewartet: %s, Durchschnitt: %.1f/s",
+		"transferred: %.1f, estimated cost: %.2f":                   "übertragen: %.1f, geschätzte Kosten: %.2f",
+		"session state saved to %q":                                 "Sitzungszustand in %q gespeichert",
+		"%d bytes written to stdout":                                "%d Bytes auf stdout geschrieben",
+		"%q is up to date, skipping":                                "%q ist aktuell, wird übersprungen",
+		"%q already exists, skipping":                               "%q existiert bereits, wird übersprungen",
+		"%q already exists, saving to %q":                           "%q existiert bereits, Speichern in %q",
+		"try %d of %d failed: %v":                                   "Versuch %d von %d fehlgeschlagen: %v",
+		"verification failed: %v, downloading again, %d of %d":      "Prüfung fehlgeschlagen: %v, erneuter Download, %d von %d",
+		"%q is shorter than recorded: %d < %d, resuming from %[2]d": "%q ist kürzer als vermerkt: %d < %d, fortgesetzt ab %[2]d",
+		"%q is longer than recorded: %d > %d, truncating":           "%q ist länger als vermerkt: %d > %d, wird gekürzt",
+		"%q tail doesn't match remote, restarting part":             "Ende von %q stimmt nicht mit dem Server überein, Teil wird neu gestartet",
+		"%q doesn't match its checksum, restarting part":            "%q stimmt nicht mit der Prüfsumme überein, Teil wird neu gestartet",
+		"%q doesn't match its checksum, verifying its pieces":       "%q stimmt nicht mit der Prüfsumme überein, seine Stücke werden geprüft",
+		"Remote file has changed: %s, starting over":                "Datei auf dem Server hat sich geändert: %s, Download beginnt neu",
+		"appending to %q, %d bytes already there":                   "an %q wird angehängt, %d Bytes bereits vorhanden",
+		"zsync: %d of %d bytes reused from %q":                      "zsync: %d von %d Bytes aus %q übernommen",
+		"torrent: %d of %d pieces of %q are good already":           "torrent: %d von %d Stücken von %q sind bereits in Ordnung",
+		"torrent: no piece hashes, content won't be verified":       "torrent: keine Stück-Hashes, Inhalt wird nicht geprüft",
+		"mirror %q dropped: %v":                                     "Spiegel %q verworfen: %v",
+		"mirror %q dropped: content differs at [%d:%d]":             "Spiegel %q verworfen: Inhalt weicht ab bei [%d:%d]",
+		"%s: %d percent downloaded.\n":                              "%s: %d Prozent heruntergeladen.\n",
+		"#\tResult\tFile\tUrl\tError":                               "#\tErgebnis\tDatei\tUrl\tFehler",
+		"#\tSpeed\tLatency\tMirror\tError":                          "#\tGeschwindigkeit\tLatenz\tSpiegel\tFehler",
+		"ok":                                                        "ok",
+		"failed":                                                    "fehlgeschlagen",
+		"skipped":                                                   "übersprungen",
+		"Total: %.1f / %.1f (%d%%), %.1f/s, ETA %s, retries %d\n":   "Gesamt: %.1f / %.1f (%d%%), %.1f/s, Restzeit %s, Wiederholungen %d\n",
+		"%d failed items written to %q":                             "%d fehlgeschlagene Einträge in %q geschrieben",
+		"exit error: %v\n":                                          "Fehler: %v\n",
+		"unexpected error: %v\n":                                    "unerwarteter Fehler: %v\n",
+	},
+}
+
+// T returns translation of format, or format itself
+func (c catalog) T(format string) string {
+	if t, ok := c[format]; ok {
+		return t
+	}
+	return format
+}
+
+// yes reports whether answer to a prompt is affirmative, in English or in
+// language of the catalog
+func (c catalog) yes(answer string) bool {
+	switch strings.ToLower(answer) {
+	case "y", "yes", c.T("y"), c.T("yes"):
+		return true
+	}
+	return false
+}
+
+// detectLanguage returns language code of the user's locale, as POSIX
+// defines precedence of LC_ALL, LC_MESSAGES and LANG
+func detectLanguage() string {
+	for _, env := range [...]string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(env); locale != "" {
+			return localeLanguage(locale)
+		}
+	}
+	return ""
+}
+
+// localeLanguage extracts language from locale like ru_RU.UTF-8
+func localeLanguage(locale string) string {
+	if i := strings.IndexAny(locale, "_.@"); i >= 0 {
+		locale = locale[:i]
+	}
+	return strings.ToLower(locale)
+}
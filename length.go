@@ -0,0 +1,76 @@
+package getparty
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	verifyStrict  = "strict"
+	verifyLenient = "lenient"
+)
+
+var reContentRange = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+|\*)$`)
+
+// checkLength verifies response against requested range and Content-Range
+// total against expected length of the whole content.
+func (p *Part) checkLength(req *http.Request, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if p.totalLength > 0 && resp.ContentLength != p.totalLength {
+			return errors.Errorf("Content-Length %d, expected %d", resp.ContentLength, p.totalLength)
+		}
+	case http.StatusPartialContent:
+		contentRange := resp.Header.Get("Content-Range")
+		groups := reContentRange.FindStringSubmatch(contentRange)
+		if groups == nil {
+			return errors.Errorf("invalid Content-Range %q", contentRange)
+		}
+		start, _ := strconv.ParseInt(groups[1], 10, 64)
+		stop, _ := strconv.ParseInt(groups[2], 10, 64)
+		if groups[3] != "*" && p.totalLength > 0 {
+			if total, _ := strconv.ParseInt(groups[3], 10, 64); total != p.totalLength {
+				return errors.Errorf("Content-Range total %d, expected %d", total, p.totalLength)
+			}
+		}
+		if requested := reByteRange.FindStringSubmatch(req.Header.Get(hRange)); requested != nil && requested[2] != "" {
+			// shorter range is fine, some servers cap response size,
+			// the rest is requested again after short read
+			reqStop, _ := strconv.ParseInt(requested[2], 10, 64)
+			if requested[1] != groups[1] || stop > reqStop {
+				return errors.Errorf("Content-Range %q doesn't match requested %q", contentRange, req.Header.Get(hRange))
+			}
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength != stop-start+1 {
+			return errors.Errorf("Content-Length %d doesn't match Content-Range %q", resp.ContentLength, contentRange)
+		}
+	}
+	return nil
+}
+
+// checkFinalLength compares size of the saved file with expected length.
+// Mismatch is an error in strict mode, otherwise it's only logged.
+func (cmd Cmd) checkFinalLength(s *Session, written int64) error {
+	fi, err := os.Stat(s.SuggestedFileName)
+	if err != nil {
+		return err
+	}
+	var mismatch error
+	switch {
+	case fi.Size() != written:
+		mismatch = errors.Errorf("%q size %d, written %d", s.SuggestedFileName, fi.Size(), written)
+	case s.ContentLength > 0 && fi.Size() != s.ContentLength:
+		mismatch = errors.Errorf("%q size %d, expected %d", s.SuggestedFileName, fi.Size(), s.ContentLength)
+	}
+	if mismatch != nil {
+		if cmd.options.VerifyLength == verifyStrict {
+			return ExpectedError{mismatch}
+		}
+		cmd.logger.Printf("length mismatch: %v", mismatch)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package getparty
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// levels of --log-file, each includes the previous ones
+const (
+	logInfo  = "info"  // messages shown without --debug
+	logDebug = "debug" // plus debug of getparty and every part
+	logTrace = "trace" // plus headers of every request and response
+)
+
+var logLevels = map[string]int{logInfo: 0, logDebug: 1, logTrace: 2}
+
+// redactedHeaders are logged without values, as they carry credentials
+var redactedHeaders = map[string]bool{
+	"Authorization":        true,
+	"Proxy-Authorization":  true,
+	"Cookie":               true,
+	"Set-Cookie":           true,
+	"X-Amz-Security-Token": true,
+}
+
+// logFile is --log-file, which gets messages up to its level, whether they
+// are shown or not, and is rotated, once it grows past maxSize, keeping
+// up to backups old files as name.1, name.2 and so on. Nil logFile is
+// valid and logs nothing.
+type logFile struct {
+	mu      sync.Mutex
+	name    string
+	level   int
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openLogFile(name, level string, maxSize int64, backups int) (*logFile, error) {
+	l := &logFile{
+		name:    name,
+		level:   logLevels[level],
+		maxSize: maxSize,
+		backups: backups,
+	}
+	return l, l.open()
+}
+
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate shifts backups by one, dropping the oldest, and starts afresh
+func (l *logFile) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if err := rotateFiles(l.name, l.backups); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// rotateFiles shifts name.1 .. name.n-1 to name.2 .. name.n and name to
+// name.1, the oldest is dropped. Missing ones are fine.
+func rotateFiles(name string, n int) error {
+	if n == 0 {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for i := n - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", name, i), fmt.Sprintf("%s.%d", name, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(name, name+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *logFile) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// tee returns writer of logger of level: out, unless discarded, along with
+// l, if l is of the level
+func (l *logFile) tee(out io.Writer, discard bool, level string) io.Writer {
+	if discard {
+		out = ioutil.Discard
+	}
+	if l == nil || logLevels[level] > l.level {
+		return out
+	}
+	if discard {
+		return l
+	}
+	return io.MultiWriter(out, l)
+}
+
+// wrap makes rt log headers of every round trip, if l is of trace level
+func (l *logFile) wrap(rt http.RoundTripper) http.RoundTripper {
+	if l == nil || l.level < logLevels[logTrace] {
+		return rt
+	}
+	return transcriptRoundTripper{base: rt, logger: log.New(l, "[http] ", log.LstdFlags)}
+}
+
+// transcriptRoundTripper logs request and response headers, like curl -v
+// does, with credentials redacted
+type transcriptRoundTripper struct {
+	base   http.RoundTripper
+	logger *log.Logger
+}
+
+func (rt transcriptRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.User = nil
+	var b strings.Builder
+	fmt.Fprintf(&b, "> %s %s %s\n", req.Method, u.String(), req.Proto)
+	if req.Host != "" && req.Host != req.URL.Host {
+		fmt.Fprintf(&b, "> Host: %s\n", req.Host)
+	}
+	writeHeaders(&b, "> ", req.Header)
+	rt.logger.Print(b.String())
+	resp, err := rt.base.RoundTrip(req)
+	if err != nil {
+		rt.logger.Printf("! %s %s: %v", req.Method, u.String(), err)
+		return resp, err
+	}
+	b.Reset()
+	fmt.Fprintf(&b, "< %s %s\n", resp.Proto, resp.Status)
+	writeHeaders(&b, "< ", resp.Header)
+	rt.logger.Print(b.String())
+	return resp, nil
+}
+
+func writeHeaders(w io.Writer, prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			if redactedHeaders[http.CanonicalHeaderKey(name)] {
+				value = "[redacted]"
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, name, value)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package getparty
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// metricsContentType is of Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4"
+
+// failure is a key of failures counted by daemon: scope is either "part"
+// or "job", status is http status code, 0 for other errors
+type failure struct {
+	scope  string
+	status int
+}
+
+// writeMetrics writes state of jobs in Prometheus text format
+func (d *daemon) writeMetrics(w io.Writer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids := make([]int, 0, len(d.jobs))
+	for id := range d.jobs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	byStatus := map[string]int{jobActive: 0, jobPaused: 0, jobDone: 0, jobFailed: 0}
+	var written int64
+	var retries uint32
+	var connections int
+	for _, j := range d.jobs {
+		byStatus[j.Status]++
+		written += j.Written
+		retries += j.Retries
+		if j.proc == nil {
+			continue
+		}
+		for _, p := range j.parts {
+			if p.Event == "progress" {
+				connections++
+			}
+		}
+	}
+
+	writeMetricHeader(w, "getparty_jobs", "gauge", "Number of jobs by status.")
+	for _, status := range []string{jobActive, jobPaused, jobDone, jobFailed} {
+		fmt.Fprintf(w, "getparty_jobs{status=%q} %d\n", status, byStatus[status])
+	}
+	writeMetricHeader(w, "getparty_downloaded_bytes", "gauge", "Bytes downloaded by all jobs.")
+	fmt.Fprintf(w, "getparty_downloaded_bytes %d\n", written)
+	writeMetricHeader(w, "getparty_retries", "gauge", "Retries of all jobs.")
+	fmt.Fprintf(w, "getparty_retries %d\n", retries)
+	writeMetricHeader(w, "getparty_active_connections", "gauge", "Parts downloading at the moment.")
+	fmt.Fprintf(w, "getparty_active_connections %d\n", connections)
+
+	writeMetricHeader(w, "getparty_job_downloaded_bytes", "gauge", "Bytes downloaded by job.")
+	for _, id := range ids {
+		fmt.Fprintf(w, "getparty_job_downloaded_bytes{job=\"%d\"} %d\n", id, d.jobs[id].Written)
+	}
+	writeMetricHeader(w, "getparty_job_size_bytes", "gauge", "Content length of job, -1 if unknown.")
+	for _, id := range ids {
+		if j := d.jobs[id]; j.Total != 0 {
+			fmt.Fprintf(w, "getparty_job_size_bytes{job=\"%d\"} %d\n", id, j.Total)
+		}
+	}
+	writeMetricHeader(w, "getparty_part_speed_bytes", "gauge", "Download speed of active part, bytes per second.")
+	for _, id := range ids {
+		j := d.jobs[id]
+		if j.proc == nil {
+			continue
+		}
+		names := make([]string, 0, len(j.parts))
+		for name, p := range j.parts {
+			if p.Event == "progress" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "getparty_part_speed_bytes{job=\"%d\",part=%q} %s\n", id, name, formatFloat(j.parts[name].Speed))
+		}
+	}
+
+	keys := make([]failure, 0, len(d.failures))
+	for k := range d.failures {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, k int) bool {
+		if keys[i].scope != keys[k].scope {
+			return keys[i].scope < keys[k].scope
+		}
+		return keys[i].status < keys[k].status
+	})
+	writeMetricHeader(w, "getparty_failures_total", "counter", "Failures of parts and jobs by http status code, 0 is any other error.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "getparty_failures_total{scope=%q,status=\"%d\"} %d\n", k.scope, k.status, d.failures[k])
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,312 @@
+package getparty
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vbauerster/mpb/v5/decor"
+)
+
+// mirror is a mirror list entry: whitespace separated urls of the same
+// resource, served over different schemes or ports, in order of preference.
+// First url is the one in use, the rest are fallbacks on connection failure.
+type mirror []string
+
+func (cmd Cmd) bestMirror(ctx context.Context, input io.Reader, max int) (best []mirror, err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "bestMirror")
+	}()
+	lines, err := readLines(input)
+	if err != nil {
+		return
+	}
+	if max <= 0 {
+		max = len(lines)
+	}
+
+	var readyWg, doneWg sync.WaitGroup
+	start := make(chan struct{})
+	responded := make(chan mirror, len(lines))
+	client := cmd.newProbeClient(nil)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	for _, line := range lines {
+		m := mirror(strings.Fields(line))
+		readyWg.Add(1)
+		doneWg.Add(1)
+		subscribe(&readyWg, start, func() {
+			defer doneWg.Done()
+			for i, u := range m {
+				if cmd.probeMirror(ctx, client, u) {
+					responded <- append(m[i:len(m):len(m)], m[:i]...)
+					return
+				}
+			}
+		})
+	}
+	readyWg.Wait()
+	close(start)
+	allDone := make(chan struct{})
+	go func() {
+		doneWg.Wait()
+		close(allDone)
+	}()
+	for len(best) < max {
+		select {
+		case m := <-responded:
+			cmd.dlogger.Printf("mirror #%d: %q", len(best)+1, m[0])
+			best = append(best, m)
+			continue
+		case <-allDone:
+			for len(best) < max && len(responded) != 0 {
+				best = append(best, <-responded)
+			}
+		case <-ctx.Done():
+		}
+		break
+	}
+	if len(best) == 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("no mirror responded")
+	}
+	return best, nil
+}
+
+// mirrorBench is throughput of a mirror, measured by benchMirrors
+type mirrorBench struct {
+	m       mirror
+	latency time.Duration // until response headers
+	speed   float64       // bytes per second of the body
+	err     error
+}
+
+// benchMirrors downloads first size bytes from every mirror concurrently
+// and ranks them by throughput, then by latency. Up to max best ones are
+// returned, all responding if max <= 0. Ranking is printed as a table,
+// unless quiet.
+func (cmd Cmd) benchMirrors(ctx context.Context, input io.Reader, size int64, max int) (best []mirror, err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "benchMirrors")
+	}()
+	results, err := cmd.rankMirrors(ctx, input, size)
+	if err != nil {
+		return
+	}
+	if !cmd.options.Quiet {
+		cmd.writeBench(cmd.Out, results)
+	}
+	for _, r := range results {
+		if r.err != nil || max > 0 && len(best) == max {
+			break
+		}
+		cmd.dlogger.Printf("mirror #%d: %q %.1f/s", len(best)+1, r.m[0], decor.SizeB1024(int64(r.speed)))
+		best = append(best, r.m)
+	}
+	if len(best) == 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("no mirror responded")
+	}
+	return best, nil
+}
+
+// rankMirrors measures every mirror of input and returns all of them,
+// responding ones first, the fastest on top.
+func (cmd Cmd) rankMirrors(ctx context.Context, input io.Reader, size int64) ([]mirrorBench, error) {
+	lines, err := readLines(input)
+	if err != nil {
+		return nil, err
+	}
+
+	client := cmd.newProbeClient(nil)
+	defer client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Duration(cmd.options.Timeout)*time.Second)
+	defer cancel()
+
+	results := make([]mirrorBench, len(lines))
+	var wg sync.WaitGroup
+	for i, line := range lines {
+		wg.Add(1)
+		go func(r *mirrorBench, m mirror) {
+			defer wg.Done()
+			// first of the urls to respond, the rest are fallbacks
+			for i, u := range m {
+				r.latency, r.speed, r.err = cmd.benchUrl(ctx, client, u, size)
+				if r.err == nil {
+					r.m = append(m[i:len(m):len(m)], m[:i]...)
+					return
+				}
+			}
+			r.m = m
+		}(&results[i], mirror(strings.Fields(line)))
+	}
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if (a.err == nil) != (b.err == nil) {
+			return a.err == nil
+		}
+		if a.speed != b.speed {
+			return a.speed > b.speed
+		}
+		return a.latency < b.latency
+	})
+	return results, nil
+}
+
+// benchUrl downloads first size bytes of u. Mirror, which is too slow to
+// deliver them in time, is measured by what it has delivered.
+func (cmd Cmd) benchUrl(ctx context.Context, client *http.Client, u string, size int64) (latency time.Duration, speed float64, err error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.URL.User = cmd.userInfo
+	cmd.applyHeaders(req)
+	req.Header.Set(hRange, fmt.Sprintf("bytes=0-%d", size-1))
+	cmd.dlogger.Printf("bench: GET %q %s", u, req.Header.Get(hRange))
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	latency = time.Since(start)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return latency, 0, errors.Errorf("unexpected status: %s", resp.Status)
+	}
+	start = time.Now()
+	n, err := io.CopyN(ioutil.Discard, resp.Body, size)
+	elapsed := time.Since(start)
+	if err != nil && !(err == io.EOF || ctx.Err() != nil && n != 0) {
+		return latency, 0, err
+	}
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	return latency, float64(n) / elapsed.Seconds(), nil
+}
+
+func (cmd Cmd) writeBench(w io.Writer, results []mirrorBench) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, cmd.msgs.T("#\tSpeed\tLatency\tMirror\tError"))
+	for i, r := range results {
+		var errText string
+		if r.err != nil {
+			errText = r.err.Error()
+		}
+		fmt.Fprintf(tw, "%d\t%.1f/s\t%s\t%s\t%s\n", i+1, decor.SizeB1024(int64(r.speed)), r.latency.Round(time.Millisecond), r.m[0], errText)
+	}
+	fmt.Fprintln(tw)
+	tw.Flush()
+}
+
+func (cmd Cmd) probeMirror(ctx context.Context, client *http.Client, u string) bool {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		cmd.dlogger.Printf("skipping %q: %v", u, err)
+		return false
+	}
+	req.URL.User = cmd.userInfo
+	cmd.dlogger.Printf("fetching: %q", u)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cmd.dlogger.Printf("fetch error: %v", err)
+	}
+	if resp == nil || resp.Body == nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		cmd.dlogger.Printf("fetch %q unexpected status: %s", u, resp.Status)
+		return false
+	}
+	return true
+}
+
+// crossCheck fetches the same window of bytes from every mirror and
+// compares it against the first (best) one. Mirrors serving different
+// content are dropped.
+func (cmd Cmd) crossCheck(ctx context.Context, jar http.CookieJar, mirrors []mirror, length, window int64) []mirror {
+	if length <= 0 {
+		return mirrors[:1]
+	}
+	if window > length {
+		window = length
+	}
+	client := cmd.newClient(true, jar)
+	defer client.CloseIdleConnections()
+
+	offset := (length - window) / 2
+	ref, err := cmd.fetchWindow(ctx, client, mirrors[0][0], offset, window)
+	if err != nil {
+		cmd.dlogger.Printf("crossCheck: reference %q: %v", mirrors[0][0], err)
+		return mirrors[:1]
+	}
+	checked := mirrors[:1]
+	for _, m := range mirrors[1:] {
+		u := m[0]
+		b, err := cmd.fetchWindow(ctx, client, u, offset, window)
+		if err != nil {
+			cmd.logger.Printf(cmd.msgs.T("mirror %q dropped: %v"), u, err)
+			continue
+		}
+		if !bytes.Equal(ref, b) {
+			cmd.logger.Printf(cmd.msgs.T("mirror %q dropped: content differs at [%d:%d]"), u, offset, offset+window)
+			continue
+		}
+		checked = append(checked, m)
+	}
+	return checked
+}
+
+func (cmd Cmd) fetchWindow(ctx context.Context, client *http.Client, u string, offset, window int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.User = cmd.userInfo
+	cmd.applyHeaders(req)
+	req.Header.Set(hRange, fmt.Sprintf("bytes=%d-%d", offset, offset+window-1))
+	cmd.dlogger.Printf("crossCheck: GET %q %s", u, req.Header.Get(hRange))
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, errors.Errorf("unexpected status: %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err == nil && int64(len(b)) != window {
+		err = errors.Errorf("short window: %d of %d", len(b), window)
+	}
+	return b, err
+}
+
+// spreadMirrors assigns mirrors to parts in round-robin fashion
+func (s *Session) spreadMirrors(mirrors []mirror) {
+	for i, p := range s.Parts {
+		m := mirrors[i%len(mirrors)]
+		p.Location = m[0]
+		p.Fallback = append([]string(nil), m[1:]...)
+	}
+}
@@ -0,0 +1,89 @@
+package getparty
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const mirrorTestCommand = "mirror-test"
+
+// mirrorTestOptions are options of mirror-test subcommand, the rest of
+// application options, like timeout, headers or proxy, apply as well.
+type mirrorTestOptions struct {
+	Input  string   `short:"i" long:"input" value-name:"mirrors.txt" default:"-" description:"mirror list, one per line, whitespace separated alternate urls, - for stdin"`
+	Sample ByteSize `long:"sample" value-name:"size" default:"1M" description:"download first size bytes from each mirror"`
+	JSON   bool     `long:"json" description:"print ranking as json"`
+}
+
+// mirrorReport is mirror-test result of a mirror, as printed by --json
+type mirrorReport struct {
+	Rank      int      `json:"rank"`
+	URL       string   `json:"url"`
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	Latency   float64  `json:"latency"` // seconds
+	Speed     float64  `json:"speed"`   // bytes per second
+	Error     string   `json:"error,omitempty"`
+}
+
+// mirrorTest ranks mirrors the way --bench-size does and prints the ranking,
+// downloading nothing. It fails, if no mirror has responded.
+func (cmd Cmd) mirrorTest(ctx context.Context, opts *mirrorTestOptions) (err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, mirrorTestCommand)
+	}()
+	if opts.Sample <= 0 {
+		return errors.New("--sample: size must be positive")
+	}
+	var input io.Reader = os.Stdin
+	if opts.Input != "-" {
+		fd, err := os.Open(opts.Input)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		input = fd
+	}
+	results, err := cmd.rankMirrors(ctx, input, int64(opts.Sample))
+	if err != nil {
+		return err
+	}
+	if opts.JSON {
+		err = writeMirrorReport(cmd.Out, results)
+	} else {
+		cmd.writeBench(cmd.Out, results)
+	}
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 || results[0].err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.New("no mirror responded")
+	}
+	return nil
+}
+
+func writeMirrorReport(w io.Writer, results []mirrorBench) error {
+	report := make([]mirrorReport, len(results))
+	for i, r := range results {
+		report[i] = mirrorReport{
+			Rank:      i + 1,
+			URL:       r.m[0],
+			Fallbacks: r.m[1:],
+			Latency:   r.latency.Seconds(),
+			Speed:     r.speed,
+		}
+		if r.err != nil {
+			report[i].Error = r.err.Error()
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
@@ -0,0 +1,12 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package getparty
+
+import "syscall"
+
+// setLowPriority lowers cpu priority of the process to the least one.
+// There is no portable I/O priority on these systems.
+func setLowPriority() error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, 20)
+}
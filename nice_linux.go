@@ -0,0 +1,22 @@
+package getparty
+
+import "syscall"
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// setLowPriority lowers cpu priority of the process to the least one, and
+// puts its disk I/O into idle class, like ionice -c3 does.
+func setLowPriority() error {
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, 19); err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!windows,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package getparty
+
+import "github.com/pkg/errors"
+
+func setLowPriority() error {
+	return errors.New("not supported on this system")
+}
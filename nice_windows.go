@@ -0,0 +1,21 @@
+package getparty
+
+import "syscall"
+
+// processModeBackgroundBegin lowers both cpu and I/O priority
+const processModeBackgroundBegin = 0x00100000
+
+var procSetPriorityClass = syscall.NewLazyDLL("kernel32.dll").NewProc("SetPriorityClass")
+
+// setLowPriority puts the process into background mode
+func setLowPriority() error {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	r, _, err := procSetPriorityClass.Call(uintptr(process), processModeBackgroundBegin)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package getparty
+
+func raiseOpenFiles(uint64) (uint64, error) {
+	return 0, errLimitUnknown
+}
@@ -0,0 +1,25 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package getparty
+
+import "syscall"
+
+// raiseOpenFiles raises soft limit of open files up to the hard one, if
+// it's below need, and returns the resulting limit
+func raiseOpenFiles(need uint64) (uint64, error) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, err
+	}
+	if uint64(rl.Cur) >= need || rl.Cur == rl.Max {
+		return uint64(rl.Cur), nil
+	}
+	cur := uint64(rl.Cur)
+	rl.Cur = rl.Max
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		// e.g. darwin, which refuses unlimited one
+		return cur, err
+	}
+	return uint64(rl.Cur), nil
+}
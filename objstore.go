@@ -0,0 +1,156 @@
+package getparty
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	"github.com/pkg/errors"
+)
+
+// object stores of s3://, gs:// and az:// urls are accessed over https with
+// requests signed by credentials of the standard chain of each store. The
+// rest of the program sees plain http responses, so multi-part download
+// and resume work the same.
+
+// objectRequest returns copy of req to u, which object url of req maps
+// onto
+func objectRequest(req *http.Request, u string) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	target, err := r.URL.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	r.URL = target
+	r.Host = ""
+	return r, nil
+}
+
+// objectResponse makes resp look like response to req, as the rest of the
+// program knows only the object url. Object stores serve ranges of any
+// object, even if they don't say so.
+func objectResponse(req *http.Request, resp *http.Response) *http.Response {
+	resp.Request = req
+	if resp.StatusCode == http.StatusOK && resp.Header.Get("Accept-Ranges") == "" {
+		resp.Header.Set("Accept-Ranges", "bytes")
+	}
+	return resp
+}
+
+// splitObjectPath splits path of object url into the first segment and the
+// rest
+func splitObjectPath(p string) (string, string) {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.IndexByte(p, '/'); i != -1 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// credentialCache keeps credentials fetched from a chain, until they are
+// about to expire. Absence of credentials is cached too, as anonymous
+// access.
+type credentialCache struct {
+	mu      sync.Mutex
+	value   interface{}
+	expires time.Time // zero if value doesn't expire
+	fetch   func(ctx context.Context) (interface{}, time.Time, error)
+}
+
+func (c *credentialCache) get(ctx context.Context) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.value != nil && (c.expires.IsZero() || time.Until(c.expires) > 5*time.Minute) {
+		return c.value, nil
+	}
+	value, expires, err := c.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.value, c.expires = value, expires
+	return value, nil
+}
+
+// metadataClient is for instance metadata endpoints, which are link-local
+// and either answer at once or aren't there at all, so it's never proxied
+// and gives up quickly
+var metadataClient = &http.Client{
+	Transport: func() http.RoundTripper {
+		t := cleanhttp.DefaultTransport()
+		t.Proxy = nil
+		return t
+	}(),
+	Timeout: 2 * time.Second,
+}
+
+// errNoMetadata is absence of instance metadata endpoint, which isn't an
+// error for credential chain, that's just exhausted
+var errNoMetadata = errors.New("no instance metadata")
+
+// fetchJSON does req with client and decodes JSON response into v.
+// Connection failure of metadataClient is errNoMetadata.
+func fetchJSON(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		if client == metadataClient {
+			return errNoMetadata
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("%s %s: %s %s", req.Method, req.URL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// readINI reads section of ini file, as of ~/.aws/credentials, keys are
+// lowercase. Missing file or section is empty map.
+func readINI(fileName, section string) (map[string]string, error) {
+	values := make(map[string]string)
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var in bool
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			in = strings.TrimSpace(strings.Trim(line, "[]")) == section
+		case in:
+			if i := strings.IndexByte(line, '='); i != -1 {
+				values[strings.ToLower(strings.TrimSpace(line[:i]))] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return values, nil
+}
+
+// homeFile returns path of name in user's home directory
+func homeFile(name ...string) string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(append([]string{home}, name...)...)
+}
+
+func getenv(keys ...string) string {
+	for _, key := range keys {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -9,7 +9,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -20,42 +22,77 @@ import (
 )
 
 const (
-	bufSize = 1 << 12
+	minBufSize = 1 << 12 // page, which --buffer-size is multiple of
 )
 
 var (
 	ErrGiveUp  = errors.New("give up!")
 	ErrNilBody = errors.New("nil body")
+
+	errShortRead = errors.New("short read")
 )
 
 var globTry uint32
 
 // Part represents state of each download part
 type Part struct {
+	Location string
+	Fallback []string
 	FileName string
 	Start    int64
 	Stop     int64
 	Written  int64
 	Skip     bool
-	Elapsed  time.Duration
-
-	name      string
-	order     int
-	maxTry    int
-	curTry    uint32
-	quiet     bool
-	jar       http.CookieJar
-	transport *http.Transport
-	dlogger   *log.Logger
+	Elapsed  time.Duration // active transfer time
+	Waited   time.Duration // connecting, awaiting response and backoff
+	Checksum string        // hex sha256 of Written bytes, as of state save
+	Pieces   string        // hex bitfield of pieces done, from the one Start is in
+
+	name          string
+	order         int
+	maxTry        int
+	maxShortReads int
+	bufSize       int64 // of reads from response, see Cmd.bufSize
+	shortReads    int
+	curTry        uint32
+	retryAt       int64 // unix nano, until which Retry-After is waited for
+	maxRetryAfter time.Duration
+	quiet         bool
+	jar           http.CookieJar
+	transport     http.RoundTripper
+	limiter       *rateLimiter
+	hosts         *hostLimiter
+	pieces        *pieceVerifier
+	checked       int64 // bytes from Start, which pieces have been verified up to
+	reserve       bool
+	gate          *pauseGate
+	dlogger       *log.Logger
+	events        *eventLog
+	trace         *span // parent of attempt spans
+	responded     chan struct{}
+	respondOnce   sync.Once
+	totalLength   int64
+	encoding      string // Content-Encoding to decode, whole content at once
+	strictLength  bool
+	bar           *mpb.Bar
+	dropBar       bool // once complete
+	started       time.Time
+	startWritten  int64
+	mu            sync.Mutex // guards Stop and Written against workStealer
 }
 
 func (p *Part) makeBar(total int64, progress *mpb.Progress, gate msgGate) *mpb.Bar {
+	var drop mpb.BarOption
+	if p.dropBar {
+		drop = mpb.BarRemoveOnComplete()
+	}
 	bar := progress.AddBar(total,
+		drop,
 		mpb.TrimSpace(),
 		mpb.BarStyle(" =>- "),
 		mpb.BarPriority(p.order),
 		mpb.PrependDecorators(
-			newMainDecorator(&p.curTry, "%s %.1f", p.name, gate, decor.WCSyncWidthR),
+			newMainDecorator(&p.curTry, &p.retryAt, "%s %.1f", p.name, gate, decor.WCSyncWidthR),
 			decor.OnComplete(decor.NewPercentage("%.2f", decor.WCSyncSpace), "100%"),
 		),
 		mpb.AppendDecorators(
@@ -79,12 +116,21 @@ func (p *Part) makeBar(total int64, progress *mpb.Progress, gate msgGate) *mpb.B
 func (p *Part) download(ctx context.Context, progress *mpb.Progress, req *http.Request, timeout uint) (err error) {
 	var bar *mpb.Bar
 	defer func() {
+		if err == nil && bar != nil && !p.Skip {
+			// total might have been lowered by workStealer, so complete explicitly
+			bar.SetTotal(p.Stop-p.Start+1, true)
+		}
 		if err != nil {
-			if bar != nil && !p.isDone() && !p.quiet {
+			if bar != nil && !p.isDone() {
 				bar.Abort(false)
 			}
+			p.events.partError(p, err)
 			err = errors.WithMessage(err, p.name)
+		} else {
+			p.events.emit(event{Event: "done", Part: p.name, Written: p.Written})
 		}
+		// so parts waiting for their turn don't wait forever
+		p.markResponded()
 		p.dlogger.Printf("quit: %v", err)
 	}()
 
@@ -103,16 +149,58 @@ func (p *Part) download(ctx context.Context, progress *mpb.Progress, req *http.R
 		}
 	}()
 
+	// pieces written by previous session, but not verified yet
+	if _, err := p.verifyPieces(fpart); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
 	total := p.Stop - p.Start + 1
 	mg := newMsgGate(p.name, p.quiet)
 	bar = p.makeBar(total, progress, mg)
+	p.bar = bar
+	p.started = time.Now()
+	p.startWritten = p.Written
+	p.events.emit(event{Event: "start", Part: p.name, Start: p.Start, Stop: p.Stop, Written: p.Written})
+	p.mu.Unlock()
 	initialWritten := p.Written
+
+	if p.reserve {
+		if err := reserveSpace(fpart, p.Written, total-p.Written); err != nil {
+			if errors.Cause(err) == syscall.ENOSPC {
+				return err
+			}
+			p.dlogger.Printf("reserve space: %v", err)
+		}
+	}
+
+	// verify cuts bad piece off and reports it, so the try ends and the
+	// next one resumes from there
+	verify := func() error {
+		mismatch, err := p.verifyPieces(fpart)
+		if err != nil || !mismatch {
+			return err
+		}
+		if !p.quiet {
+			bar.SetCurrent(p.Written)
+		}
+		mg.flash(&message{msg: errPieceMismatch.Error()})
+		return errPieceMismatch
+	}
+
 	prefix := p.dlogger.Prefix()
 
+	var skipPause bool
+	var lastTryEnd time.Time
 	err = backoff.Retry(ctx,
-		exponential.New(exponential.WithBaseDelay(50*time.Millisecond)),
+		immediateStrategy{
+			Strategy: exponential.New(exponential.WithBaseDelay(50 * time.Millisecond)),
+			skip:     &skipPause,
+		},
 		time.Minute,
 		func(count int, now time.Time) (retry bool, err error) {
+			// continuations after short read don't count as retries
+			count -= p.shortReads
 			if count > p.maxTry {
 				return false, ErrGiveUp
 			}
@@ -123,15 +211,32 @@ func (p *Part) download(ctx context.Context, progress *mpb.Progress, req *http.R
 
 			p.dlogger.SetPrefix(fmt.Sprintf("%s[%02d] ", prefix, count))
 
-			req.Header.Set(hRange, p.getRange())
-			p.dlogger.Printf("GET %q", req.URL)
-			p.dlogger.Printf("%s: %s", hUserAgentKey, req.Header.Get(hUserAgentKey))
-			p.dlogger.Printf("%s: %s", hRange, req.Header.Get(hRange))
+			attempt := p.trace.child("part attempt")
+			attempt.set("part", p.name)
+			attempt.set("try", count)
+			defer func() {
+				attempt.set("written", p.Written)
+				attempt.end(err)
+			}()
 
+			if !lastTryEnd.IsZero() {
+				p.Waited += now.Sub(lastTryEnd)
+			}
 			defer func() {
-				p.Elapsed += time.Since(now)
+				lastTryEnd = time.Now()
 			}()
 
+			if p.encoding != "" {
+				// range of encoded content can't be decoded alone
+				req.Header.Del(hRange)
+			} else {
+				req.Header.Set(hRange, p.getRange())
+			}
+			p.dlogger.Printf("GET %q", req.URL)
+			p.dlogger.Printf("%s: %s", hUserAgentKey, req.Header.Get(hUserAgentKey))
+			p.dlogger.Printf("%s: %s", hRange, req.Header.Get(hRange))
+			attempt.set("http.range", req.Header.Get(hRange))
+
 			ctxTimeout := time.Duration(timeout) * time.Second
 			if count > 0 {
 				ctxTimeout = time.Duration((1<<uint(count-1))*timeout) * time.Second
@@ -141,11 +246,17 @@ func (p *Part) download(ctx context.Context, progress *mpb.Progress, req *http.R
 				atomic.AddUint32(&globTry, 1)
 				atomic.StoreUint32(&p.curTry, uint32(count))
 				mg.flash(&message{msg: "Retrying..."})
-			} else {
-				bar.DecoratorAverageAdjust(now)
+				p.events.emit(event{Event: "retry", Part: p.name, Try: count})
 			}
 			p.dlogger.Printf("ctxTimeout: %s", ctxTimeout)
 
+			// waiting for the host isn't covered by timeout
+			release, err := p.hosts.acquire(ctx, req.URL.Host)
+			if err != nil {
+				return false, err
+			}
+			defer release()
+
 			ctx, cancel := context.WithCancel(ctx)
 			defer cancel()
 			timer := time.AfterFunc(ctxTimeout, func() {
@@ -161,12 +272,25 @@ func (p *Part) download(ctx context.Context, progress *mpb.Progress, req *http.R
 				Jar:       p.jar,
 			}
 			resp, err := client.Do(req.WithContext(ctx))
+			p.markResponded()
+			p.Waited += time.Since(now)
 			if err != nil {
 				p.dlogger.Printf("client do: %s", err.Error())
+				if next := p.nextLocation(); next != nil {
+					next.User = req.URL.User
+					req.URL, req.Host = next, ""
+					mg.flash(&message{msg: "Fallback " + next.Scheme})
+					p.dlogger.Printf("falling back to: %q", p.Location)
+				}
 				return true, err
 			}
 
 			p.dlogger.Printf("resp.Status: %s", resp.Status)
+			attempt.set("http.status_code", resp.StatusCode)
+			p.dlogger.Printf("resp.Proto: %s", resp.Proto)
+			if resp.TLS != nil {
+				p.dlogger.Printf("TLS resumed: %t", resp.TLS.DidResume)
+			}
 			p.dlogger.Printf("resp.ContentLength: %d", resp.ContentLength)
 			if cookies := p.jar.Cookies(req.URL); len(cookies) != 0 {
 				p.dlogger.Println("CookieJar:")
@@ -177,17 +301,77 @@ func (p *Part) download(ctx context.Context, progress *mpb.Progress, req *http.R
 
 			switch resp.StatusCode {
 			case http.StatusOK: // no partial content, so download with single part
-				if p.order != 0 {
+				ranged := req.Header.Get(hRange) != ""
+				if v := req.Header.Get(hIfRange); ranged && v != "" && (p.Start != 0 || p.Written != 0) && !hasValidator(resp, v) {
+					// If-Range validator doesn't match, it's different content
+					resp.Body.Close()
+					return false, errors.WithStack(errRemoteChanged)
+				}
+				p.mu.Lock()
+				split := ranged && p.totalLength > 0 && (p.Start != 0 || p.Stop < p.totalLength-1)
+				p.mu.Unlock()
+				if split {
+					// the same content, but whole, other parts are no use
+					resp.Body.Close()
+					return false, errors.WithStack(errNoRanges)
+				}
+				if p.Start != 0 {
+					p.mu.Lock()
 					p.Skip = true
+					p.mu.Unlock()
 					bar.Abort(true)
 					p.dlogger.Print("no partial content, skipping...")
 					return false, nil
 				}
 				total = resp.ContentLength
+				if p.encoding != "" {
+					total = -1
+				}
+				if p.Written > 0 {
+					// whole content again, so drop what previous try wrote
+					if err := fpart.Truncate(0); err != nil {
+						resp.Body.Close()
+						return false, err
+					}
+					bar.SetCurrent(0)
+				}
 				bar.SetTotal(total, false)
+				p.mu.Lock()
 				p.Stop = total - 1
 				p.Written = 0
-			case http.StatusForbidden, http.StatusTooManyRequests:
+				p.mu.Unlock()
+			case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+				resp.Body.Close()
+				statusErr := newStatusError(resp)
+				if _, ok := parseRetryAfter(resp.Header.Get(hRetryAfter), now); !ok {
+					// no advice, backoff decides
+					mg.flash(&message{msg: resp.Status})
+					return true, errors.WithStack(statusErr)
+				}
+				if statusErr.RetryAfter > p.maxRetryAfter {
+					flushed := make(chan struct{})
+					mg.flash(&message{
+						msg:   resp.Status,
+						final: true,
+						done:  flushed,
+					})
+					<-flushed
+					return false, errors.Wrapf(statusErr, "retry after %s exceeds --max-retry-after", statusErr.RetryAfter)
+				}
+				p.dlogger.Printf("retry after: %s", statusErr.RetryAfter)
+				// waiting as asked isn't inactivity of the server
+				timer.Stop()
+				slept := time.Now()
+				atomic.StoreInt64(&p.retryAt, slept.Add(statusErr.RetryAfter).UnixNano())
+				err := sleepContext(ctx, statusErr.RetryAfter)
+				atomic.StoreInt64(&p.retryAt, 0)
+				p.Waited += time.Since(slept)
+				if err != nil {
+					return false, err
+				}
+				skipPause = true
+				return true, errors.WithStack(statusErr)
+			case http.StatusForbidden:
 				flushed := make(chan struct{})
 				mg.flash(&message{
 					msg:   resp.Status,
@@ -198,18 +382,41 @@ func (p *Part) download(ctx context.Context, progress *mpb.Progress, req *http.R
 				fallthrough
 			default:
 				if resp.StatusCode != http.StatusPartialContent {
-					return false, errors.Errorf("unexpected status: %s", resp.Status)
+					return false, errors.WithStack(newStatusError(resp))
+				}
+			}
+
+			if err := p.checkLength(req, resp); err != nil {
+				if p.strictLength {
+					resp.Body.Close()
+					return false, err
 				}
+				p.dlogger.Printf("length mismatch: %v", err)
+				mg.flash(&message{msg: "Length mismatch"})
 			}
 
+			active := time.Now()
+			defer func() {
+				p.Elapsed += time.Since(active)
+			}()
+
 			body := resp.Body
+			if encoding := resp.Header.Get(hContentEncoding); p.encoding != "" && encoding != "" {
+				p.dlogger.Printf("decoding %s", encoding)
+				if body, err = newDecoder(encoding, resp.Body); err != nil {
+					resp.Body.Close()
+					return true, err
+				}
+			}
 			if !p.quiet {
-				body = bar.ProxyReader(resp.Body)
+				body = bar.ProxyReader(body)
+				// average is over active time only, so waits between
+				// tries and sessions don't skew it
+				bar.DecoratorAverageAdjust(active.Add(-p.Elapsed))
 				if p.Written > 0 {
 					p.dlogger.Printf("bar refill written: %d", p.Written)
 					bar.SetRefill(p.Written)
 					if p.Written-initialWritten == 0 {
-						bar.DecoratorAverageAdjust(time.Now().Add(-p.Elapsed))
 						bar.IncrInt64(p.Written)
 					}
 				}
@@ -222,7 +429,7 @@ func (p *Part) download(ctx context.Context, progress *mpb.Progress, req *http.R
 			defer body.Close()
 
 			pWrittenSnap := p.Written
-			buf, max := bytes.NewBuffer(make([]byte, 0, bufSize)), int64(bufSize)
+			buf, max := bytes.NewBuffer(make([]byte, 0, p.bufSize)), p.bufSize
 			var n int64
 			for timer.Reset(ctxTimeout) {
 				n, err = io.CopyN(buf, body, max)
@@ -239,24 +446,68 @@ func (p *Part) download(ctx context.Context, progress *mpb.Progress, req *http.R
 					}
 					break
 				}
-				n, _ = io.Copy(fpart, buf)
-				p.Written += n
+				done, e := p.write(fpart, buf, total > 0)
+				if e != nil {
+					// e.g. disk is full, retry won't help
+					return false, e
+				}
+				if err = verify(); err != nil || done {
+					break
+				}
+				if p.gate.isPaused() {
+					timer.Stop()
+					d, e := p.gate.wait(ctx)
+					// paused time is neither active nor waiting
+					active = active.Add(d)
+					timer.Reset(ctxTimeout)
+					if e != nil {
+						err = e
+						break
+					}
+				}
+				if d := p.limiter.reserve(n); d > 0 {
+					// waiting for the limiter isn't inactivity of the server
+					timer.Reset(ctxTimeout + d)
+					if err = sleepContext(ctx, d); err != nil {
+						break
+					}
+				}
 				if total <= 0 && !p.quiet {
 					bar.SetTotal(p.Written+max*2, false)
 				}
-				max = bufSize
+				max = p.bufSize
 			}
 
-			n, _ = io.Copy(fpart, buf)
-			p.Written += n
+			if _, e := p.write(fpart, buf, total > 0); e != nil {
+				return false, e
+			}
 			p.dlogger.Printf("total written: %d", p.Written-pWrittenSnap)
+			if e := verify(); e != nil {
+				return true, e
+			}
 			if total <= 0 {
+				p.mu.Lock()
 				p.Stop = p.Written - 1
+				p.mu.Unlock()
 			}
 
+			if (err == io.EOF || err == io.ErrUnexpectedEOF) && total > 0 && !p.isDone() {
+				// server closed response before the range end, some
+				// CDNs cap response size, so just continue from here
+				if p.shortReads < p.maxShortReads {
+					p.shortReads++
+					skipPause = true
+					p.dlogger.Printf("short read %d of %d, continuing", p.shortReads, p.maxShortReads)
+				}
+				return true, errShortRead
+			}
 			if err == io.EOF {
 				return false, nil
 			}
+			if err != nil && p.encoding != "" {
+				// truncated encoded content, nothing to continue from
+				return true, err
+			}
 			return !p.isDone(), err
 		})
 
@@ -273,13 +524,69 @@ func (p *Part) download(ctx context.Context, progress *mpb.Progress, req *http.R
 	return err
 }
 
-func (p Part) getRange() string {
+// immediateStrategy is backoff strategy, which doesn't pause once, after
+// skip is set
+type immediateStrategy struct {
+	backoff.Strategy
+	skip *bool
+}
+
+func (s immediateStrategy) Pause(attempt int) time.Duration {
+	if *s.skip {
+		*s.skip = false
+		return 0
+	}
+	return s.Strategy.Pause(attempt)
+}
+
+// nextLocation rotates Location with the first of Fallback urls
+func (p *Part) nextLocation() *url.URL {
+	for len(p.Fallback) != 0 {
+		next := p.Fallback[0]
+		p.Fallback = append(p.Fallback[1:], p.Location)
+		p.Location = next
+		if u, err := url.Parse(next); err == nil {
+			return u
+		}
+	}
+	return nil
+}
+
+// write flushes buf into dst. If bounded is true, bytes beyond p.Stop
+// are discarded, as p.Stop may be lowered by workStealer in the middle
+// of transfer. Returns true if the part is done.
+func (p *Part) write(dst io.Writer, buf *bytes.Buffer, bounded bool) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if bounded {
+		if remaining := p.Stop - p.Start - p.Written + 1; int64(buf.Len()) > remaining {
+			buf.Truncate(int(remaining))
+		}
+	}
+	n, err := io.Copy(dst, buf)
+	p.Written += n
+	return bounded && p.Written > p.Stop-p.Start, err
+}
+
+func (p *Part) getRange() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if p.Stop <= 0 {
 		return "bytes=0-"
 	}
 	return fmt.Sprintf("bytes=%d-%d", p.Start+p.Written, p.Stop)
 }
 
-func (p Part) isDone() bool {
+func (p *Part) isDone() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.Skip || p.Written > p.Stop-p.Start
 }
+
+// markResponded closes responded, if any, on the first response or quit,
+// so the next part of --part-order may start
+func (p *Part) markResponded() {
+	if p.responded != nil {
+		p.respondOnce.Do(func() { close(p.responded) })
+	}
+}
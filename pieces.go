@@ -0,0 +1,156 @@
+package getparty
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// defaultPieceLength is length of pieces of Part.Pieces bitfield, if
+// session has no piece hashes of its own
+const defaultPieceLength = 1 << 20
+
+var errPieceMismatch = errors.New("piece doesn't match its hash")
+
+// pieceVerifier holds piece hashes, which parts check their pieces against
+// as soon as they are written. Nil *pieceVerifier checks nothing.
+type pieceVerifier struct {
+	length int64
+	hashes []byte // concatenated SHA-1 of every piece
+}
+
+// newPieceVerifier returns verifier of session's piece hashes, nil if
+// there are none or content isn't written as is
+func (s Session) newPieceVerifier() *pieceVerifier {
+	if s.PieceHashes == "" || s.PieceLength <= 0 || s.ContentLength <= 0 ||
+		s.ContentEncoding != "" || s.SplitPieces != 0 {
+		return nil
+	}
+	hashes, err := hex.DecodeString(s.PieceHashes)
+	if err != nil {
+		return nil
+	}
+	return &pieceVerifier{length: s.PieceLength, hashes: hashes}
+}
+
+// pieceLength returns length of pieces, progress of parts is tracked in
+func (s Session) pieceLength() int64 {
+	if s.PieceLength > 0 {
+		return s.PieceLength
+	}
+	return defaultPieceLength
+}
+
+// pieceBitfield returns hex bitfield of pieces, which share of the part is
+// written completely, starting from the piece Start is in. With verified,
+// pieces lying within the part count only once they have been checked
+// against their hashes.
+func (p *Part) pieceBitfield(length, total int64, verified bool) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Skip || p.Written == 0 || total <= 0 {
+		return ""
+	}
+	first, last := p.Start/length, p.Stop/length
+	bits := make([]byte, (last-first)/8+1)
+	for i := first; i <= last; i++ {
+		start, end := i*length, (i+1)*length
+		if end > total {
+			end = total
+		}
+		shareEnd := end
+		if shareEnd > p.Stop+1 {
+			shareEnd = p.Stop + 1
+		}
+		if p.Start+p.Written < shareEnd {
+			break
+		}
+		if verified && start >= p.Start && end <= p.Stop+1 && end > p.Start+p.checked {
+			break
+		}
+		bits[(i-first)/8] |= 0x80 >> uint((i-first)%8)
+	}
+	return hex.EncodeToString(bits)
+}
+
+// initChecked sets how far pieces of the part are known to match their
+// hashes, from the recorded bitfield. Bytes before the first piece, which
+// lies within the part, can't be checked by the part alone, so they are
+// skipped.
+func (p *Part) initChecked(length, total int64) {
+	p.checked = (p.Start+length-1)/length*length - p.Start
+	bits, err := hex.DecodeString(p.Pieces)
+	if err != nil {
+		return
+	}
+	first := p.Start / length
+	for i := (p.Start + p.checked) / length; ; i++ {
+		if n := i - first; n/8 >= int64(len(bits)) || bits[n/8]&(0x80>>uint(n%8)) == 0 {
+			return
+		}
+		end := (i + 1) * length
+		if end > total {
+			end = total
+		}
+		if end > p.Start+p.Written || end > p.Stop+1 {
+			return
+		}
+		p.checked = end - p.Start
+	}
+}
+
+// verifyPieces checks pieces within the part, which have been written
+// completely since the last call, against their hashes. Written is cut
+// back to the start of the first one, which doesn't match, so only that
+// piece is downloaded again.
+func (p *Part) verifyPieces(fpart *os.File) (mismatch bool, err error) {
+	v := p.pieces
+	if v == nil {
+		return false, nil
+	}
+	for {
+		p.mu.Lock()
+		start, stop, written := p.Start+p.checked, p.Stop, p.Written
+		p.mu.Unlock()
+		end := start + v.length
+		if end > p.totalLength {
+			end = p.totalLength
+		}
+		if end <= start || end > stop+1 || end > p.Start+written {
+			return false, nil
+		}
+		i := start / v.length
+		sum, err := sumRange(p.FileName, start-p.Start, end-start)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(sum, v.hashes[i*sha1.Size:(i+1)*sha1.Size]) {
+			p.dlogger.Printf("piece %d doesn't match its hash, resuming from %d", i, start-p.Start)
+			p.mu.Lock()
+			p.Written = start - p.Start
+			p.mu.Unlock()
+			return true, fpart.Truncate(start - p.Start)
+		}
+		p.mu.Lock()
+		p.checked = end - p.Start
+		p.mu.Unlock()
+	}
+}
+
+// sumRange returns SHA-1 of n bytes of file at off
+func sumRange(fileName string, off, n int64) ([]byte, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, off, n)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
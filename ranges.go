@@ -0,0 +1,89 @@
+package getparty
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// errNoRanges is 200 response of the server to range request of a split
+// session, so the whole session falls back to a single part
+var errNoRanges = errors.New("server ignores byte ranges")
+
+// probeRanges finds out whether server honours byte ranges, by requesting
+// the last byte before splitting. Some servers advertise Accept-Ranges, but
+// respond with the whole content, others support ranges without advertising
+// them. The latter are probed with --force-parts only. If the probe fails,
+// advertised support is trusted, or assumed with --force-parts.
+func (cmd Cmd) probeRanges(ctx context.Context, jar http.CookieJar, s *Session) bool {
+	advertised := s.isAcceptRanges()
+	if !advertised && !cmd.options.ForceParts {
+		return false
+	}
+	u, err := url.Parse(s.Location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		// other protocols serve ranges as asked
+		return advertised
+	}
+	guess := advertised || cmd.options.ForceParts
+	req, err := http.NewRequest(http.MethodGet, s.Location, nil)
+	if err != nil {
+		cmd.dlogger.Printf("probe ranges: %v", err)
+		return guess
+	}
+	req.URL.User = cmd.userInfo
+	req.Header = s.partHeader()
+	req.Header.Set(hRange, fmt.Sprintf("bytes=%d-%[1]d", s.ContentLength-1))
+	cmd.dlogger.Printf("probe ranges: GET %q %s", s.Location, req.Header.Get(hRange))
+	client := cmd.newClient(true, jar)
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cmd.dlogger.Printf("probe ranges: %v", err)
+		return guess
+	}
+	// the whole content may follow, which isn't wanted
+	resp.Body.Close()
+	cmd.dlogger.Printf("probe ranges: %s", resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		if !advertised {
+			cmd.logger.Print(cmd.msgs.T("server supports byte ranges without advertising them"))
+		}
+		return true
+	case resp.StatusCode == http.StatusOK:
+		if advertised {
+			cmd.logger.Print(cmd.msgs.T("server ignores advertised byte ranges, using single part"))
+		}
+		return false
+	}
+	return guess
+}
+
+// singlePart turns split session, which server has turned out to ignore
+// byte ranges, into a single part one. What the first part has written is
+// kept, though server is likely to send it again.
+func (s *Session) singlePart() error {
+	p0 := s.Parts[0]
+	for _, p := range s.Parts[1:] {
+		if err := os.Remove(p.FileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if p0.Start != 0 {
+		if err := os.Remove(p0.FileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.Parts = s.calcParts(1)
+	} else {
+		p0.Stop = s.ContentLength - 1
+		p0.Skip = false
+		s.Parts = s.Parts[:1]
+	}
+	s.AcceptRanges = ""
+	return nil
+}
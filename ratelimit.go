@@ -0,0 +1,65 @@
+package getparty
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter caps aggregate speed of all parts. Rate can be changed on
+// the fly, zero rate doesn't limit anything, nor does nil *rateLimiter.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64   // bytes per second
+	next time.Time // when bytes read so far are due at the rate
+}
+
+func newRateLimiter(rate ByteSize) *rateLimiter {
+	return &rateLimiter{rate: float64(rate)}
+}
+
+func (l *rateLimiter) getRate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *rateLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.next = time.Time{}
+}
+
+// reserve accounts n bytes read, returning how long to wait, before they
+// fit into the rate
+func (l *rateLimiter) reserve(n int64) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return 0
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		// idle time isn't saved up for a burst
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	return d
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
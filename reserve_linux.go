@@ -0,0 +1,18 @@
+package getparty
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize allocates blocks without changing file size, so appends
+// keep working
+const fallocKeepSize = 0x01
+
+// reserveSpace allocates disk blocks for size bytes of f past its offset
+func reserveSpace(f *os.File, offset, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, offset, size)
+}
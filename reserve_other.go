@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package getparty
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func reserveSpace(*os.File, int64, int64) error {
+	return errors.New("space reservation isn't supported on this system")
+}
@@ -0,0 +1,213 @@
+package getparty
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// checkParts reconciles recorded Written of each part with actual size of
+// its file. Shorter file means lost data, so Written is lowered. Longer file
+// has unaccounted bytes at the tail, which are cut off. Part, which doesn't
+// match its recorded checksum, is restarted, unless there are piece hashes
+// to find out which of its pieces are bad.
+func (cmd Cmd) checkParts(s *Session) error {
+	for _, p := range s.Parts {
+		if p.Skip {
+			continue
+		}
+		var size int64
+		fi, err := os.Stat(p.FileName)
+		switch {
+		case err == nil:
+			size = fi.Size()
+		case !os.IsNotExist(err):
+			return err
+		}
+		recorded := p.Written
+		switch {
+		case size < p.Written:
+			cmd.logger.Printf(cmd.msgs.T("%q is shorter than recorded: %d < %d, resuming from %[2]d"), p.FileName, size, p.Written)
+			p.Written = size
+		case size > p.Written:
+			cmd.logger.Printf(cmd.msgs.T("%q is longer than recorded: %d > %d, truncating"), p.FileName, size, p.Written)
+			if err := os.Truncate(p.FileName, p.Written); err != nil {
+				return err
+			}
+		}
+		if p.Checksum == "" || size < recorded {
+			// nothing to verify against
+			continue
+		}
+		sum, err := sumPart(p.FileName, p.Written)
+		if err != nil {
+			return err
+		}
+		if sum != p.Checksum && s.newPieceVerifier() != nil {
+			// pieces tell bad bytes from good, once the part is started
+			cmd.logger.Printf(cmd.msgs.T("%q doesn't match its checksum, verifying its pieces"), p.FileName)
+			p.Pieces = ""
+			continue
+		}
+		if sum != p.Checksum {
+			cmd.logger.Printf(cmd.msgs.T("%q doesn't match its checksum, restarting part"), p.FileName)
+			if err := os.Truncate(p.FileName, 0); err != nil {
+				return err
+			}
+			p.Written = 0
+		}
+	}
+	return nil
+}
+
+// verifyTails fetches last window bytes of every part from the server and
+// compares them with ones on disk. Part which doesn't match is restarted.
+func (cmd Cmd) verifyTails(ctx context.Context, jar http.CookieJar, s *Session, window int64) (err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "verifyTails")
+	}()
+	client := cmd.newClient(true, jar)
+	defer client.CloseIdleConnections()
+
+	for _, p := range s.Parts {
+		if p.Skip || p.Written == 0 {
+			continue
+		}
+		n := window
+		if n > p.Written {
+			n = p.Written
+		}
+		location := s.Location
+		if p.Location != "" {
+			location = p.Location
+		}
+		remote, err := cmd.fetchWindow(ctx, client, location, p.Start+p.Written-n, n)
+		if err != nil {
+			return err
+		}
+		local := make([]byte, n)
+		fd, err := os.Open(p.FileName)
+		if err != nil {
+			return err
+		}
+		_, err = fd.ReadAt(local, p.Written-n)
+		if e := fd.Close(); err == nil {
+			err = e
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if !bytes.Equal(local, remote) {
+			cmd.logger.Printf(cmd.msgs.T("%q tail doesn't match remote, restarting part"), p.FileName)
+			p.Written = 0
+			if err := os.Truncate(p.FileName, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// appendExisting treats existing output file as downloaded prefix of the
+// content, so only the rest is requested. Returns false if there is no
+// file to append to.
+func (cmd Cmd) appendExisting(s *Session) (bool, error) {
+	fi, err := os.Stat(s.SuggestedFileName)
+	if err != nil || fi.Size() == 0 {
+		return false, nil
+	}
+	switch {
+	case s.SplitPieces != 0:
+		return false, ExpectedError{errors.New("append: not supported with split pieces")}
+	case s.ContentLength <= 0 || !s.isAcceptRanges():
+		return false, ExpectedError{errors.Errorf("append: %q: server doesn't support byte ranges or length is unknown", s.SuggestedFileName)}
+	case fi.Size() > s.ContentLength:
+		return false, ExpectedError{errors.Errorf("append: %q is longer than remote: %d > %d", s.SuggestedFileName, fi.Size(), s.ContentLength)}
+	}
+	cmd.logger.Printf(cmd.msgs.T("appending to %q, %d bytes already there"), s.SuggestedFileName, fi.Size())
+	s.Parts = s.appendParts(int64(cmd.options.Parts), fi.Size())
+	return true, nil
+}
+
+// findSession returns state of unfinished download of s, left by earlier
+// run without -c, along with its file name. It's nil, unless state file
+// loads, is of the same content and some of its part files exist.
+func (cmd Cmd) findSession(s *Session) (*Session, string) {
+	stateName := findStateFile(s.SuggestedFileName)
+	if stateName == "" {
+		return nil, ""
+	}
+	found := new(Session)
+	if err := found.loadState(stateName); err != nil {
+		if !os.IsNotExist(err) {
+			cmd.dlogger.Printf("findSession: %q: %v", stateName, err)
+		}
+		return nil, ""
+	}
+	if found.SuggestedFileName != s.SuggestedFileName ||
+		found.ContentLength != s.ContentLength ||
+		found.ContentMD5 != s.ContentMD5 ||
+		found.SplitPieces != s.SplitPieces {
+		cmd.dlogger.Printf("findSession: %q is of different content", stateName)
+		return nil, ""
+	}
+	for _, p := range found.Parts {
+		if p.Skip {
+			continue
+		}
+		if _, err := os.Stat(p.FileName); err == nil {
+			return found, stateName
+		}
+	}
+	return nil, ""
+}
+
+// changedFrom describes how remote content of s differs from one of last
+// session, empty if it doesn't. Validators missing in either session aren't
+// compared, state of older versions has none.
+func (s Session) changedFrom(last *Session) string {
+	switch {
+	case s.ContentMD5 != last.ContentMD5:
+		return fmt.Sprintf("ContentMD5 %q, expected %q", s.ContentMD5, last.ContentMD5)
+	case s.ContentLength != last.ContentLength:
+		return fmt.Sprintf("ContentLength %d, expected %d", s.ContentLength, last.ContentLength)
+	case s.ETag != "" && last.ETag != "" && weakETag(s.ETag) != weakETag(last.ETag):
+		return fmt.Sprintf("%s %s, expected %s", hETag, s.ETag, last.ETag)
+	case s.LastModified != "" && last.LastModified != "" && s.LastModified != last.LastModified:
+		return fmt.Sprintf("%s %q, expected %q", hLastModified, s.LastModified, last.LastModified)
+	}
+	return ""
+}
+
+// ifRange returns If-Range validator of parts, so server, which content has
+// changed since, responds with the whole new content instead of a range of
+// it. Only strong ETag may be used there.
+func (s Session) ifRange() string {
+	if s.ETag != "" && !strings.HasPrefix(s.ETag, "W/") {
+		return s.ETag
+	}
+	return s.LastModified
+}
+
+// hasValidator reports whether resp is of the content, which If-Range
+// validator v is of, so its 200 is of ignored range rather than of changed
+// content
+func hasValidator(resp *http.Response, v string) bool {
+	if strings.HasPrefix(v, `"`) {
+		return weakETag(resp.Header.Get(hETag)) == v
+	}
+	return resp.Header.Get(hLastModified) == v
+}
+
+// weakETag strips weakness indicator, as compression by proxy or CDN may
+// turn strong ETag into weak one of the same content
+func weakETag(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
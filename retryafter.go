@@ -0,0 +1,48 @@
+package getparty
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const hRetryAfter = "Retry-After"
+
+// newStatusError returns StatusError of resp, with Retry-After advice of
+// 429 and 503 responses
+func newStatusError(resp *http.Response) StatusError {
+	e := StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		e.RetryAfter, _ = parseRetryAfter(resp.Header.Get(hRetryAfter), time.Now())
+	}
+	return e
+}
+
+// parseRetryAfter parses Retry-After of either delay seconds or http date
+// form, relative to now. Date in the past is zero wait.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		if secs > int64(math.MaxInt64/time.Second) {
+			return math.MaxInt64, true
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
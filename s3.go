@@ -0,0 +1,278 @@
+package getparty
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	awsMetadataHost  = "http://169.254.169.254"
+	awsContainerHost = "http://169.254.170.2"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// s3RoundTripper maps s3://bucket/key onto GET of the object, signed with
+// AWS Signature Version 4. Credentials are looked up like AWS CLI does:
+// environment, shared credentials file, container and instance role.
+// Without any, request goes unsigned, which is fine for public buckets.
+type s3RoundTripper struct {
+	base  http.RoundTripper
+	creds *credentialCache
+}
+
+func newS3RoundTripper(base http.RoundTripper) s3RoundTripper {
+	return s3RoundTripper{
+		base:  base,
+		creds: &credentialCache{fetch: fetchAWSCredentials},
+	}
+}
+
+func (rt s3RoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	defer func() {
+		err = errors.WithMessage(err, "s3")
+	}()
+	bucket, key := req.URL.Host, strings.TrimPrefix(req.URL.Path, "/")
+	region := awsRegion()
+	path := "/" + awsEscape(key, false)
+	endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region)
+	if custom := getenv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); custom != "" {
+		endpoint = strings.TrimSuffix(custom, "/")
+		path = "/" + bucket + path
+	} else if strings.Contains(bucket, ".") {
+		// virtual-hosted name wouldn't match the certificate
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+		path = "/" + bucket + path
+	}
+	query := awsCanonicalQuery(req.URL.Query())
+	target := endpoint + path
+	if query != "" {
+		target += "?" + query
+	}
+	r, err := objectRequest(req, target)
+	if err != nil {
+		return nil, err
+	}
+	v, err := rt.creds.get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	if creds := v.(*awsCredentials); creds.AccessKeyId != "" {
+		signS3(r, creds, region, time.Now())
+	}
+	resp, err = rt.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	return objectResponse(req, resp), nil
+}
+
+// signS3 adds Signature Version 4 headers to req. Only host and x-amz-*
+// headers are signed, so Range and the like may be set by proxies and
+// retries freely.
+func signS3(req *http.Request, creds *awsCredentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyId, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape escapes s the way Signature Version 4 expects: everything, but
+// unreserved characters, and slash, unless it's query
+func awsEscape(s string, query bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !query:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsCanonicalQuery returns query sorted and escaped, so it's both sent and
+// signed as is, e.g. versionId of the object
+func awsCanonicalQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func awsProfile() string {
+	if profile := getenv("AWS_PROFILE", "AWS_DEFAULT_PROFILE"); profile != "" {
+		return profile
+	}
+	return "default"
+}
+
+// awsRegion returns region of environment or of ~/.aws/config profile,
+// us-east-1 by default
+func awsRegion() string {
+	if region := getenv("AWS_REGION", "AWS_DEFAULT_REGION"); region != "" {
+		return region
+	}
+	fileName := getenv("AWS_CONFIG_FILE")
+	if fileName == "" {
+		fileName = homeFile(".aws", "config")
+	}
+	section := "profile " + awsProfile()
+	if awsProfile() == "default" {
+		section = "default"
+	}
+	if config, _ := readINI(fileName, section); config["region"] != "" {
+		return config["region"]
+	}
+	return "us-east-1"
+}
+
+// fetchAWSCredentials walks the credential chain. Empty credentials mean
+// anonymous access.
+func fetchAWSCredentials(ctx context.Context) (interface{}, time.Time, error) {
+	if id, secret := getenv("AWS_ACCESS_KEY_ID"), getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &awsCredentials{AccessKeyId: id, SecretAccessKey: secret, Token: getenv("AWS_SESSION_TOKEN")}, time.Time{}, nil
+	}
+	fileName := getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if fileName == "" {
+		fileName = homeFile(".aws", "credentials")
+	}
+	shared, err := readINI(fileName, awsProfile())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if shared["aws_access_key_id"] != "" {
+		return &awsCredentials{
+			AccessKeyId:     shared["aws_access_key_id"],
+			SecretAccessKey: shared["aws_secret_access_key"],
+			Token:           shared["aws_session_token"],
+		}, time.Time{}, nil
+	}
+	creds := new(awsCredentials)
+	if uri := getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, awsContainerHost+uri, nil)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		err = fetchJSON(metadataClient, req, creds)
+		return creds, creds.Expiration, err
+	}
+	if strings.EqualFold(getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return creds, time.Time{}, nil
+	}
+	err = fetchInstanceCredentials(ctx, creds)
+	if err == errNoMetadata {
+		return creds, time.Time{}, nil
+	}
+	return creds, creds.Expiration, err
+}
+
+// fetchInstanceCredentials gets credentials of EC2 instance role with
+// IMDSv2 session token
+func fetchInstanceCredentials(ctx context.Context, creds *awsCredentials) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, awsMetadataHost+"/latest/api/token", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return errNoMetadata
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return errNoMetadata
+	}
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, awsMetadataHost+path, nil)
+		if err == nil {
+			req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+		}
+		return req, err
+	}
+	req, err = get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return err
+	}
+	resp, err = metadataClient.Do(req)
+	if err != nil {
+		return errNoMetadata
+	}
+	role, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		// instance without role
+		return errNoMetadata
+	}
+	req, err = get("/latest/meta-data/iam/security-credentials/" + strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0]))
+	if err != nil {
+		return err
+	}
+	return fetchJSON(metadataClient, req, creds)
+}
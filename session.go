@@ -1,38 +1,88 @@
 package getparty
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/vbauerster/mpb/v5"
 	"github.com/vbauerster/mpb/v5/decor"
 )
 
 const (
 	acceptRangesType = "bytes"
+	// stateVersion 2 has validators and checksums of parts, unversioned
+	// state is version 1
+	stateVersion = 2
 )
 
 // Session represents download session state
 type Session struct {
+	Version           int
 	Location          string
 	SuggestedFileName string
 	ContentMD5        string
+	ContentSHA1       string // of zsync control file, verified when done
+	PieceLength       int64
+	PieceHashes       string // of torrent, hex SHA-1 of every PieceLength bytes, verified when done
 	AcceptRanges      string
 	StatusCode        int
 	ContentLength     int64
 	ContentType       string
+	LastModified      string
+	ETag              string
+	ContentEncoding   string // decoded on the fly, with --compressed
 	HeaderMap         map[string]string
+	Header            http.Header // effective header of parts, replayed on resume
+	SplitPieces       int
+	Hops              []Hop // responses, which led to Location
 	Parts             []*Part
 }
 
+// Hop is a response of redirect chain, the final one included
+type Hop struct {
+	URL        string
+	Status     int
+	SetCookies []string      `json:",omitempty"`
+	FileName   string        `json:",omitempty"` // of Content-Disposition
+	Elapsed    time.Duration // until response headers
+}
+
+// partHeader returns copy of s.Header for part request. Cookie is left out,
+// jar adds it, having been seeded from s.Header.
+func (s Session) partHeader() http.Header {
+	header := s.Header.Clone()
+	header.Del(hCookie)
+	return header
+}
+
 func (s Session) isAcceptRanges() bool {
 	return strings.EqualFold(s.AcceptRanges, acceptRangesType)
 }
 
+// maxParts returns max number of parts, length can be split into, so each
+// part is at least minSize. It's never less than 1.
+func maxParts(length, minSize int64) int64 {
+	if minSize <= 0 || length <= 0 {
+		return math.MaxInt32
+	}
+	if max := length / minSize; max > 1 {
+		return max
+	}
+	return 1
+}
+
 func (s Session) calcParts(parts int64) []*Part {
 	var partSize int64
 	if s.ContentLength <= 0 {
@@ -60,6 +110,10 @@ func (s Session) calcParts(parts int64) []*Part {
 
 	stop = start - 1
 	if stop < parts*8 {
+		// too small to split, the first part is the whole content
+		if s.ContentLength > 0 {
+			ps[0].Stop = s.ContentLength - 1
+		}
 		return ps[:1]
 	}
 
@@ -67,15 +121,129 @@ func (s Session) calcParts(parts int64) []*Part {
 	return ps
 }
 
-func (s Session) concatenateParts(dlogger *log.Logger, progress *mpb.Progress) (err error) {
+// calcChunks is like calcParts, but parts are of size, except the last
+// one, which gets the rest
+func (s Session) calcChunks(size int64) []*Part {
+	if s.ContentLength <= size {
+		return s.calcParts(1)
+	}
+	n := (s.ContentLength + size - 1) / size
+	ps := make([]*Part, n)
+	for i := range ps {
+		ps[i] = &Part{
+			FileName: fmt.Sprintf("%s.part%d", s.SuggestedFileName, i),
+			Start:    int64(i) * size,
+			Stop:     int64(i+1)*size - 1,
+		}
+	}
+	ps[0].FileName = s.SuggestedFileName
+	ps[n-1].Stop = s.ContentLength - 1
+	return ps
+}
+
+// appendParts is like calcParts, but content up to written is already in
+// the output file, so it becomes Written of the first part and the rest is
+// split as usual.
+func (s Session) appendParts(parts int64, written int64) []*Part {
+	if written >= s.ContentLength {
+		return []*Part{{
+			FileName: s.SuggestedFileName,
+			Stop:     s.ContentLength - 1,
+			Written:  s.ContentLength,
+		}}
+	}
+	rest := s
+	rest.ContentLength -= written
+	ps := rest.calcParts(parts)
+	for i, p := range ps {
+		if i != 0 {
+			p.Start += written
+		}
+		p.Stop += written
+	}
+	ps[0].Written = written
+	return ps
+}
+
+// orderParts returns parts in order of --part-order: tail-first is useful
+// for media files with index at the end, random spreads load over CDN
+// shards other way than sequential does.
+func orderParts(parts []*Part, order string) []*Part {
+	ordered := append([]*Part(nil), parts...)
+	switch order {
+	case "tail-first":
+		for i, k := 0, len(ordered)-1; i < k; i, k = i+1, k-1 {
+			ordered[i], ordered[k] = ordered[k], ordered[i]
+		}
+	case "random":
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		rnd.Shuffle(len(ordered), func(i, k int) {
+			ordered[i], ordered[k] = ordered[k], ordered[i]
+		})
+	}
+	return ordered
+}
+
+// coalesceParts merges parts, which haven't been started yet, into the
+// preceding one, while its remainder is less than minSize, and the last
+// part too, if it's less than minSize itself. So uneven division or fine
+// grained stealing don't waste requests and bars on trivial ranges.
+// Number of merged parts is returned.
+func (s *Session) coalesceParts(minSize int64) (merged int, err error) {
+	if minSize <= 0 || s.SplitPieces != 0 || len(s.Parts) <= 1 {
+		return 0, nil
+	}
+	mergeable := func(prev, cur *Part) bool {
+		return !prev.Skip && !cur.Skip && cur.Written == 0 &&
+			prev.Stop+1 == cur.Start && prev.Location == cur.Location
+	}
+	merge := func(prev, cur *Part) error {
+		prev.Stop = cur.Stop
+		merged++
+		if e := os.Remove(cur.FileName); !os.IsNotExist(e) {
+			return e
+		}
+		return nil
+	}
+	parts := s.Parts[:1]
+	for _, cur := range s.Parts[1:] {
+		prev := parts[len(parts)-1]
+		if prev.Stop-prev.Start+1-prev.Written < minSize && mergeable(prev, cur) {
+			if err := merge(prev, cur); err != nil {
+				return merged, err
+			}
+			continue
+		}
+		parts = append(parts, cur)
+	}
+	if n := len(parts); n > 1 {
+		prev, last := parts[n-2], parts[n-1]
+		if last.Stop-last.Start+1 < minSize && mergeable(prev, last) {
+			if err := merge(prev, last); err != nil {
+				return merged, err
+			}
+			parts = parts[:n-1]
+		}
+	}
+	s.Parts = parts
+	return merged, nil
+}
+
+func (s Session) concatenateParts(dlogger *log.Logger, progress *mpb.Progress, bufSize int) (err error) {
 	if len(s.Parts) <= 1 {
 		return nil
 	}
 
-	fpart0, err := os.OpenFile(s.Parts[0].FileName, os.O_APPEND|os.O_WRONLY, 0644)
+	// not O_APPEND, which copy_file_range and sendfile refuse
+	fpart0, err := os.OpenFile(s.Parts[0].FileName, os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
+	if _, err := fpart0.Seek(0, io.SeekEnd); err != nil {
+		fpart0.Close()
+		return err
+	}
+	buf := make([]byte, bufSize)
 
 	bar := progress.AddBar(int64(len(s.Parts)-1),
 		mpb.TrimSpace(),
@@ -105,7 +273,7 @@ func (s Session) concatenateParts(dlogger *log.Logger, progress *mpb.Progress) (
 			return err
 		}
 		dlogger.Printf("concatenating: %s", fparti.Name())
-		if _, err := io.Copy(fpart0, fparti); err != nil {
+		if _, err := copyFile(fpart0, fparti, buf); err != nil {
 			return err
 		}
 		for _, err := range [...]error{fparti.Close(), os.Remove(fparti.Name())} {
@@ -118,17 +286,34 @@ func (s Session) concatenateParts(dlogger *log.Logger, progress *mpb.Progress) (
 	return fpart0.Close()
 }
 
-func (s *Session) saveState(fileName string) error {
-	dst, err := os.Create(fileName)
-	if err != nil {
-		return err
-	}
+// copyBuffer is io.CopyBuffer, which doesn't take ReadFrom or WriteTo
+// shortcuts around buf
+func copyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
 
-	err = json.NewEncoder(dst).Encode(s)
-	if e := dst.Close(); err == nil {
-		err = e
+// saveState writes state with checksums of what parts have written so far.
+// Write is atomic, so crash in the middle doesn't lose previous state.
+func (s *Session) saveState(fileName string) error {
+	s.Version = stateVersion
+	for _, p := range s.Parts {
+		// bitfield of part, which hasn't been verifying, is kept as loaded
+		if p.pieces != nil || s.PieceHashes == "" {
+			p.Pieces = p.pieceBitfield(s.pieceLength(), s.ContentLength, p.pieces != nil)
+		}
+		p.Checksum = ""
+		if p.Skip || p.Written == 0 {
+			continue
+		}
+		sum, err := sumPart(p.FileName, p.Written)
+		if err != nil {
+			return err
+		}
+		p.Checksum = sum
 	}
-	return err
+	return writeFileAtomic(fileName, 0644, func(w io.Writer) error {
+		return encodeState(w, fileName, s)
+	})
 }
 
 func (s *Session) loadState(fileName string) error {
@@ -137,11 +322,76 @@ func (s *Session) loadState(fileName string) error {
 		return err
 	}
 
-	err = json.NewDecoder(src).Decode(s)
+	err = decodeState(src, fileName, s)
 	if e := src.Close(); err == nil {
 		err = e
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	return errors.WithMessage(s.migrate(), fileName)
+}
+
+// migrate brings state of older version up to date
+func (s *Session) migrate() error {
+	switch {
+	case s.Version > stateVersion:
+		return errors.Errorf("state version %d is newer than supported %d", s.Version, stateVersion)
+	case s.Version <= 1:
+		// header, replayed by parts on resume, was that of HeaderMap
+		if s.Header == nil {
+			s.Header = make(http.Header, len(s.HeaderMap))
+			for k, v := range s.HeaderMap {
+				s.Header.Set(k, v)
+			}
+		}
+		// Elapsed of parts counts their waits too, and there are neither
+		// validators nor checksums, so parts are resumed unverified
+		s.Version = stateVersion
+	}
+	return nil
+}
+
+// sumPart returns hex sha256 of first n bytes of fileName
+func sumPart(fileName string, n int64) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, n); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFileAtomic writes fileName via temporary file in the same directory,
+// renamed over it, once write has succeeded and is synced
+func writeFileAtomic(fileName string, perm os.FileMode, write func(io.Writer) error) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
 }
 
 func (s *Session) actualPartsOnly() {
@@ -163,25 +413,45 @@ func (s Session) totalWritten() int64 {
 	return total
 }
 
-func (s Session) writeSummary(w io.Writer) {
+// timeStats returns active time of the longest running part and wait
+// time of all parts
+func (s Session) timeStats() (active, waited time.Duration) {
+	for _, p := range s.Parts {
+		if p.Elapsed > active {
+			active = p.Elapsed
+		}
+		waited += p.Waited
+	}
+	return active, waited
+}
+
+func (s Session) writeSummary(w io.Writer, msgs catalog, costPerGB float64) {
 	humanSize := decor.SizeB1024(s.ContentLength)
-	format := fmt.Sprintf("Length: %%s [%s]\n", s.ContentType)
-	lengthSummary := "unknown"
+	lengthSummary := msgs.T("unknown")
 	if s.ContentLength >= 0 {
 		lengthSummary = fmt.Sprintf("%d (%.1f)", s.ContentLength, humanSize)
 		if totalWritten := s.totalWritten(); totalWritten > 0 {
 			remaining := s.ContentLength - totalWritten
-			lengthSummary += fmt.Sprintf(", %d (%.1f) remaining", remaining, decor.SizeB1024(remaining))
+			lengthSummary += fmt.Sprintf(msgs.T(", %d (%.1f) remaining"), remaining, decor.SizeB1024(remaining))
 		}
 	}
-	fmt.Fprintf(w, format, lengthSummary)
+	fmt.Fprintf(w, msgs.T("Length: %s [%s]\n"), lengthSummary, s.ContentType)
 	if s.ContentMD5 != "" {
 		fmt.Fprintf(w, "MD5: %s\n", s.ContentMD5)
 	}
+	if costPerGB > 0 && s.ContentLength > 0 {
+		fmt.Fprintf(w, msgs.T("Estimated cost: %.2f\n"), transferCost(s.ContentLength-s.totalWritten(), costPerGB))
+	}
 	if !s.isAcceptRanges() {
-		fmt.Fprintln(w, "HTTP server doesn't seem to support byte ranges. Cannot resume.")
+		fmt.Fprint(w, msgs.T("HTTP server doesn't seem to support byte ranges. Cannot resume.\n"))
 	}
-	fmt.Fprintf(w, "Saving to: %q\n\n", s.SuggestedFileName)
+	fmt.Fprintf(w, msgs.T("Saving to: %q\n\n"), s.SuggestedFileName)
+}
+
+// transferCost estimates cost of transferring n bytes at price per GB, which
+// cloud providers bill in units of 2^30 bytes
+func transferCost(n int64, perGB float64) float64 {
+	return float64(n) / (1 << 30) * perGB
 }
 
 func (s Session) removeFiles() (err error) {
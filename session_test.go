@@ -0,0 +1,84 @@
+package getparty
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCalcChunks(t *testing.T) {
+	tests := []struct {
+		length, size int64
+		want         [][2]int64
+	}{
+		{10, 3, [][2]int64{{0, 2}, {3, 5}, {6, 8}, {9, 9}}},
+		{9, 3, [][2]int64{{0, 2}, {3, 5}, {6, 8}}},
+		{4, 3, [][2]int64{{0, 2}, {3, 3}}},
+		{3, 3, [][2]int64{{0, 2}}},
+		{2, 3, [][2]int64{{0, 1}}},
+	}
+	for _, tt := range tests {
+		s := Session{SuggestedFileName: "f", ContentLength: tt.length}
+		parts := s.calcChunks(tt.size)
+		if len(parts) != len(tt.want) {
+			t.Errorf("calcChunks(%d) of %d: %d parts, want %d", tt.size, tt.length, len(parts), len(tt.want))
+			continue
+		}
+		for i, p := range parts {
+			if p.Start != tt.want[i][0] || p.Stop != tt.want[i][1] {
+				t.Errorf("calcChunks(%d) of %d: part %d is [%d:%d], want %v", tt.size, tt.length, i, p.Start, p.Stop, tt.want[i])
+			}
+			name := fmt.Sprintf("f.part%d", i)
+			if i == 0 {
+				name = "f"
+			}
+			if p.FileName != name {
+				t.Errorf("calcChunks(%d) of %d: part %d is %q, want %q", tt.size, tt.length, i, p.FileName, name)
+			}
+		}
+	}
+}
+
+// v1StateFixture is state, as written by getparty before versioning
+const v1StateFixture = `{"Location":"https://example.com/f.iso","SuggestedFileName":"f.iso","ContentMD5":"","AcceptRanges":"bytes","StatusCode":200,"ContentLength":100,"ContentType":"application/octet-stream","HeaderMap":{"Cookie":"sid=1","User-Agent":"Mozilla/5.0","X-Token":"t"},"Parts":[{"FileName":"f.iso","Start":0,"Stop":49,"Written":10,"Skip":false,"Elapsed":3000000000},{"FileName":"f.iso.part1","Start":50,"Stop":99,"Written":0,"Skip":false,"Elapsed":0}]}`
+
+func TestLoadStateV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getparty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "f.iso.json")
+	if err := ioutil.WriteFile(name, []byte(v1StateFixture), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := new(Session)
+	if err := s.loadState(name); err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != stateVersion {
+		t.Errorf("Version = %d, want %d", s.Version, stateVersion)
+	}
+	for k, v := range map[string]string{"Cookie": "sid=1", "User-Agent": "Mozilla/5.0", "X-Token": "t"} {
+		if got := s.Header.Get(k); got != v {
+			t.Errorf("Header %s = %q, want %q", k, got, v)
+		}
+	}
+	if got := s.partHeader().Get("X-Token"); got != "t" {
+		t.Errorf("part header X-Token = %q, want %q", got, "t")
+	}
+	if len(s.Parts) != 2 || s.Parts[0].Written != 10 || s.Parts[0].Elapsed != 3*time.Second || s.Parts[0].Checksum != "" {
+		t.Errorf("parts = %+v", s.Parts)
+	}
+
+	newer := fmt.Sprintf(`{"Version":%d}`, stateVersion+1)
+	if err := ioutil.WriteFile(name, []byte(newer), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(Session).loadState(name); err == nil {
+		t.Error("state of newer version loaded")
+	}
+}
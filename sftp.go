@@ -0,0 +1,153 @@
+package getparty
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpRoundTripper implements http.RoundTripper on top of sftp protocol.
+// Range requests are mapped onto file seek, which sftp always supports.
+type sftpRoundTripper struct {
+	config *ssh.ClientConfig
+	dialer *dialer
+}
+
+func newSftpRoundTripper(dialer *dialer, insecure bool) sftpRoundTripper {
+	config := &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	home, _ := os.UserHomeDir()
+	if !insecure {
+		callback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+		if err != nil {
+			callback = func(string, net.Addr, ssh.PublicKey) error {
+				return errors.Errorf("known_hosts: %v", err)
+			}
+		}
+		config.HostKeyCallback = callback
+	}
+	var signers []ssh.Signer
+	for _, name := range [...]string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		key, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(key); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) != 0 {
+		config.Auth = append(config.Auth, ssh.PublicKeys(signers...))
+	}
+	return sftpRoundTripper{config: config, dialer: dialer}
+}
+
+func (rt sftpRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	defer func() {
+		err = errors.WithMessage(err, "sftp")
+	}()
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "22")
+	}
+	config := *rt.config
+	config.User = os.Getenv("USER")
+	if req.URL.User != nil {
+		config.User = req.URL.User.Username()
+		if pass, ok := req.URL.User.Password(); ok {
+			config.Auth = append([]ssh.AuthMethod{ssh.Password(pass)}, config.Auth...)
+		}
+	}
+
+	conn, err := rt.dialer.DialContext(req.Context(), "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(req, conn)
+	var streaming bool
+	defer func() {
+		if !streaming {
+			stop()
+			conn.Close()
+		}
+	}()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, host, &config)
+	if err != nil {
+		return nil, err
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(req.URL.Path)
+	if err != nil {
+		client.Close()
+		if os.IsNotExist(err) {
+			return ftpResponse(req, http.StatusNotFound, err.Error()), nil
+		}
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	size := fi.Size()
+	status, start, end := http.StatusOK, int64(0), size-1
+	if groups := reByteRange.FindStringSubmatch(req.Header.Get(hRange)); groups != nil {
+		start, _ = strconv.ParseInt(groups[1], 10, 64)
+		if groups[2] != "" {
+			end, _ = strconv.ParseInt(groups[2], 10, 64)
+		}
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			client.Close()
+			return nil, err
+		}
+		status = http.StatusPartialContent
+	}
+
+	resp = ftpResponse(req, status, "")
+	resp.Proto = "SFTP"
+	resp.Header.Set("Accept-Ranges", acceptRangesType)
+	resp.ContentLength = end - start + 1
+	if status == http.StatusPartialContent {
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	resp.Body = &sftpBody{
+		Reader:  io.LimitReader(f, resp.ContentLength),
+		closers: []io.Closer{f, client, sshClient},
+		stop:    stop,
+	}
+	streaming = true
+	return resp, nil
+}
+
+type sftpBody struct {
+	io.Reader
+	closers []io.Closer
+	stop    func()
+}
+
+func (b *sftpBody) Close() (err error) {
+	b.stop()
+	for _, c := range b.closers {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package getparty
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// signatureError is failure of the saved file to match its OpenPGP
+// signature, or signature by none of the given keys
+type signatureError struct {
+	Err error
+}
+
+func (e signatureError) Error() string {
+	return e.Err.Error()
+}
+
+// checkSignature verifies saved fileName against detached signature of
+// --signature-url or --signature-file with keys of --keyring
+func (cmd Cmd) checkSignature(ctx context.Context, jar http.CookieJar, fileName, userUrl string) (err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "signature")
+	}()
+	sig, err := cmd.readSignature(ctx, jar, userUrl)
+	if err != nil {
+		// file is complete, so retry of the whole session is no use
+		return ExpectedError{err}
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	check := openpgp.CheckDetachedSignature
+	if isArmored(sig) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+	signer, err := check(cmd.keyring, f, bytes.NewReader(sig))
+	if err != nil {
+		// bad signature and signature by unknown key alike
+		return signatureError{errors.Errorf("%q: %v", fileName, err)}
+	}
+	cmd.logger.Printf(cmd.msgs.T("%q: good signature by %s"), fileName, signerName(signer))
+	return nil
+}
+
+// readSignature reads detached signature of --signature-file, or fetches
+// one of --signature-url, where {} is replaced with userUrl
+func (cmd Cmd) readSignature(ctx context.Context, jar http.CookieJar, userUrl string) ([]byte, error) {
+	if cmd.options.SignatureFile != "" {
+		return ioutil.ReadFile(cmd.options.SignatureFile)
+	}
+	u := strings.Replace(cmd.options.SignatureURL, "{}", userUrl, -1)
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.User = cmd.userInfo
+	cmd.applyHeaders(req)
+	cmd.dlogger.Printf("signature: GET %q", u)
+	client := cmd.newClient(true, jar)
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: unexpected status: %s", u, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// readKeyring reads public keys of every file, either armored or binary
+func readKeyring(fileNames []string) (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	for _, name := range fileNames {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		read := openpgp.ReadKeyRing
+		if isArmored(data) {
+			read = openpgp.ReadArmoredKeyRing
+		}
+		keys, err := read(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.WithMessage(err, name)
+		}
+		keyring = append(keyring, keys...)
+	}
+	return keyring, nil
+}
+
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP"))
+}
+
+// signerName returns primary user id of e, or any, if none is marked so,
+// and key id as the last resort
+func signerName(e *openpgp.Entity) string {
+	var names []string
+	for name, id := range e.Identities {
+		if id.SelfSignature != nil && id.SelfSignature.IsPrimaryId != nil && *id.SelfSignature.IsPrimaryId {
+			return name
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return e.PrimaryKey.KeyIdString()
+	}
+	sort.Strings(names)
+	return names[0]
+}
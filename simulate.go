@@ -0,0 +1,97 @@
+package getparty
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errSimulatedLoss = errors.New("simulated loss")
+
+// simulator degrades network for testing retries, backoff and work
+// stealing. It's seeded, so a run can be reproduced.
+type simulator struct {
+	latency time.Duration
+	loss    float64
+	mu      sync.Mutex
+	rnd     *rand.Rand
+}
+
+func newSimulator(latency time.Duration, loss float64, seed int64) *simulator {
+	if latency <= 0 && loss <= 0 {
+		return nil
+	}
+	return &simulator{
+		latency: latency,
+		loss:    loss,
+		rnd:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// lose reports whether to drop, and fraction of body to keep, if it's
+// the body to be dropped
+func (s *simulator) lose() (bool, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rnd.Float64() < s.loss, s.rnd.Float64()
+}
+
+// wrap returns rt, which delays every request by latency, fails it with
+// probability of loss, or cuts its body short with the same probability
+func (s *simulator) wrap(rt http.RoundTripper) http.RoundTripper {
+	if s == nil {
+		return rt
+	}
+	return simTransport{base: rt, sim: s}
+}
+
+type simTransport struct {
+	base http.RoundTripper
+	sim  *simulator
+}
+
+func (t simTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := sleepContext(req.Context(), t.sim.latency); err != nil {
+		return nil, err
+	}
+	if drop, _ := t.sim.lose(); drop {
+		return nil, errSimulatedLoss
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.ContentLength <= 0 {
+		return resp, err
+	}
+	if drop, keep := t.sim.lose(); drop {
+		resp.Body = &cutBody{ReadCloser: resp.Body, remaining: int64(float64(resp.ContentLength) * keep)}
+	}
+	return resp, nil
+}
+
+func (t simTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// cutBody ends with io.ErrUnexpectedEOF after remaining bytes, as
+// connection dropped by the network
+type cutBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *cutBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
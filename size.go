@@ -0,0 +1,89 @@
+package getparty
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ByteSize is a flag value, which accepts optional K, M, G or T suffix
+// with 1024 multiplier, like 512K or 1.5G
+type ByteSize int64
+
+func (s *ByteSize) UnmarshalFlag(value string) error {
+	n, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*s = ByteSize(n)
+	return nil
+}
+
+func (s ByteSize) MarshalFlag() (string, error) {
+	return strconv.FormatInt(int64(s), 10), nil
+}
+
+func parseByteSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	mult := int64(1)
+	if value != "" {
+		switch strings.ToUpper(value[len(value)-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		case "T":
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		return 0, errors.Errorf("invalid size %q", value)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// SizeTolerance is a flag value of expected size with optional tolerance,
+// either size or percent of the expected one, like 1.2G or 1.2G,5%
+type SizeTolerance struct {
+	Size      int64
+	Tolerance int64
+	value     string
+}
+
+func (s *SizeTolerance) UnmarshalFlag(value string) error {
+	parts := strings.SplitN(value, ",", 2)
+	size, err := parseByteSize(parts[0])
+	if err != nil {
+		return err
+	}
+	var tolerance int64
+	if len(parts) == 2 {
+		if percent := strings.TrimSpace(parts[1]); strings.HasSuffix(percent, "%") {
+			f, err := strconv.ParseFloat(strings.TrimSuffix(percent, "%"), 64)
+			if err != nil || f < 0 {
+				return errors.Errorf("invalid tolerance %q", parts[1])
+			}
+			tolerance = int64(float64(size) * f / 100)
+		} else if tolerance, err = parseByteSize(parts[1]); err != nil {
+			return errors.Errorf("invalid tolerance %q", parts[1])
+		}
+	}
+	*s = SizeTolerance{Size: size, Tolerance: tolerance, value: value}
+	return nil
+}
+
+func (s SizeTolerance) MarshalFlag() (string, error) {
+	return s.value, nil
+}
+
+// contains reports whether size is within tolerance of the expected one
+func (s SizeTolerance) contains(size int64) bool {
+	return size >= s.Size-s.Tolerance && size <= s.Size+s.Tolerance
+}
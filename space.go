@@ -0,0 +1,129 @@
+package getparty
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/vbauerster/mpb/v5/decor"
+)
+
+var (
+	errSpaceUnknown  = errors.New("free space is unknown on this system")
+	errInodesUnknown = errors.New("free inodes are unknown on this filesystem")
+	errLimitUnknown  = errors.New("open files limit is unknown on this system")
+)
+
+// spaceError is lack of space or inodes for the download, found out before
+// it starts
+type spaceError struct {
+	Err error
+}
+
+func (e spaceError) Error() string {
+	return e.Err.Error()
+}
+
+// baseOpenFiles is headroom of open files besides parts: std streams, log,
+// state and cookie files, resolver and control sockets and the like
+const baseOpenFiles = 32
+
+// spaceNeeded returns bytes yet to be written to disk: remainder of every
+// part, plus the largest part but the first, as parts are appended to the
+// first one and removed one by one on concatenation.
+func (s Session) spaceNeeded(concatenate bool) int64 {
+	var need, largest int64
+	for i, p := range s.Parts {
+		if p.Skip {
+			continue
+		}
+		size := p.Stop - p.Start + 1
+		need += size - p.Written
+		if i != 0 && size > largest {
+			largest = size
+		}
+	}
+	if concatenate {
+		need += largest
+	}
+	return need
+}
+
+// filesNeeded returns number of files yet to be created: parts, which
+// haven't got any data yet, plus state file and its temporary.
+func (s Session) filesNeeded() uint64 {
+	need := uint64(2)
+	for _, p := range s.Parts {
+		if !p.Skip && p.Written == 0 {
+			need++
+		}
+	}
+	return need
+}
+
+// openFilesNeeded returns number of descriptors the download may hold at
+// once: file and connection of every part, which is downloaded at once
+// with up to max others, 0 for all, plus baseOpenFiles
+func (s Session) openFilesNeeded(max int) uint64 {
+	var parts int
+	for _, p := range s.Parts {
+		if !p.Skip {
+			parts++
+		}
+	}
+	if max > 0 && parts > max {
+		parts = max
+	}
+	return uint64(baseOpenFiles + 2*parts)
+}
+
+// checkSpace fails fast, if filesystem of the download can't fit it, either
+// by bytes or by inodes
+func (cmd Cmd) checkSpace(s *Session) error {
+	if s.ContentLength <= 0 {
+		return nil
+	}
+	dir := filepath.Dir(s.SuggestedFileName)
+	avail, err := freeSpace(dir)
+	if err != nil {
+		cmd.dlogger.Printf("space check of %q: %v", dir, err)
+		return nil
+	}
+	// stream picks parts up and removes them, there is no concatenation
+	need := s.spaceNeeded(cmd.stream == nil)
+	cmd.dlogger.Printf("space check of %q: need %d, available %d", dir, need, avail)
+	if uint64(need) > avail {
+		return spaceError{errors.Errorf("not enough space in %q: need %.1f, available %.1f, --no-space-check to try anyway",
+			dir, decor.SizeB1024(need), decor.SizeB1024(int64(avail)))}
+	}
+	free, err := freeInodes(dir)
+	if err != nil {
+		cmd.dlogger.Printf("inode check of %q: %v", dir, err)
+		return nil
+	}
+	files := s.filesNeeded()
+	cmd.dlogger.Printf("inode check of %q: need %d, free %d", dir, files, free)
+	if files > free {
+		return spaceError{errors.Errorf("not enough inodes in %q: need %d, free %d, --no-space-check to try anyway", dir, files, free)}
+	}
+	return nil
+}
+
+// checkOpenFiles raises open files limit, if parts of s need more than the
+// current one, and fails fast, if they can't get enough anyway, instead of
+// failing parts with "too many open files" midway
+func (cmd Cmd) checkOpenFiles(s *Session) error {
+	need := s.openFilesNeeded(cmd.maxConnections())
+	limit, err := raiseOpenFiles(need)
+	if err == errLimitUnknown {
+		return nil
+	}
+	if err != nil {
+		cmd.dlogger.Printf("raise open files limit: %v", err)
+	}
+	cmd.dlogger.Printf("open files: need %d, limit %d", need, limit)
+	if need > limit {
+		return errors.Errorf("%d parts need about %d open files, but limit is %d, lower --parts or --max-connections, or raise limit with ulimit -n",
+			len(s.Parts), need, limit)
+	}
+	return nil
+}
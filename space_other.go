@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!windows
+
+package getparty
+
+func freeSpace(string) (uint64, error) {
+	return 0, errSpaceUnknown
+}
+
+func freeInodes(string) (uint64, error) {
+	return 0, errInodesUnknown
+}
@@ -0,0 +1,97 @@
+package getparty
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var reSplitPiece = regexp.MustCompile(`^(.*\.)(z?)(\d+)$`)
+
+// splitPieceURLs expands url of the first piece of a server-side split
+// archive, like file.001 or file.z01, into n consecutive piece urls.
+// For zip style splits the last piece is file.zip. Second return value
+// is the name of the joined artifact.
+func splitPieceURLs(rawUrl string, n int) ([]string, string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, "", err
+	}
+	groups := reSplitPiece.FindStringSubmatch(u.Path)
+	if groups == nil {
+		return nil, "", errors.Errorf("%q doesn't look like first piece of split archive", rawUrl)
+	}
+	base, zip, digits := groups[1], groups[2] != "", groups[3]
+	first, err := strconv.Atoi(digits)
+	if err != nil {
+		return nil, "", err
+	}
+	joined := path.Base(base[:len(base)-1])
+	if zip {
+		joined += ".zip"
+	}
+	urls := make([]string, n)
+	for i := 0; i < n; i++ {
+		pu := *u
+		if zip && i == n-1 {
+			pu.Path = base + "zip"
+		} else {
+			pu.Path = fmt.Sprintf("%s%s%0*d", base, groups[2], len(digits), first+i)
+		}
+		urls[i] = pu.String()
+	}
+	return urls, joined, nil
+}
+
+// followPieces follows every piece of a split archive and combines them
+// into single session, where each piece is downloaded as a separate part.
+func (cmd Cmd) followPieces(ctx context.Context, jar http.CookieJar, userUrl string, n int) (*Session, error) {
+	urls, joined, err := splitPieceURLs(userUrl, n)
+	if err != nil {
+		return nil, errors.WithMessage(err, "followPieces")
+	}
+	if cmd.options.OutFileName != "" {
+		joined = cmd.options.OutFileName
+	} else if joined, err = cmd.outputName(userUrl, joined); err != nil {
+		return nil, errors.WithMessage(err, "followPieces")
+	}
+
+	session := &Session{
+		Location:          userUrl,
+		SuggestedFileName: joined,
+		SplitPieces:       n,
+	}
+	for i, u := range urls {
+		cmd.options.OutFileName = joined
+		piece, err := cmd.follow(ctx, jar, u)
+		if err != nil {
+			return nil, err
+		}
+		if piece.ContentLength <= 0 {
+			return nil, errors.Errorf("followPieces: unknown length of piece %q", u)
+		}
+		if i == 0 {
+			session.AcceptRanges = piece.AcceptRanges
+			session.ContentType = piece.ContentType
+			session.StatusCode = piece.StatusCode
+			session.Header = piece.Header
+		}
+		p := &Part{
+			Location: piece.Location,
+			FileName: joined,
+			Stop:     piece.ContentLength - 1,
+		}
+		if i != 0 {
+			p.FileName = fmt.Sprintf("%s.part%d", joined, i)
+		}
+		session.ContentLength += piece.ContentLength
+		session.Parts = append(session.Parts, p)
+	}
+	return session, nil
+}
@@ -0,0 +1,96 @@
+package getparty
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	stateJSON = "json"
+	stateYAML = "yaml"
+	stateTOML = "toml"
+)
+
+// stateFormats are in order of lookup of unfinished session
+var stateFormats = []string{stateJSON, stateYAML, stateTOML}
+
+// stateHeader is prepended to human-editable state, json has no comments
+const stateHeader = `getparty session state, resume with: getparty -c %s
+
+Edit with care, when rescuing broken session:
+  Location of the session or of a part (mirror) may be replaced by other
+  url of the same content.
+  Part downloads bytes [Start, Stop] of content into FileName, first
+  Written bytes of it are there already. Parts must cover content without
+  gaps or overlaps, Skip ones are ignored.
+  Checksum is of Written bytes, clear it, if part file has been changed on
+  purpose, or the part is restarted. Pieces is hex bitfield of pieces
+  done, verified ones if there are piece hashes, clear it along with
+  Checksum.
+`
+
+// stateFormat returns format of state file by its extension
+func stateFormat(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return stateYAML
+	case ".toml":
+		return stateTOML
+	}
+	return stateJSON
+}
+
+// findStateFile returns existing state file of download to fileName in any
+// of stateFormats, empty if there is none
+func findStateFile(fileName string) string {
+	for _, format := range stateFormats {
+		stateName := fileName + "." + format
+		if _, err := os.Stat(stateName); err == nil {
+			return stateName
+		}
+	}
+	return ""
+}
+
+func encodeState(w io.Writer, fileName string, s *Session) error {
+	format := stateFormat(fileName)
+	if format == stateJSON {
+		return json.NewEncoder(w).Encode(s)
+	}
+	header := fmt.Sprintf(stateHeader, filepath.Base(fileName))
+	for _, line := range strings.Split(strings.TrimSuffix(header, "\n"), "\n") {
+		if _, err := fmt.Fprintln(w, strings.TrimRight("# "+line, " ")); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintln(w); err != nil {
+		return err
+	}
+	if format == stateYAML {
+		return yaml.NewEncoder(w).Encode(s)
+	}
+	return toml.NewEncoder(w).Encode(s)
+}
+
+func decodeState(r io.Reader, fileName string, s *Session) error {
+	switch stateFormat(fileName) {
+	case stateYAML:
+		return yaml.NewDecoder(r).Decode(s)
+	case stateTOML:
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		_, err = toml.Decode(string(b), s)
+		return err
+	}
+	return json.NewDecoder(r).Decode(s)
+}
@@ -0,0 +1,150 @@
+package getparty
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// workStealer re-segments download on the fly: when a part is done, it
+// steals upper half of the remaining range of the slowest part, so one
+// slow connection doesn't drag out the whole download.
+//
+// With headFirst, range is stolen from the first part, which has enough
+// remaining, instead, so connections gather at the earliest missing byte
+// and content becomes available in order as soon as possible.
+type workStealer struct {
+	mu        sync.Mutex
+	session   *Session
+	minSize   int64
+	headFirst bool
+}
+
+// steal returns new part, carved out of the slowest one, or nil if there
+// is nothing worth stealing.
+func (ws *workStealer) steal() *Part {
+	if ws.minSize <= 0 {
+		return nil
+	}
+	return ws.split(ws.minSize)
+}
+
+// split carves new part out of the slowest one, which remainder is at
+// least 2*minSize, or returns nil. Parts, which haven't been started yet,
+// e.g. waiting for their --part-order turn, aren't split: they aren't
+// prepared to download, and their turn would be taken.
+func (ws *workStealer) split(minSize int64) *Part {
+	if ws.session.ContentLength <= 0 {
+		return nil
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	var victim *Part
+	var victimIdx int
+	maxEta := -1.0
+	for i, p := range ws.session.Parts {
+		if !p.isStarted() {
+			continue
+		}
+		remaining, eta := p.eta()
+		if remaining < 2*minSize {
+			continue
+		}
+		if eta > maxEta {
+			victim, victimIdx, maxEta = p, i, eta
+		}
+		if ws.headFirst {
+			// parts are in order of content
+			break
+		}
+	}
+	if victim == nil {
+		return nil
+	}
+
+	victim.mu.Lock()
+	defer victim.mu.Unlock()
+	cur := victim.Start + victim.Written
+	remaining := victim.Stop - cur + 1
+	if victim.Skip || remaining < 2*minSize {
+		return nil
+	}
+	mid := cur + remaining/2
+	p := &Part{
+		Location: victim.Location,
+		Fallback: append([]string(nil), victim.Fallback...),
+		FileName: ws.nextFileName(),
+		Start:    mid,
+		Stop:     victim.Stop,
+		name:     fmt.Sprintf("P%02d", len(ws.session.Parts)+1),
+		order:    len(ws.session.Parts),
+	}
+	victim.Stop = mid - 1
+	if victim.bar != nil {
+		victim.bar.SetTotal(victim.Stop-victim.Start+1, false)
+	}
+	victim.dlogger.Printf("range [%d:%d] stolen", p.Start, p.Stop)
+
+	parts := ws.session.Parts
+	parts = append(parts, nil)
+	copy(parts[victimIdx+2:], parts[victimIdx+1:])
+	parts[victimIdx+1] = p
+	ws.session.Parts = parts
+	return p
+}
+
+func (ws *workStealer) nextFileName() string {
+	used := make(map[string]bool, len(ws.session.Parts))
+	for _, p := range ws.session.Parts {
+		used[p.FileName] = true
+	}
+	for i := len(ws.session.Parts); ; i++ {
+		name := fmt.Sprintf("%s.part%d", ws.session.SuggestedFileName, i)
+		if _, err := os.Stat(name); !used[name] && os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+// isStarted reports whether download of p has begun in this session
+func (p *Part) isStarted() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.started.IsZero()
+}
+
+// eta returns remaining bytes and estimated seconds to download them,
+// based on the speed observed since the part has been started.
+func (p *Part) eta() (int64, float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Skip {
+		return 0, 0
+	}
+	remaining := p.Stop - p.Start - p.Written + 1
+	if p.started.IsZero() {
+		return remaining, math.Inf(1)
+	}
+	speed := float64(p.Written-p.startWritten) / time.Since(p.started).Seconds()
+	if speed <= 0 {
+		return remaining, math.Inf(1)
+	}
+	return remaining, float64(remaining) / speed
+}
+
+// coalesceParts merges trivial ranges of s before download, by the same
+// measure as stealing
+func (cmd Cmd) coalesceParts(s *Session) error {
+	if cmd.options.PartSize > 0 {
+		// size of parts is what user has asked for
+		return nil
+	}
+	merged, err := s.coalesceParts(int64(cmd.options.MinSplitSize))
+	if merged != 0 {
+		cmd.dlogger.Printf("%d parts merged into neighbors, %d left", merged, len(s.Parts))
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package getparty
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSplitSkipsNotStarted(t *testing.T) {
+	started := &Part{
+		FileName: "f",
+		Stop:     999,
+		Written:  100,
+		started:  time.Now().Add(-time.Second),
+		dlogger:  log.New(ioutil.Discard, "", 0),
+	}
+	// waiting for its --part-order turn, not prepared
+	waiting := &Part{FileName: "f.part1", Start: 1000, Stop: 99999}
+	dir, err := ioutil.TempDir("", "steal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &Session{SuggestedFileName: filepath.Join(dir, "f"), ContentLength: 100000, Parts: []*Part{started, waiting}}
+	ws := &workStealer{session: s, minSize: 100}
+	p := ws.split(ws.minSize)
+	if p == nil {
+		t.Fatal("nothing split")
+	}
+	if p.Start != 550 || p.Stop != 999 || started.Stop != 549 {
+		t.Errorf("split [%d:%d] off [%d:%d], want [550:999] off [0:549]", p.Start, p.Stop, started.Start, started.Stop)
+	}
+	if waiting.Start != 1000 || waiting.Stop != 99999 {
+		t.Errorf("waiting part is [%d:%d] now", waiting.Start, waiting.Stop)
+	}
+
+	started.Stop, started.Written = 100, 100
+	if p := ws.split(ws.minSize); p != nil && p.Start >= 1000 {
+		t.Errorf("split [%d:%d] off waiting part", p.Start, p.Stop)
+	}
+}
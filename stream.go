@@ -0,0 +1,110 @@
+package getparty
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// streamer writes downloaded content to w in order, as contiguous prefixes
+// of parts complete, so output can be piped while later parts are still
+// being downloaded. Position is kept as part file name and bytes emitted
+// from it, so it survives session retries, where parts are reloaded from
+// state.
+type streamer struct {
+	w        io.Writer
+	fileName string
+	emitted  int64
+	total    int64
+}
+
+// run flushes available content every interval, until done is closed,
+// then flushes the rest.
+func (s *streamer) run(ws *workStealer, done <-chan struct{}, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var finished bool
+		select {
+		case <-ticker.C:
+		case <-done:
+			finished = true
+		}
+		if err := s.flush(ws); err != nil {
+			if e, ok := err.(*os.PathError); ok && e.Err == syscall.EPIPE {
+				// reader has gone, e.g. head in pipeline
+				return ExpectedError{errors.WithMessage(err, "stream")}
+			}
+			return errors.WithMessage(err, "stream")
+		}
+		if finished {
+			return nil
+		}
+	}
+}
+
+func (s *streamer) flush(ws *workStealer) error {
+	for {
+		fileName, written, next := s.position(ws)
+		switch {
+		case fileName == "":
+			return nil
+		case written > s.emitted:
+			if err := s.copy(fileName, written); err != nil {
+				return err
+			}
+		case next != "":
+			s.fileName, s.emitted = next, 0
+		default:
+			return nil
+		}
+	}
+}
+
+// position returns current part file name, its written bytes and, if the
+// part is done, file name of the next one. Parts stolen from the current
+// one are inserted right after it, so order of the list is the order of
+// content.
+func (s *streamer) position(ws *workStealer) (fileName string, written int64, next string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	var cur *Part
+	for _, p := range ws.session.Parts {
+		if p.Skip {
+			continue
+		}
+		if cur != nil {
+			if cur.isDone() {
+				next = p.FileName
+			}
+			break
+		}
+		if s.fileName == "" || p.FileName == s.fileName {
+			cur = p
+		}
+	}
+	if cur == nil {
+		return "", 0, ""
+	}
+	cur.mu.Lock()
+	defer cur.mu.Unlock()
+	return cur.FileName, cur.Written, next
+}
+
+func (s *streamer) copy(fileName string, written int64) error {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(s.w, io.NewSectionReader(fd, s.emitted, written-s.emitted))
+	s.fileName = fileName
+	s.emitted += n
+	s.total += n
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package getparty
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
+)
+
+// exit codes, documented in README, so scripts may rely on them
+const (
+	exitOK         = 0
+	exitFailure    = 1 // expected failure, none of the below
+	exitUsage      = 2
+	exitUnexpected = 3
+	exitSignature  = 4
+	exitNetwork    = 5
+	exitHTTP4xx    = 6
+	exitHTTP5xx    = 7
+	exitChecksum   = 8
+	exitDiskFull   = 9
+	exitCanceled   = 10
+	exitPartial    = 11 // failed, but state is saved to resume from
+)
+
+// exitCode tells what err is about, ExpectedError doesn't hide its cause.
+// Failure with session state saved is partial, unless its cause is more
+// specific than network failure.
+func (cmd Cmd) exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var expected bool
+	cause := errors.Cause(err)
+	for {
+		e, ok := cause.(ExpectedError)
+		if !ok {
+			break
+		}
+		expected = true
+		cause = errors.Cause(e.Err)
+	}
+	switch e := cause.(type) {
+	case *flags.Error:
+		if e.Type == flags.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	case signatureError:
+		return exitSignature
+	case verifyError:
+		return exitChecksum
+	case spaceError:
+		return exitDiskFull
+	case StatusError:
+		switch {
+		case e.StatusCode >= 500:
+			return exitHTTP5xx
+		case e.StatusCode >= 400:
+			return exitHTTP4xx
+		}
+	}
+	var netErr net.Error
+	switch {
+	case cause == context.Canceled:
+		return exitCanceled
+	case errors.Is(cause, syscall.ENOSPC):
+		return exitDiskFull
+	case cmd.leftState != "":
+		return exitPartial
+	case cause == ErrGiveUp || cause == errShortRead || errors.As(cause, &netErr):
+		return exitNetwork
+	case expected:
+		return exitFailure
+	}
+	return exitUnexpected
+}
+
+// summary is --json-summary report of the run
+type summary struct {
+	URL      string  `json:"url"`
+	Path     string  `json:"path,omitempty"`
+	Size     int64   `json:"size"`
+	Written  int64   `json:"written"`
+	Duration float64 `json:"duration"`
+	Speed    float64 `json:"speed"`
+	Retries  uint32  `json:"retries"`
+	SHA256   string  `json:"sha256,omitempty"`
+	State    string  `json:"state,omitempty"`
+	ExitCode int     `json:"exit_code"`
+	Error    string  `json:"error,omitempty"`
+
+	started time.Time
+	active  time.Duration
+}
+
+// record takes what is known of the download of s from userUrl, later
+// downloads of the run override earlier ones. Nil summary records nothing.
+func (r *summary) record(userUrl string, s *Session) {
+	if r == nil {
+		return
+	}
+	r.URL = userUrl
+	if s == nil {
+		return
+	}
+	r.Path = s.SuggestedFileName
+	r.Size = s.ContentLength
+	r.Written = s.totalWritten()
+	r.active, _ = s.timeStats()
+}
+
+// writeSummary writes --json-summary of the run, which has ended with err
+func (cmd Cmd) writeSummary(err error) error {
+	r := cmd.summary
+	r.Duration = time.Since(r.started).Seconds()
+	if r.active > 0 {
+		// the same average as of the final log line
+		r.Speed = float64(r.Written) / r.active.Seconds()
+	}
+	r.Retries = atomic.LoadUint32(&globTry)
+	r.State = cmd.leftState
+	r.ExitCode = cmd.exitCode(err)
+	if err != nil {
+		r.Error = err.Error()
+	} else if cmd.stream != nil {
+		r.Path = "-"
+	} else if r.Path != "" {
+		if _, e := os.Stat(r.Path); e == nil {
+			sum, e := fileSHA256(r.Path)
+			if e != nil {
+				return e
+			}
+			r.SHA256 = sum
+		}
+	}
+	b, e := json.MarshalIndent(r, "", "  ")
+	if e != nil {
+		return e
+	}
+	return ioutil.WriteFile(cmd.options.JSONSummary, append(b, '\n'), 0644)
+}
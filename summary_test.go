@@ -0,0 +1,49 @@
+package getparty
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
+)
+
+func TestExitCode(t *testing.T) {
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	tests := []struct {
+		name      string
+		err       error
+		leftState string
+		want      int
+	}{
+		{"ok", nil, "", exitOK},
+		{"help", &flags.Error{Type: flags.ErrHelp}, "", exitOK},
+		{"usage", &flags.Error{Type: flags.ErrUnknownFlag}, "", exitUsage},
+		{"unexpected", errors.New("oops"), "", exitUnexpected},
+		{"expected", ExpectedError{errors.New("refused")}, "", exitFailure},
+		{"signature", ExpectedError{signatureError{errors.New("bad")}}, "", exitSignature},
+		{"checksum", errors.WithMessage(verifyError{errors.New("bad")}, "run"), "f.json", exitChecksum},
+		{"disk full", spaceError{errors.New("full")}, "", exitDiskFull},
+		{"enospc", errors.WithMessage(&os.PathError{Op: "write", Path: "f", Err: syscall.ENOSPC}, "P01"), "f.json", exitDiskFull},
+		{"4xx", ExpectedError{StatusError{StatusCode: 404, Status: "404 Not Found"}}, "", exitHTTP4xx},
+		{"5xx", ExpectedError{StatusError{StatusCode: 503, Status: "503 Service Unavailable"}}, "f.json", exitHTTP5xx},
+		{"3xx status", StatusError{StatusCode: 304, Status: "304 Not Modified"}, "", exitUnexpected},
+		{"canceled", errors.WithMessage(context.Canceled, "run"), "f.json", exitCanceled},
+		{"partial", ErrGiveUp, "f.json", exitPartial},
+		{"give up", ErrGiveUp, "", exitNetwork},
+		{"short read", ExpectedError{errShortRead}, "", exitNetwork},
+		{"net", errors.WithMessage(netErr, "follow"), "", exitNetwork},
+		{"nested expected", ExpectedError{ExpectedError{StatusError{StatusCode: 403}}}, "", exitHTTP4xx},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := Cmd{leftState: tt.leftState}
+			if got := cmd.exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package getparty
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultHashLen = 8
+
+var reTemplateToken = regexp.MustCompile(`\{(\w+)(?::(\d+))?\}`)
+
+// expandTemplate replaces tokens of --output-template:
+//
+//	{host}     host of the user's url
+//	{filename} name suggested by the server or taken from the url
+//	{name}     filename without extension
+//	{ext}      extension of filename, without dot
+//	{date}     current date as 2006-01-02
+//	{hash:n}   first n hex digits of sha256 of the user's url, 8 by default
+func expandTemplate(template, userUrl, fileName string, now time.Time) (string, error) {
+	var host string
+	if u, err := url.Parse(userUrl); err == nil {
+		host, _ = safeFileName(u.Hostname())
+	}
+	ext := filepath.Ext(fileName)
+	var err error
+	expanded := reTemplateToken.ReplaceAllStringFunc(template, func(token string) string {
+		m := reTemplateToken.FindStringSubmatch(token)
+		switch m[1] {
+		case "host":
+			return host
+		case "filename":
+			return fileName
+		case "name":
+			return strings.TrimSuffix(fileName, ext)
+		case "ext":
+			return strings.TrimPrefix(ext, ".")
+		case "date":
+			return now.Format("2006-01-02")
+		case "hash":
+			n := defaultHashLen
+			if m[2] != "" {
+				n, _ = strconv.Atoi(m[2])
+			}
+			sum := sha256.Sum256([]byte(userUrl))
+			digest := hex.EncodeToString(sum[:])
+			if n < 1 || n > len(digest) {
+				err = errors.Errorf("output template: hash length %d isn't in 1..%d", n, len(digest))
+				return token
+			}
+			return digest[:n]
+		}
+		err = errors.Errorf("output template: unknown token %q", token)
+		return token
+	})
+	return expanded, err
+}
+
+// outputName returns path of download named by the server or after url,
+// laid out by --output-template and placed into --dir
+func (cmd Cmd) outputName(userUrl, fileName string) (string, error) {
+	fileName, err := safeFileName(fileName)
+	if err != nil {
+		return "", err
+	}
+	if cmd.options.OutputTemplate != "" {
+		fileName, err = expandTemplate(cmd.options.OutputTemplate, userUrl, fileName, time.Now())
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(cmd.options.Dir, fileName), nil
+}
+
+// safeFileName returns the last element of name, suggested by the server
+// or taken from the url, so it can't place download out of --dir.
+// Backslash is taken as separator on every platform.
+func safeFileName(name string) (string, error) {
+	base := filepath.Base(strings.Replace(name, `\`, "/", -1))
+	switch base {
+	case ".", "..", "/":
+		return "", errors.Errorf("%q isn't a file name", name)
+	}
+	return base, nil
+}
@@ -0,0 +1,57 @@
+package getparty
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseContentDisposition(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{`attachment; filename="f.iso"`, "f.iso"},
+		{`attachment; filename*=UTF-8''%D1%84.iso`, "ф.iso"},
+		{`attachment; filename*=utf-8''..%2F..%2Fx`, "x"},
+		{`attachment; filename="../../etc/x"`, "x"},
+		{`attachment; filename="..\..\x"`, "x"},
+		{`attachment; filename=".."`, ""},
+		{`attachment; filename=/`, ""},
+	}
+	for _, tt := range tests {
+		if got := parseContentDisposition(tt.header); got != tt.want {
+			t.Errorf("parseContentDisposition(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestOutputNameStaysInDir(t *testing.T) {
+	tests := []struct {
+		template string
+		userUrl  string
+		fileName string
+		want     string
+	}{
+		{"", "https://example.com/f.iso", "../../x", "x"},
+		{"{host}/{filename}", "https://example.com/f.iso", `..\x`, "example.com/x"},
+		{"{name}-{date}.{ext}", "https://example.com/f.iso", "/etc/f.iso", "f-" + time.Now().Format("2006-01-02") + ".iso"},
+	}
+	for _, tt := range tests {
+		cmd := Cmd{options: &Options{Dir: "dl", OutputTemplate: tt.template}}
+		got, err := cmd.outputName(tt.userUrl, tt.fileName)
+		if err != nil {
+			t.Errorf("outputName(%q): %v", tt.fileName, err)
+			continue
+		}
+		if want := filepath.Join("dl", tt.want); got != want {
+			t.Errorf("outputName(%q) = %q, want %q", tt.fileName, got, want)
+		}
+	}
+	for _, name := range []string{"..", "/", ""} {
+		cmd := Cmd{options: &Options{Dir: "dl"}}
+		if got, err := cmd.outputName("https://example.com/", name); err == nil {
+			t.Errorf("outputName(%q) = %q, want error", name, got)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package getparty
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+var milestones = [...]int{25, 50, 75, 100}
+
+// textProgress reports overall progress with short plain sentences at
+// milestones, instead of animated bars, which screen readers can't follow.
+// Nil *textProgress is valid and reports nothing.
+type textProgress struct {
+	w    io.Writer
+	msgs catalog
+}
+
+// track reports milestones reached by session of ws each interval, until
+// ctx is done, then reports the last time.
+func (t *textProgress) track(ctx context.Context, ws *workStealer, interval time.Duration) {
+	if t == nil || ws.session.ContentLength <= 0 {
+		return
+	}
+	next := -1
+	report := func() {
+		ws.mu.Lock()
+		var written int64
+		for _, p := range ws.session.Parts {
+			p.mu.Lock()
+			written += p.Written
+			p.mu.Unlock()
+		}
+		ws.mu.Unlock()
+		percent := int(written * 100 / ws.session.ContentLength)
+		if next == -1 {
+			// milestones passed in previous sessions aren't news
+			for next = 0; next < len(milestones) && milestones[next] <= percent; next++ {
+			}
+			return
+		}
+		reached := -1
+		for ; next < len(milestones) && milestones[next] <= percent; next++ {
+			reached = milestones[next]
+		}
+		if reached != -1 {
+			fmt.Fprintf(t.w, t.msgs.T("%s: %d percent downloaded.\n"), ws.session.SuggestedFileName, reached)
+		}
+	}
+	report()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report()
+		case <-ctx.Done():
+			report()
+			return
+		}
+	}
+}
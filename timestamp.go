@@ -0,0 +1,62 @@
+package getparty
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	hIfModifiedSince = "If-Modified-Since"
+	hLastModified    = "Last-Modified"
+	hETag            = "ETag"
+	hIfRange         = "If-Range"
+	hIfNoneMatch     = "If-None-Match"
+)
+
+var (
+	errNotModified   = errors.New("not modified")
+	errRemoteChanged = errors.New("remote file has changed")
+)
+
+// setIfModifiedSince makes req conditional on mtime of local fileName,
+// if the file exists
+func setIfModifiedSince(req *http.Request, fileName string) {
+	fi, err := os.Stat(fileName)
+	if err != nil || findStateFile(fileName) != "" {
+		// mtime of unfinished download isn't of the server
+		return
+	}
+	req.Header.Set(hIfModifiedSince, fi.ModTime().UTC().Format(http.TimeFormat))
+}
+
+// remoteNewer reports whether Last-Modified of s is after mtime of the
+// saved file. Missing file, unfinished one, or no Last-Modified to compare
+// with, count as newer.
+func (s Session) remoteNewer() bool {
+	fi, err := os.Stat(s.SuggestedFileName)
+	if err != nil || s.LastModified == "" || findStateFile(s.SuggestedFileName) != "" {
+		return true
+	}
+	t, err := http.ParseTime(s.LastModified)
+	if err != nil {
+		return true
+	}
+	// Last-Modified has no fraction of second
+	return t.After(fi.ModTime().Truncate(time.Second))
+}
+
+// setModTime sets mtime of the saved file to Last-Modified of the session,
+// so next conditional request compares against the server's time.
+func (s Session) setModTime() error {
+	if s.LastModified == "" {
+		return nil
+	}
+	t, err := http.ParseTime(s.LastModified)
+	if err != nil {
+		return errors.WithMessage(err, "setModTime")
+	}
+	return os.Chtimes(s.SuggestedFileName, t, t)
+}
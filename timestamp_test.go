@@ -0,0 +1,52 @@
+package getparty
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoteNewer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getparty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "f.iso")
+	if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 1, 1, 0, 0, 0, 500, time.UTC)
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		lastModified string
+		want         bool
+	}{
+		{name, mtime.Format(http.TimeFormat), false},
+		{name, mtime.Add(-time.Hour).Format(http.TimeFormat), false},
+		{name, mtime.Add(time.Second).Format(http.TimeFormat), true},
+		{name, "", true},
+		{name, "yesterday", true},
+		{name + ".missing", mtime.Format(http.TimeFormat), true},
+	}
+	for _, tt := range tests {
+		s := Session{SuggestedFileName: tt.name, LastModified: tt.lastModified}
+		if got := s.remoteNewer(); got != tt.want {
+			t.Errorf("remoteNewer(%q, %q) = %v, want %v", tt.name, tt.lastModified, got, tt.want)
+		}
+	}
+	// unfinished download has mtime of its own
+	if err := ioutil.WriteFile(name+"."+stateFormats[0], nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := Session{SuggestedFileName: name, LastModified: mtime.Format(http.TimeFormat)}
+	if !s.remoteNewer() {
+		t.Error("remoteNewer of unfinished download = false, want true")
+	}
+}
@@ -0,0 +1,74 @@
+package getparty
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const pinPrefix = "sha256//"
+
+// buildTLSConfig builds tls config from user's options, or returns nil if
+// defaults are fine
+func (cmd Cmd) buildTLSConfig() (conf *tls.Config, err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "tls")
+	}()
+	opts := cmd.options
+	if !opts.InsecureSkipVerify && opts.CACert == "" && opts.Cert == "" && opts.PinnedPubKey == "" {
+		return nil, nil
+	}
+	conf = &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	if opts.CACert != "" {
+		pem, err := ioutil.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %q", opts.CACert)
+		}
+	}
+	if opts.Cert != "" {
+		key := opts.Key
+		if key == "" {
+			key = opts.Cert
+		}
+		cert, err := tls.LoadX509KeyPair(opts.Cert, key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if opts.PinnedPubKey != "" {
+		pins := make(map[string]bool)
+		for _, pin := range strings.Split(opts.PinnedPubKey, ";") {
+			pin = strings.TrimSpace(pin)
+			if !strings.HasPrefix(pin, pinPrefix) {
+				return nil, errors.Errorf("unsupported pin %q, expected %s<base64>", pin, pinPrefix)
+			}
+			pins[pin[len(pinPrefix):]] = true
+		}
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no peer certificate to pin")
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+			if !pins[base64.StdEncoding.EncodeToString(sum[:])] {
+				return errors.New("public key doesn't match pinned one")
+			}
+			return nil
+		}
+	}
+	return conf, nil
+}
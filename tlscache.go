@@ -0,0 +1,147 @@
+package getparty
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const tlsSessionCacheSize = 64
+
+var errSessionsNotPersisted = errors.New("persisting TLS sessions requires Go 1.21 or newer build")
+
+// sessionCache is client session cache, shared by all connections of the
+// run, so parts resume TLS session of the probe instead of full handshake.
+// It remembers what has been put, so sessions can be saved for next runs.
+type sessionCache struct {
+	tls.ClientSessionCache
+	mu       sync.Mutex
+	sessions map[string]*tls.ClientSessionState
+}
+
+func newSessionCache() *sessionCache {
+	return &sessionCache{
+		ClientSessionCache: tls.NewLRUClientSessionCache(tlsSessionCacheSize),
+		sessions:           make(map[string]*tls.ClientSessionState),
+	}
+}
+
+func (c *sessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.ClientSessionCache.Put(key, cs)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cs == nil {
+		delete(c.sessions, key)
+		return
+	}
+	c.sessions[key] = cs
+}
+
+// sessionFile is what is persisted by --tls-session-cache
+type sessionFile struct {
+	// sessions verified by other means must not be resumed
+	Verify   string
+	Sessions map[string]sessionEntry
+}
+
+type sessionEntry struct {
+	Ticket []byte
+	State  []byte
+}
+
+// sessionVerify describes how server certificates are verified
+func (cmd Cmd) sessionVerify() string {
+	return fmt.Sprintf("insecure=%t cacert=%s", cmd.options.InsecureSkipVerify, cmd.options.CACert)
+}
+
+// setupSessionCache makes all transports share session cache, loading it
+// from --tls-session-cache file, if given. Returned func saves it back.
+func (cmd *Cmd) setupSessionCache() (save func() error, err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "tls session cache")
+	}()
+	save = func() error { return nil }
+	if cmd.options.PinnedPubKey != "" {
+		// resumed session skips VerifyPeerCertificate, so the pin
+		return save, nil
+	}
+	cache := newSessionCache()
+	if cmd.tlsConfig == nil {
+		cmd.tlsConfig = new(tls.Config)
+	}
+	cmd.tlsConfig.ClientSessionCache = cache
+
+	fileName := cmd.options.TLSSessionCache
+	if fileName == "" {
+		return save, nil
+	}
+	if !canPersistSessions {
+		return save, errSessionsNotPersisted
+	}
+	if err := cmd.loadSessions(cache, fileName); err != nil {
+		if !os.IsNotExist(errors.Cause(err)) {
+			return save, err
+		}
+	}
+	return func() error {
+		return errors.WithMessage(cmd.saveSessions(cache, fileName), "tls session cache")
+	}, nil
+}
+
+func (cmd Cmd) loadSessions(cache *sessionCache, fileName string) error {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var f sessionFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return errors.WithMessage(err, fileName)
+	}
+	if f.Verify != cmd.sessionVerify() {
+		cmd.dlogger.Printf("%q: sessions of different verification, ignored", fileName)
+		return nil
+	}
+	for key, e := range f.Sessions {
+		cs, err := decodeSession(e.Ticket, e.State)
+		if err != nil {
+			cmd.dlogger.Printf("%q: session of %q: %v", fileName, key, err)
+			continue
+		}
+		cache.Put(key, cs)
+	}
+	cmd.dlogger.Printf("%q: %d TLS sessions loaded", fileName, len(f.Sessions))
+	return nil
+}
+
+func (cmd Cmd) saveSessions(cache *sessionCache, fileName string) error {
+	f := sessionFile{
+		Verify:   cmd.sessionVerify(),
+		Sessions: make(map[string]sessionEntry),
+	}
+	cache.mu.Lock()
+	for key, cs := range cache.sessions {
+		ticket, state, err := encodeSession(cs)
+		if err != nil {
+			cache.mu.Unlock()
+			return err
+		}
+		f.Sessions[key] = sessionEntry{Ticket: ticket, State: state}
+	}
+	cache.mu.Unlock()
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	// session secrets, so readable by the owner only
+	return writeFileAtomic(fileName, 0600, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
@@ -0,0 +1,25 @@
+//go:build go1.21
+// +build go1.21
+
+package getparty
+
+import "crypto/tls"
+
+const canPersistSessions = true
+
+func encodeSession(cs *tls.ClientSessionState) (ticket, state []byte, err error) {
+	ticket, ss, err := cs.ResumptionState()
+	if err != nil {
+		return nil, nil, err
+	}
+	state, err = ss.Bytes()
+	return ticket, state, err
+}
+
+func decodeSession(ticket, state []byte) (*tls.ClientSessionState, error) {
+	ss, err := tls.ParseSessionState(state)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewResumptionState(ticket, ss)
+}
@@ -0,0 +1,17 @@
+//go:build !go1.21
+// +build !go1.21
+
+package getparty
+
+import "crypto/tls"
+
+// session state can't be serialized before Go 1.21
+const canPersistSessions = false
+
+func encodeSession(*tls.ClientSessionState) (ticket, state []byte, err error) {
+	return nil, nil, errSessionsNotPersisted
+}
+
+func decodeSession(ticket, state []byte) (*tls.ClientSessionState, error) {
+	return nil, errSessionsNotPersisted
+}
@@ -0,0 +1,433 @@
+package getparty
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	torrentExt   = ".torrent"
+	magnetScheme = "magnet:"
+	btihPrefix   = "urn:btih:"
+)
+
+// torrentMeta is what getparty takes of a .torrent file or magnet link: web
+// seeds (BEP 19) to download from over HTTP/FTP and piece hashes to verify
+// content with. There is no peer protocol.
+type torrentMeta struct {
+	name        string
+	length      int64 // 0 if unknown
+	pieceLength int64
+	pieces      []byte // concatenated SHA-1 of pieces, nil if unknown
+	webSeeds    []string
+}
+
+// isTorrentSource reports whether arg is a magnet link or .torrent file
+func isTorrentSource(arg string) bool {
+	return strings.HasPrefix(strings.ToLower(arg), magnetScheme) ||
+		strings.HasSuffix(strings.ToLower(arg), torrentExt)
+}
+
+// loadTorrent reads .torrent file, local or remote, or magnet link. Magnet
+// link has piece hashes only if its xs parameter points to .torrent file.
+func (cmd Cmd) loadTorrent(ctx context.Context, src string) (t *torrentMeta, err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "torrent")
+	}()
+	if !strings.HasPrefix(strings.ToLower(src), magnetScheme) {
+		b, err := cmd.readTorrentFile(ctx, src)
+		if err != nil {
+			return nil, err
+		}
+		t, _, err = parseTorrent(b)
+		return t, err
+	}
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	if xs := q.Get("xs"); xs != "" {
+		b, err := cmd.readTorrentFile(ctx, xs)
+		if err != nil {
+			return nil, err
+		}
+		var infoHash []byte
+		t, infoHash, err = parseTorrent(b)
+		if err != nil {
+			return nil, err
+		}
+		if want := parseBTIH(q.Get("xt")); want != nil && !bytes.Equal(want, infoHash) {
+			return nil, errors.Errorf("%s: info hash %x doesn't match magnet link", xs, infoHash)
+		}
+	} else {
+		t = &torrentMeta{name: q.Get("dn")}
+		if xl := q.Get("xl"); xl != "" {
+			if t.length, err = strconv.ParseInt(xl, 10, 64); err != nil {
+				return nil, errors.WithMessage(err, "xl")
+			}
+		}
+	}
+	for _, ws := range q["ws"] {
+		t.addWebSeed(ws)
+	}
+	if len(t.webSeeds) == 0 {
+		return nil, errors.New("no web seeds, only peers, which aren't supported")
+	}
+	return t, nil
+}
+
+// useTorrent loads torrent of src and returns its web seeds to download
+// from, as alternate urls
+func (cmd *Cmd) useTorrent(ctx context.Context, src string) ([]string, error) {
+	t, err := cmd.loadTorrent(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.options.OutFileName == "" && cmd.options.OutputTemplate == "" {
+		if name := t.fileName(); name != "" {
+			cmd.options.OutFileName = filepath.Join(cmd.options.Dir, name)
+		}
+	}
+	if t.pieces == nil {
+		cmd.logger.Printf(cmd.msgs.T("torrent: no piece hashes, content won't be verified"))
+	}
+	cmd.dlogger.Printf("torrent: %q, web seeds: %q", t.name, t.webSeeds)
+	cmd.torrent = t
+	return t.webSeeds, nil
+}
+
+func (cmd Cmd) readTorrentFile(ctx context.Context, src string) ([]byte, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return ioutil.ReadFile(src)
+	}
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.User = cmd.userInfo
+	cmd.applyHeaders(req)
+	cmd.dlogger.Printf("torrent: GET %q", src)
+	client := cmd.newClient(true, nil)
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: unexpected status: %s", src, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parseTorrent parses single file torrent, it returns info hash as well
+func parseTorrent(b []byte) (*torrentMeta, []byte, error) {
+	d := &bdecoder{b: b}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, ok := v.(map[string]interface{})
+	if !ok || d.infoEnd == 0 {
+		return nil, nil, errors.New("no info dictionary")
+	}
+	info := root["info"].(map[string]interface{})
+	if _, ok := info["files"]; ok {
+		return nil, nil, errors.New("multi-file torrents aren't supported")
+	}
+	t := new(torrentMeta)
+	t.name, _ = info["name"].(string)
+	t.length, _ = info["length"].(int64)
+	t.pieceLength, _ = info["piece length"].(int64)
+	pieces, _ := info["pieces"].(string)
+	t.pieces = []byte(pieces)
+	switch {
+	case t.name == "" || strings.ContainsAny(t.name, `/\`) || t.name == "..":
+		return nil, nil, errors.Errorf("invalid name %q", t.name)
+	case t.length <= 0 || t.pieceLength <= 0:
+		return nil, nil, errors.New("invalid length or piece length")
+	case int64(len(t.pieces)) != (t.length+t.pieceLength-1)/t.pieceLength*sha1.Size:
+		return nil, nil, errors.New("pieces don't match length")
+	}
+	switch seeds := root["url-list"].(type) {
+	case string:
+		t.addWebSeed(seeds)
+	case []interface{}:
+		for _, seed := range seeds {
+			if seed, ok := seed.(string); ok {
+				t.addWebSeed(seed)
+			}
+		}
+	}
+	infoHash := sha1.Sum(b[d.infoStart:d.infoEnd])
+	return t, infoHash[:], nil
+}
+
+// apply checks that content is the torrent's one and sets piece hashes of s
+func (t *torrentMeta) apply(s *Session) error {
+	if t.length != 0 && s.ContentLength != t.length {
+		return errors.Errorf("torrent: %q is of length %d, torrent is of %d", s.Location, s.ContentLength, t.length)
+	}
+	if t.pieces != nil {
+		s.PieceLength = t.pieceLength
+		s.PieceHashes = hex.EncodeToString(t.pieces)
+	}
+	return nil
+}
+
+// addWebSeed adds url of the file, BEP 19 url ending with / is of directory
+func (t *torrentMeta) addWebSeed(seed string) {
+	if seed == "" {
+		return
+	}
+	if strings.HasSuffix(seed, "/") {
+		seed += url.PathEscape(t.name)
+	}
+	for _, ws := range t.webSeeds {
+		if ws == seed {
+			return
+		}
+	}
+	t.webSeeds = append(t.webSeeds, seed)
+}
+
+// fileName is the name to save to, in case there is no -o
+func (t *torrentMeta) fileName() string {
+	if name, err := safeFileName(t.name); err == nil && t.name != "" {
+		return name
+	}
+	if u, err := url.Parse(t.webSeeds[0]); err == nil && path.Base(u.Path) != "/" {
+		return path.Base(u.Path)
+	}
+	return ""
+}
+
+// parseBTIH returns info hash of magnet xt, hex or base32 encoded, or nil
+func parseBTIH(xt string) []byte {
+	if !strings.HasPrefix(strings.ToLower(xt), btihPrefix) {
+		return nil
+	}
+	hash := xt[len(btihPrefix):]
+	var b []byte
+	var err error
+	switch len(hash) {
+	case 2 * sha1.Size:
+		b, err = hex.DecodeString(hash)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// torrentExisting checks pieces of existing output file against torrent
+// hashes and leaves only mismatching ones to download, like zsyncExisting
+// does with blocks.
+func (cmd Cmd) torrentExisting(s *Session, maxParts int) (ok bool, err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "torrent")
+	}()
+	fi, err := os.Stat(s.SuggestedFileName)
+	if err != nil || fi.Size() == 0 || s.PieceHashes == "" || !s.isAcceptRanges() {
+		return false, nil
+	}
+	seedName := s.SuggestedFileName + torrentExt + "-seed"
+	if err := os.Rename(s.SuggestedFileName, seedName); err != nil {
+		return false, err
+	}
+	seed, err := os.Open(seedName)
+	if err != nil {
+		return false, err
+	}
+	found, err := s.matchPieces(seed)
+	if err == nil {
+		s.Parts, err = makeBlockParts(s.SuggestedFileName, found, s.PieceLength, s.ContentLength, seed, maxParts)
+	}
+	if e := seed.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return false, err
+	}
+	var good int
+	for _, off := range found {
+		if off >= 0 {
+			good++
+		}
+	}
+	cmd.logger.Printf(cmd.msgs.T("torrent: %d of %d pieces of %q are good already"), good, len(found), s.SuggestedFileName)
+	return true, os.Remove(seedName)
+}
+
+// matchPieces returns offset of every piece of r, which matches its hash,
+// -1 otherwise
+func (s Session) matchPieces(r io.ReaderAt) ([]int64, error) {
+	hashes, err := hex.DecodeString(s.PieceHashes)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]int64, len(hashes)/sha1.Size)
+	piece := make([]byte, s.PieceLength)
+	for i := range found {
+		off := int64(i) * s.PieceLength
+		n := s.PieceLength
+		if rest := s.ContentLength - off; rest < n {
+			n = rest
+		}
+		m, err := r.ReadAt(piece[:n], off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		found[i] = -1
+		if sum := sha1.Sum(piece[:m]); int64(m) == n && bytes.Equal(sum[:], hashes[i*sha1.Size:(i+1)*sha1.Size]) {
+			found[i] = off
+		}
+	}
+	return found, nil
+}
+
+// checkPieces verifies saved file against piece hashes of torrent
+func (s Session) checkPieces() error {
+	if s.PieceHashes == "" {
+		return nil
+	}
+	f, err := os.Open(s.SuggestedFileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	found, err := s.matchPieces(f)
+	if err != nil {
+		return err
+	}
+	var bad []string
+	for i, off := range found {
+		if off < 0 {
+			bad = append(bad, strconv.Itoa(i))
+		}
+	}
+	if len(bad) != 0 {
+		if len(bad) > 10 {
+			bad = append(bad[:10], "...")
+		}
+		return errors.Errorf("%q: %d of %d pieces don't match torrent hashes (%s)", s.SuggestedFileName, len(bad), len(found), strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// bdecoder decodes bencoding: strings, int64, []interface{} and
+// map[string]interface{}. Span of top level info dictionary is kept, as its
+// SHA-1 is the info hash.
+type bdecoder struct {
+	b                  []byte
+	pos                int
+	infoStart, infoEnd int
+}
+
+func (d *bdecoder) decode(depth int) (interface{}, error) {
+	if depth > 64 {
+		return nil, errors.New("bencode: too deep")
+	}
+	if d.pos >= len(d.b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch c := d.b[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.b[d.pos:], 'e')
+		if end < 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n, err := strconv.ParseInt(string(d.b[d.pos+1:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, errors.WithMessage(err, "bencode")
+		}
+		d.pos += end + 1
+		return n, nil
+	case c == 'l':
+		d.pos++
+		var list []interface{}
+		for d.pos < len(d.b) && d.b[d.pos] != 'e' {
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		if d.pos >= len(d.b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		d.pos++
+		return list, nil
+	case c == 'd':
+		d.pos++
+		dict := make(map[string]interface{})
+		for d.pos < len(d.b) && d.b[d.pos] != 'e' {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, errors.New("bencode: dictionary key isn't a string")
+			}
+			start := d.pos
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if depth == 0 && k == "info" {
+				if _, ok := v.(map[string]interface{}); ok {
+					d.infoStart, d.infoEnd = start, d.pos
+				}
+			}
+			dict[k] = v
+		}
+		if d.pos >= len(d.b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		d.pos++
+		return dict, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(d.b[d.pos:], ':')
+		if colon < 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n, err := strconv.Atoi(string(d.b[d.pos : d.pos+colon]))
+		if err != nil || n < 0 {
+			return nil, errors.New("bencode: invalid string length")
+		}
+		start := d.pos + colon + 1
+		if n > len(d.b)-start {
+			return nil, io.ErrUnexpectedEOF
+		}
+		d.pos = start + n
+		return string(d.b[start:d.pos]), nil
+	default:
+		return nil, errors.Errorf("bencode: unexpected %q at %d", c, d.pos)
+	}
+}
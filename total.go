@@ -0,0 +1,140 @@
+package getparty
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vbauerster/mpb/v5"
+	"github.com/vbauerster/mpb/v5/decor"
+)
+
+// totalStats is aggregate progress of all parts of a session
+type totalStats struct {
+	written int64
+	total   int64
+	speed   float64 // bytes per second, since the session start
+	eta     time.Duration
+	retries uint32
+}
+
+// totalTracker samples parts of a session, so aggregate bar and text
+// summary don't need to take locks of the parts themselves.
+type totalTracker struct {
+	ws      *workStealer
+	start   time.Time
+	initial int64
+	mu      sync.Mutex
+	last    totalStats
+}
+
+func newTotalTracker(ws *workStealer) *totalTracker {
+	t := &totalTracker{
+		ws:    ws,
+		start: time.Now(),
+	}
+	t.sample()
+	t.initial = t.last.written
+	return t
+}
+
+func (t *totalTracker) sample() totalStats {
+	t.ws.mu.Lock()
+	s := totalStats{
+		total:   t.ws.session.ContentLength,
+		retries: atomic.LoadUint32(&globTry),
+	}
+	for _, p := range t.ws.session.Parts {
+		p.mu.Lock()
+		s.written += p.Written
+		p.mu.Unlock()
+	}
+	t.ws.mu.Unlock()
+	// bytes of previous sessions don't count towards speed
+	if elapsed := time.Since(t.start).Seconds(); elapsed > 0 {
+		s.speed = float64(s.written-t.initial) / elapsed
+	}
+	if s.speed > 0 && s.total > 0 {
+		s.eta = time.Duration(float64(s.total-s.written)/s.speed) * time.Second
+	}
+	t.mu.Lock()
+	t.last = s
+	t.mu.Unlock()
+	return s
+}
+
+func (t *totalTracker) stats() totalStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last
+}
+
+// makeBar adds aggregate bar above or below bars of the parts, status is
+// appended to it
+func (t *totalTracker) makeBar(progress *mpb.Progress, top bool, status func() string) *mpb.Bar {
+	priority := math.MaxInt32
+	if top {
+		priority = -1
+	}
+	return progress.AddBar(t.ws.session.ContentLength,
+		mpb.TrimSpace(),
+		mpb.BarStyle(" =>- "),
+		mpb.BarPriority(priority),
+		mpb.PrependDecorators(
+			decor.Name("Total", decor.WCSyncWidthR),
+			decor.OnComplete(decor.NewPercentage("%.2f", decor.WCSyncSpace), "100%"),
+		),
+		mpb.AppendDecorators(
+			decor.CountersKibiByte("%.1f / %.1f"),
+			decor.Any(func(decor.Statistics) string {
+				s := t.stats()
+				return fmt.Sprintf(" %.1f/s ETA %s R:%d%s", decor.SizeB1024(int64(s.speed)), s.eta, s.retries, status())
+			}),
+		),
+	)
+}
+
+// run samples progress each refreshRate, updating bar if it isn't nil, and
+// writes text summary to w each interval, if w isn't nil, until ctx is done.
+func (t *totalTracker) run(ctx context.Context, bar *mpb.Bar, w io.Writer, interval time.Duration, msgs catalog) {
+	if bar == nil && w == nil {
+		return
+	}
+	ticker := time.NewTicker(refreshRate * time.Millisecond)
+	defer ticker.Stop()
+	lastText := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			s := t.sample()
+			if bar != nil {
+				bar.SetCurrent(s.written)
+			}
+			if w != nil && time.Since(lastText) >= interval {
+				lastText = time.Now()
+				t.writeText(w, s, msgs)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *totalTracker) writeText(w io.Writer, s totalStats, msgs catalog) {
+	var percent int64
+	if s.total > 0 {
+		percent = s.written * 100 / s.total
+	}
+	fmt.Fprintf(w, msgs.T("Total: %.1f / %.1f (%d%%), %.1f/s, ETA %s, retries %d\n"),
+		decor.SizeB1024(s.written),
+		decor.SizeB1024(s.total),
+		percent,
+		decor.SizeB1024(int64(s.speed)),
+		s.eta,
+		s.retries,
+	)
+}
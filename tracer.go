@@ -0,0 +1,206 @@
+package getparty
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	otlpTracesPath = "/v1/traces"
+	otlpSpanClient = 3 // SPAN_KIND_CLIENT
+	otlpStatusErr  = 2 // STATUS_CODE_ERROR
+)
+
+// tracer collects spans of the run and exports them to OTLP/HTTP collector
+// in json encoding. Nil *tracer is valid and records nothing, the same is
+// true for spans it returns, so callers don't need to check mode.
+type tracer struct {
+	endpoint string
+	traceID  string
+	mu       sync.Mutex
+	spans    []otlpSpan
+}
+
+// span is a timed operation, it's recorded by tracer on end
+type span struct {
+	t      *tracer
+	id     string
+	parent string
+	name   string
+	start  time.Time
+	attrs  []otlpAttr
+}
+
+type otlpSpan struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"`
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr  `json:"attributes,omitempty"`
+	Status       *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	String *string `json:"stringValue,omitempty"`
+	Int    *string `json:"intValue,omitempty"` // int64 is a string in json encoding
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func newTracer(endpoint string) *tracer {
+	if endpoint == "" {
+		return nil
+	}
+	return &tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + otlpTracesPath,
+		traceID:  randomHex(16),
+	}
+}
+
+// start begins root span of the trace
+func (t *tracer) start(name string) *span {
+	if t == nil {
+		return nil
+	}
+	return &span{
+		t:     t,
+		id:    randomHex(8),
+		name:  name,
+		start: time.Now(),
+	}
+}
+
+// child begins span, which is a part of s
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	c := s.t.start(name)
+	c.parent = s.id
+	return c
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	var v otlpValue
+	switch value := value.(type) {
+	case int:
+		str := strconv.Itoa(value)
+		v.Int = &str
+	case int64:
+		str := strconv.FormatInt(value, 10)
+		v.Int = &str
+	case string:
+		v.String = &value
+	default:
+		return
+	}
+	s.attrs = append(s.attrs, otlpAttr{Key: key, Value: v})
+}
+
+// end records s, failed one if err isn't nil
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	rec := otlpSpan{
+		TraceID:      s.t.traceID,
+		SpanID:       s.id,
+		ParentSpanID: s.parent,
+		Name:         s.name,
+		Kind:         otlpSpanClient,
+		Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+		End:          strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:   s.attrs,
+	}
+	if err != nil {
+		rec.Status = &otlpStatus{Code: otlpStatusErr, Message: err.Error()}
+	}
+	s.t.mu.Lock()
+	s.t.spans = append(s.t.spans, rec)
+	s.t.mu.Unlock()
+}
+
+// flush exports spans recorded so far. Collector being down shouldn't fail
+// the download, so caller just logs the error.
+func (t *tracer) flush(ctx context.Context) (err error) {
+	if t == nil {
+		return nil
+	}
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "otlp")
+	}()
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+	name := cmdName
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttr{{Key: "service.name", Value: otlpValue{String: &name}}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": cmdName},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,216 @@
+package getparty
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+var privateNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",   // NAT64, embeds any IPv4 address
+	"64:ff9b:1::/48", // local NAT64
+	"2002::/16",      // 6to4, embeds any IPv4 address
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// newTransport returns transport with user's network options applied.
+// Every client of the program should get its transport from here, so
+// options are applied consistently.
+func (cmd Cmd) newTransport(pooled bool) *http.Transport {
+	var t *http.Transport
+	if pooled {
+		t = cleanhttp.DefaultPooledTransport()
+	} else {
+		t = cleanhttp.DefaultTransport()
+	}
+	t.DialContext = cmd.newDialer().DialContext
+	// probe must see the same length as ranges of parts do, decoding is
+	// up to --compressed
+	t.DisableCompression = true
+	t.TLSHandshakeTimeout = time.Duration(cmd.options.Timeout) * time.Second
+	if cmd.tlsConfig != nil {
+		t.TLSClientConfig = cmd.tlsConfig.Clone()
+	}
+	if cmd.options.Proxy != "" {
+		if proxy, err := url.Parse(cmd.options.Proxy); err == nil {
+			t.Proxy = http.ProxyURL(proxy)
+		}
+	}
+	if cmd.options.SafeResolve || cmd.options.UnixSocket != "" {
+		// proxy would resolve target on our behalf, bypassing the check,
+		// and the socket is the only way out
+		t.Proxy = nil
+	}
+	switch {
+	case cmd.options.HTTP11:
+		// non-nil empty map disables HTTP/2 over TLS
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	case cmd.options.HTTP2:
+		// custom dialer and tls config would otherwise disable it
+		t.ForceAttemptHTTP2 = true
+		// h2c goes direct, proxy is for HTTP/1.1
+		if cmd.options.Proxy == "" {
+			t.RegisterProtocol("http", cmd.newH2CTransport())
+		}
+	case cmd.options.HTTP3:
+		tlsConfig := new(tls.Config)
+		if cmd.tlsConfig != nil {
+			tlsConfig = cmd.tlsConfig.Clone()
+		}
+		t.RegisterProtocol("https", HTTP3Transport(tlsConfig, cmd.newDialer().lookup))
+	}
+	cmd.registerProtocols(t)
+	return t
+}
+
+// HTTP3Transport returns round tripper of --http3, which connects to
+// ip:port given by lookup. It's nil, unless the program is built with
+// HTTP/3 support, which needs newer Go than the rest, see cmd/getparty-h3.
+var HTTP3Transport func(tlsConfig *tls.Config, lookup func(ctx context.Context, address string) (string, error)) http.RoundTripper
+
+// newH2CTransport returns HTTP/2 transport for http urls, which assumes
+// server speaks cleartext HTTP/2 without upgrade. All parts share single
+// connection per host.
+func (cmd Cmd) newH2CTransport() *http2.Transport {
+	dialer := cmd.newDialer()
+	return &http2.Transport{
+		AllowHTTP:          true,
+		DisableCompression: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		},
+	}
+}
+
+// newRoundTripper returns transport from newTransport, wrapped with
+// simulator, if asked for, and authTransport, if user has provided
+// credentials or token
+func (cmd Cmd) newRoundTripper(pooled bool) http.RoundTripper {
+	return cmd.wrap(cmd.newTransport(pooled))
+}
+
+func (cmd Cmd) wrap(t *http.Transport) http.RoundTripper {
+	rt := cmd.logFile.wrap(cmd.sim.wrap(t))
+	if cmd.auth == nil {
+		return rt
+	}
+	return authTransport{base: rt, auth: cmd.auth}
+}
+
+// newClient returns client, which follows redirects, with transport
+// from newRoundTripper
+func (cmd Cmd) newClient(pooled bool, jar http.CookieJar) *http.Client {
+	return &http.Client{
+		Transport: cmd.newRoundTripper(pooled),
+		Jar:       jar,
+	}
+}
+
+// newProbeClient returns client for follow and mirror probes, which bounds
+// response header size and time, so broken or malicious server can't hang
+// the probe phase, where no part timeouts apply yet.
+func (cmd Cmd) newProbeClient(jar http.CookieJar) *http.Client {
+	t := cmd.newTransport(false)
+	t.MaxResponseHeaderBytes = int64(cmd.options.MaxHeaderSize)
+	t.ResponseHeaderTimeout = time.Duration(cmd.options.Timeout) * time.Second
+	return &http.Client{
+		Transport: cmd.wrap(t),
+		Jar:       jar,
+	}
+}
+
+// newDialer returns dialer with -4, -6, --resolve, --dns-servers,
+// --connect-to, --unix-socket and --safe-resolve applied
+func (cmd Cmd) newDialer() *dialer {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}
+	if cmd.options.SafeResolve {
+		d.Control = safeControl
+	}
+	if len(cmd.dns) != 0 {
+		d.Resolver = newResolver(cmd.dns)
+	}
+	dialer := &dialer{
+		Dialer:     d,
+		resolve:    cmd.resolve,
+		connectTo:  cmd.connectTo,
+		unixSocket: cmd.options.UnixSocket,
+	}
+	switch {
+	case cmd.options.IPv4:
+		dialer.network = "tcp4"
+	case cmd.options.IPv6:
+		dialer.network = "tcp6"
+	}
+	return dialer
+}
+
+// registerProtocols makes ftp, sftp and object store urls available to t
+func (cmd Cmd) registerProtocols(t *http.Transport) {
+	t.RegisterProtocol("ftp", ftpRoundTripper{
+		dialer: cmd.newDialer(),
+	})
+	t.RegisterProtocol("sftp", newSftpRoundTripper(cmd.newDialer(), cmd.options.InsecureSkipVerify))
+	t.RegisterProtocol("s3", newS3RoundTripper(t))
+	t.RegisterProtocol("gs", newGsRoundTripper(t))
+	t.RegisterProtocol("az", newAzRoundTripper(t))
+}
+
+// safeControl refuses connections to private, loopback and link-local
+// addresses. It runs after DNS resolution for every dial, redirects
+// included, so it can't be fooled by a hostname.
+func safeControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("safe-resolve: invalid address %q", host)
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return errors.Errorf("safe-resolve: refusing to connect to %s", ip)
+		}
+	}
+	return nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
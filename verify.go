@@ -0,0 +1,62 @@
+package getparty
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// verifyError is failure of the saved file to match zsync or torrent hashes
+type verifyError struct {
+	Err error
+}
+
+func (e verifyError) Error() string {
+	return e.Err.Error()
+}
+
+// prepareVerifyRetry turns session, which file has failed verification,
+// into state of a new session to resume from: with piece hashes only the
+// mismatching pieces are to be downloaded, otherwise the whole file. Hashes
+// stay in the state, so the retry is verified as well.
+func (cmd Cmd) prepareVerifyRetry(s *Session, userUrl string) (stateName string, err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "verify retry")
+	}()
+	maxParts := int(cmd.options.Parts)
+	if s.PieceHashes != "" && s.isAcceptRanges() {
+		seedName := s.SuggestedFileName + torrentExt + "-seed"
+		if err := os.Rename(s.SuggestedFileName, seedName); err != nil {
+			return "", err
+		}
+		seed, err := os.Open(seedName)
+		if err != nil {
+			return "", err
+		}
+		found, err := s.matchPieces(seed)
+		if err == nil {
+			s.Parts, err = makeBlockParts(s.SuggestedFileName, found, s.PieceLength, s.ContentLength, seed, maxParts)
+		}
+		if e := seed.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := os.Remove(seedName); err != nil {
+			return "", err
+		}
+	} else {
+		if err := os.Remove(s.SuggestedFileName); err != nil {
+			return "", err
+		}
+		if !s.isAcceptRanges() {
+			maxParts = 1
+		}
+		s.Parts = s.calcParts(int64(maxParts))
+	}
+	s.Location = userUrl
+	stateName = s.SuggestedFileName + "." + cmd.options.StateFormat
+	return stateName, s.saveState(stateName)
+}
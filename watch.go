@@ -0,0 +1,48 @@
+package getparty
+
+import (
+	"context"
+	"time"
+)
+
+// watch downloads args every --watch interval, but only if remote has
+// changed since: requests are conditional on ETag of the last download and
+// on mtime of the saved file, which is set from Last-Modified. Replaced
+// versions are kept up to --keep-versions. Failure of one check doesn't
+// stop watching, only ctx does.
+func (cmd *Cmd) watch(ctx context.Context, args []string, mirrorList string) error {
+	cmd.options.Timestamping = true
+	// unattended, so failed download is resumed by the next check, unless
+	// remote has changed meanwhile
+	cmd.options.AutoContinue = true
+	cmd.options.AllowRestart = true
+	// download mutates options, so every check starts from the same ones
+	base := *cmd.options
+	var fileName string
+	for {
+		*cmd.options = base
+		cmd.options.HeaderMap = make(map[string]string, len(base.HeaderMap))
+		for k, v := range base.HeaderMap {
+			cmd.options.HeaderMap[k] = v
+		}
+		if fileName != "" {
+			// name of Content-Disposition may differ from url's one
+			cmd.options.OutFileName = fileName
+		}
+		err := cmd.runTries(ctx, args, mirrorList)
+		if ctx.Err() != nil {
+			return err
+		}
+		err = cmd.runHooks(err)
+		if err != nil {
+			cmd.logger.Printf("watch: %v", err)
+		} else if !cmd.unchanged {
+			fileName = cmd.options.OutFileName
+		}
+		select {
+		case <-time.After(cmd.options.Watch):
+		case <-ctx.Done():
+			return ExpectedError{ctx.Err()}
+		}
+	}
+}
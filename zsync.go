@@ -0,0 +1,409 @@
+package getparty
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/md4"
+)
+
+const zsyncExt = ".zsync"
+
+// zsyncControl is parsed .zsync control file, as made by zsyncmake: text
+// headers, followed by rolling and strong checksums of every block.
+type zsyncControl struct {
+	blockSize     int64
+	length        int64
+	rsumBytes     int
+	checksumBytes int
+	sha1          string
+	rsums         []uint32
+	checksums     [][]byte
+}
+
+func parseZsync(r io.Reader) (*zsyncControl, error) {
+	br := bufio.NewReader(r)
+	c := new(zsyncControl)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, errors.WithMessage(err, "header")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, errors.Errorf("malformed header %q", line)
+		}
+		key, value := line[:i], strings.TrimSpace(line[i+1:])
+		switch key {
+		case "Blocksize":
+			c.blockSize, err = strconv.ParseInt(value, 10, 64)
+		case "Length":
+			c.length, err = strconv.ParseInt(value, 10, 64)
+		case "Hash-Lengths":
+			var seqMatches int
+			_, err = fmt.Sscanf(value, "%d,%d,%d", &seqMatches, &c.rsumBytes, &c.checksumBytes)
+		case "SHA-1":
+			c.sha1 = strings.ToLower(value)
+		}
+		if err != nil {
+			return nil, errors.WithMessage(err, key)
+		}
+	}
+	switch {
+	case c.blockSize <= 0 || c.length < 0:
+		return nil, errors.New("missing Blocksize or Length")
+	case c.rsumBytes < 1 || c.rsumBytes > 4 || c.checksumBytes < 1 || c.checksumBytes > md4.Size:
+		return nil, errors.Errorf("unsupported Hash-Lengths %d,%d", c.rsumBytes, c.checksumBytes)
+	}
+	blocks := (c.length + c.blockSize - 1) / c.blockSize
+	c.rsums = make([]uint32, blocks)
+	c.checksums = make([][]byte, blocks)
+	buf := make([]byte, c.rsumBytes+c.checksumBytes)
+	for i := range c.rsums {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, errors.WithMessage(err, "checksums")
+		}
+		// last rsumBytes of big endian a, b pair
+		for _, b := range buf[:c.rsumBytes] {
+			c.rsums[i] = c.rsums[i]<<8 | uint32(b)
+		}
+		c.checksums[i] = append([]byte(nil), buf[c.rsumBytes:]...)
+	}
+	return c, nil
+}
+
+// rsumMask keeps bits of rolling checksum, which are in control file
+func (c *zsyncControl) rsumMask() uint32 {
+	return 0xffffffff >> uint(32-8*c.rsumBytes)
+}
+
+// rsum is rolling checksum of zsync (and rsync): a is sum of bytes, b is
+// sum of a at every byte of the block, both are 16 bit.
+type rsum struct {
+	a, b uint16
+}
+
+func newRsum(block []byte) rsum {
+	var r rsum
+	n := len(block)
+	for i, c := range block {
+		r.a += uint16(c)
+		r.b += uint16(n-i) * uint16(c)
+	}
+	return r
+}
+
+// roll moves block of size n one byte forward: out leaves, in enters
+func (r *rsum) roll(out, in byte, n int) {
+	r.a += uint16(in) - uint16(out)
+	r.b += r.a - uint16(n)*uint16(out)
+}
+
+func (r rsum) value() uint32 {
+	return uint32(r.a)<<16 | uint32(r.b)
+}
+
+// matchBlocks scans seed for blocks of control and returns offset in seed
+// of every block found, -1 for the rest. Last block is zero padded up to
+// block size, as zsyncmake does, so seed is scanned the same way.
+func (c *zsyncControl) matchBlocks(seed io.Reader) ([]int64, error) {
+	found := make([]int64, len(c.rsums))
+	index := make(map[uint32][]int)
+	mask := c.rsumMask()
+	for i, r := range c.rsums {
+		found[i] = -1
+		index[r&mask] = append(index[r&mask], i)
+	}
+	w := &seedWindow{r: seed, size: int(c.blockSize)}
+	var r rsum
+	fresh := true
+	for off := int64(0); ; {
+		block, err := w.at(off)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			return found, nil
+		}
+		if fresh {
+			r, fresh = newRsum(block), false
+		}
+		var matched bool
+		if candidates := index[r.value()&mask]; len(candidates) != 0 {
+			sum := md4Sum(block)
+			for _, i := range candidates {
+				if found[i] == -1 && bytes.Equal(sum[:c.checksumBytes], c.checksums[i]) {
+					found[i] = off
+					matched = true
+				}
+			}
+		}
+		if matched {
+			// blocks of the new content don't overlap
+			off += c.blockSize
+			fresh = true
+			continue
+		}
+		out := block[0] // block is gone, once window moves
+		next, err := w.at(off + 1)
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return found, nil
+		}
+		r.roll(out, next[len(next)-1], len(next))
+		off++
+	}
+}
+
+// seedWindow reads seed sequentially, keeping block size window of it and
+// some bytes ahead. Window past the end of seed is zero padded, window,
+// which starts past the end, is nil.
+type seedWindow struct {
+	r     io.Reader
+	size  int
+	buf   []byte
+	start int64 // offset of buf[0]
+	eof   bool
+}
+
+func (w *seedWindow) at(off int64) ([]byte, error) {
+	for !w.eof && off+int64(w.size) > w.start+int64(len(w.buf)) {
+		// drop what is behind, read more ahead
+		drop := int(off - w.start)
+		w.buf = append(w.buf[:0], w.buf[drop:]...)
+		w.start = off
+		chunk := make([]byte, 1<<20)
+		n, err := io.ReadFull(w.r, chunk)
+		w.buf = append(w.buf, chunk[:n]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			w.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	i := int(off - w.start)
+	if i >= len(w.buf) {
+		return nil, nil
+	}
+	if i+w.size > len(w.buf) {
+		block := make([]byte, w.size)
+		copy(block, w.buf[i:])
+		return block, nil
+	}
+	return w.buf[i : i+w.size], nil
+}
+
+func md4Sum(b []byte) []byte {
+	h := md4.New()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// zsyncExisting reuses blocks of existing output file, which match control
+// file url.zsync, so only the rest is requested. Blocks found locally make
+// parts, which are done already, missing ones are joined into up to maxParts
+// parts to download. Returns false if there is no file to reuse.
+func (cmd Cmd) zsyncExisting(ctx context.Context, jar http.CookieJar, s *Session, maxParts int) (ok bool, err error) {
+	defer func() {
+		// just add method name, without stack trace at the point
+		err = errors.WithMessage(err, "zsync")
+	}()
+	fi, err := os.Stat(s.SuggestedFileName)
+	if err != nil || fi.Size() == 0 {
+		return false, nil
+	}
+	switch {
+	case s.SplitPieces != 0:
+		return false, ExpectedError{errors.New("not supported with split pieces")}
+	case s.ContentLength <= 0 || !s.isAcceptRanges():
+		return false, ExpectedError{errors.Errorf("%q: server doesn't support byte ranges or length is unknown", s.SuggestedFileName)}
+	}
+
+	control, err := cmd.fetchZsync(ctx, jar, s.Location+zsyncExt)
+	if err != nil {
+		return false, err
+	}
+	if control.length != s.ContentLength {
+		return false, errors.Errorf("control file is of length %d, content is of %d", control.length, s.ContentLength)
+	}
+
+	seedName := s.SuggestedFileName + zsyncExt + "-seed"
+	if err := os.Rename(s.SuggestedFileName, seedName); err != nil {
+		return false, err
+	}
+	seed, err := os.Open(seedName)
+	if err != nil {
+		return false, err
+	}
+	found, err := control.matchBlocks(seed)
+	if err == nil {
+		s.Parts, err = makeBlockParts(s.SuggestedFileName, found, control.blockSize, control.length, seed, maxParts)
+	}
+	if e := seed.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return false, err
+	}
+	s.ContentSHA1 = control.sha1
+
+	var reused int64
+	for _, p := range s.Parts {
+		if p.isDone() {
+			reused += p.Written
+		}
+	}
+	cmd.logger.Printf(cmd.msgs.T("zsync: %d of %d bytes reused from %q"), reused, s.ContentLength, s.SuggestedFileName)
+	return true, os.Remove(seedName)
+}
+
+func (cmd Cmd) fetchZsync(ctx context.Context, jar http.CookieJar, u string) (*zsyncControl, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.User = cmd.userInfo
+	cmd.applyHeaders(req)
+	cmd.dlogger.Printf("zsync: GET %q", u)
+	client := cmd.newClient(true, jar)
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: unexpected status: %s", u, resp.Status)
+	}
+	control, err := parseZsync(resp.Body)
+	return control, errors.WithMessage(err, u)
+}
+
+// makeBlockParts writes runs of found blocks of content of length into part
+// files and leaves runs of missing ones to download. found is offset of
+// every block in seed, -1 if missing. Short runs of found blocks between
+// missing ones are downloaded too, until there are at most maxParts to
+// download.
+func makeBlockParts(fileName string, found []int64, blockSize, length int64, seed io.ReaderAt, maxParts int) ([]*Part, error) {
+	type run struct {
+		first, last int // blocks
+		local       bool
+	}
+	var runs []run
+	for i, off := range found {
+		local := off >= 0
+		if n := len(runs); n != 0 && runs[n-1].local == local {
+			runs[n-1].last = i
+			continue
+		}
+		runs = append(runs, run{first: i, last: i, local: local})
+	}
+	if maxParts < 1 {
+		maxParts = 1
+	}
+	for {
+		var missing int
+		shortest := -1
+		for i, r := range runs {
+			if !r.local {
+				missing++
+			} else if i > 0 && i < len(runs)-1 && (shortest == -1 || r.last-r.first < runs[shortest].last-runs[shortest].first) {
+				shortest = i
+			}
+		}
+		if missing <= maxParts || shortest == -1 {
+			break
+		}
+		merged := run{first: runs[shortest-1].first, last: runs[shortest+1].last}
+		runs = append(append(runs[:shortest-1], merged), runs[shortest+2:]...)
+	}
+
+	parts := make([]*Part, len(runs))
+	for i, r := range runs {
+		p := &Part{
+			FileName: fileName,
+			Start:    int64(r.first) * blockSize,
+			Stop:     (int64(r.last)+1)*blockSize - 1,
+		}
+		if i != 0 {
+			p.FileName = fmt.Sprintf("%s.part%d", fileName, i)
+		}
+		if p.Stop >= length {
+			p.Stop = length - 1
+		}
+		parts[i] = p
+		if !r.local {
+			continue
+		}
+		f, err := os.Create(p.FileName)
+		if err != nil {
+			return nil, err
+		}
+		block := make([]byte, blockSize)
+		for b := r.first; b <= r.last; b++ {
+			n := blockSize
+			if rest := length - int64(b)*blockSize; rest < n {
+				n = rest
+			}
+			// block may have matched with zero padding past the seed end
+			var m int
+			m, err = seed.ReadAt(block[:n], found[b])
+			if err == io.EOF {
+				err = nil
+				for i := m; i < int(n); i++ {
+					block[i] = 0
+				}
+			}
+			if err != nil {
+				break
+			}
+			if _, err = f.Write(block[:n]); err != nil {
+				break
+			}
+			p.Written += n
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// checkSHA1 verifies saved file against SHA-1 of zsync control file
+func (s Session) checkSHA1() error {
+	if s.ContentSHA1 == "" {
+		return nil
+	}
+	f, err := os.Open(s.SuggestedFileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != s.ContentSHA1 {
+		return errors.Errorf("%q SHA-1 %s, expected %s", s.SuggestedFileName, sum, s.ContentSHA1)
+	}
+	return nil
+}